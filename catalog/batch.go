@@ -0,0 +1,190 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const (
+	MaxBatchSize = 1000
+	// batch operations
+	BatchOpCreate = "create"
+	BatchOpUpdate = "update"
+	BatchOpDelete = "delete"
+)
+
+// BatchOperation is one item of a batch request
+type BatchOperation struct {
+	Op string           `json:"op"`
+	ID string           `json:"id,omitempty"`
+	TD ThingDescription `json:"td,omitempty"`
+}
+
+// batchResult is the outcome of one batch operation
+type batchResult struct {
+	id      string
+	created bool
+	err     error
+}
+
+// storageWrite is a write operation applied as part of a storage batch
+// A nil td deletes the entry. The event, if any, is added to the outbox.
+type storageWrite struct {
+	id    string
+	td    ThingDescription
+	event *outboxEvent
+}
+
+// batch performs the given operations and returns one result per operation.
+// In atomic mode, either all operations are committed in one storage batch or none of them.
+func (c *Controller) batch(ops []BatchOperation, atomic bool) []batchResult {
+	if atomic {
+		return c.batchAtomic(ops)
+	}
+
+	results := make([]batchResult, len(ops))
+	for i, op := range ops {
+		results[i].id = op.ID
+		err := checkBatchOperation(op)
+		if err != nil {
+			results[i].err = err
+			continue
+		}
+		switch op.Op {
+		case BatchOpCreate:
+			results[i].id, err = c.add(op.TD)
+			results[i].created = err == nil
+		case BatchOpUpdate:
+			err = c.update(op.ID, op.TD, nil)
+		case BatchOpDelete:
+			err = c.delete(op.ID, nil)
+		}
+		results[i].err = err
+	}
+	return results
+}
+
+func (c *Controller) batchAtomic(ops []BatchOperation) []batchResult {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// pending changes of the batch; a nil value marks a deletion
+	pending := make(map[string]ThingDescription)
+	current := func(id string) (ThingDescription, error) {
+		if td, found := pending[id]; found {
+			if td == nil {
+				return nil, &NotFoundError{id + " is not found"}
+			}
+			return td, nil
+		}
+		return c.storage.get(id)
+	}
+
+	var (
+		writes []storageWrite
+		failed bool
+	)
+	results := make([]batchResult, len(ops))
+	for i, op := range ops {
+		results[i].id = op.ID
+		err := checkBatchOperation(op)
+		if err != nil {
+			results[i].err = err
+			failed = true
+			continue
+		}
+		switch op.Op {
+		case BatchOpCreate:
+			var id string
+			id, err = c.prepareAdd(op.TD, "")
+			if err != nil {
+				break
+			}
+			results[i].id = id
+			if _, err = current(id); err == nil {
+				err = &ConflictError{id + " is not unique"}
+				break
+			} else if _, ok := err.(*NotFoundError); !ok {
+				break
+			}
+			if err = c.continueRevision(id, op.TD); err != nil {
+				break
+			}
+			results[i].created = true
+			pending[id] = op.TD
+			writes = append(writes, storageWrite{id, op.TD, createdEvent(op.TD)})
+		case BatchOpUpdate:
+			var oldTD ThingDescription
+			if oldTD, err = current(op.ID); err != nil {
+				break
+			}
+			if err = c.prepareUpdate(oldTD, op.TD); err != nil {
+				break
+			}
+			pending[op.ID] = op.TD
+			writes = append(writes, storageWrite{op.ID, op.TD, updatedEvent(oldTD, op.TD)})
+		case BatchOpDelete:
+			var oldTD ThingDescription
+			if oldTD, err = current(op.ID); err != nil {
+				break
+			}
+			pending[op.ID] = nil
+			writes = append(writes, storageWrite{op.ID, nil, deletedEvent(oldTD)})
+		}
+		if err != nil {
+			results[i].err = err
+			failed = true
+		}
+	}
+
+	if !failed {
+		err := c.storage.writeBatch(writes)
+		if err != nil {
+			for i := range results {
+				results[i].err = err
+			}
+			failed = true
+		}
+	}
+	if failed {
+		// the whole batch is rejected
+		for i := range results {
+			results[i].created = false
+			if results[i].err == nil {
+				results[i].err = &FailedDependencyError{"not applied due to other failed operations in the atomic batch"}
+			}
+		}
+		return results
+	}
+
+	c.signalOutbox()
+
+	return results
+}
+
+// checkBatchOperation checks that the operation has the attributes required by its type
+func checkBatchOperation(op BatchOperation) error {
+	switch op.Op {
+	case BatchOpCreate:
+		if op.TD == nil {
+			return &BadRequestError{"create operation without td"}
+		}
+	case BatchOpUpdate:
+		if op.ID == "" || op.TD == nil {
+			return &BadRequestError{"update operation without id or td"}
+		}
+		if op.TD[wot.KeyThingID] != op.ID {
+			return &BadRequestError{fmt.Sprintf("Resource id (%s) does not match the id in td (%v)", op.ID, op.TD[wot.KeyThingID])}
+		}
+	case BatchOpDelete:
+		if op.ID == "" {
+			return &BadRequestError{"delete operation without id"}
+		}
+	default:
+		return &BadRequestError{fmt.Sprintf("unknown batch operation: %s", op.Op)}
+	}
+	return nil
+}
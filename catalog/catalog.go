@@ -4,7 +4,13 @@ package catalog
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/linksmart/thing-directory/wot"
 )
@@ -27,14 +33,75 @@ func validateThingDescription(td map[string]interface{}) ([]wot.ValidationError,
 	return result, nil
 }
 
+// ThingETag returns the strong entity-tag of the TD, derived from its revision number and content
+// The content hash covers the changes that keep the revision, such as heartbeats, and TDs recreated without history.
+func ThingETag(td ThingDescription) string {
+	revision := strconv.FormatUint(ThingRevision(ThingRegistration(td)), 10)
+	b, err := json.Marshal(td)
+	if err != nil {
+		return `"` + revision + `"`
+	}
+	sum := sha256.Sum256(b)
+	return `"` + revision + "-" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// preconditions are the entity-tags of a conditional request (RFC7232)
+type preconditions struct {
+	ifMatch     string
+	ifNoneMatch string
+}
+
+// matchETag checks whether the etag is included in the value of an If-Match or If-None-Match header
+// Weak entity-tags never match since only strong comparison is supported
+func matchETag(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// check evaluates the preconditions against the currently stored TD
+// A nil receiver represents an unconditional request
+func (p *preconditions) check(current ThingDescription) error {
+	if p == nil {
+		return nil
+	}
+	if p.ifMatch != "" {
+		if current == nil || !matchETag(p.ifMatch, ThingETag(current)) {
+			return &PreconditionFailedError{"If-Match precondition failed"}
+		}
+	}
+	if p.ifNoneMatch != "" {
+		if current != nil && matchETag(p.ifNoneMatch, ThingETag(current)) {
+			return &PreconditionFailedError{"If-None-Match precondition failed"}
+		}
+	}
+	return nil
+}
+
 // Controller interface
 type CatalogController interface {
 	add(d ThingDescription) (string, error)
 	get(id string) (ThingDescription, error)
-	update(id string, d ThingDescription) error
-	patch(id string, d ThingDescription) error
-	delete(id string) error
+	getRevision(id string, revision uint64) (ThingDescription, error)
+	history(id string) ([]ThingDescription, error)
+	restore(id string, revision uint64, pre *preconditions) (bool, error)
+	update(id string, d ThingDescription, pre *preconditions) error
+	put(id string, d ThingDescription, pre *preconditions) (bool, error)
+	register(d ThingDescription, origin string) (bool, error)
+	patch(id string, d ThingDescription, pre *preconditions) error
+	jsonPatch(id string, patch []byte, pre *preconditions) error
+	delete(id string, pre *preconditions) error
+	heartbeat(id string) (*wot.ThingRegistration, error)
+	batch(ops []BatchOperation, atomic bool) []batchResult
 	list(page, perPage int) ([]ThingDescription, int, error)
+	// listAfter returns up to limit TDs following the given cursor, and the cursor of the next page if there are more
+	listAfter(after string, limit int) (tds []ThingDescription, next string, err error)
+	listSorted(sortBy string, desc bool, page, perPage int) ([]ThingDescription, int, error)
+	listAllSorted(sortBy string, desc bool) ([]ThingDescription, error)
 	listAllBytes() ([]byte, error)
 	// Deprecated
 	filterJSONPath(path string, page, perPage int) ([]interface{}, int, error)
@@ -53,12 +120,25 @@ type CatalogController interface {
 }
 
 // Storage interface
+// The writes add the given event, if any, to the outbox in the same atomic operation.
 type Storage interface {
-	add(id string, td ThingDescription) error
-	update(id string, td ThingDescription) error
-	delete(id string) error
+	add(id string, td ThingDescription, event *outboxEvent) error
+	update(id string, td ThingDescription, event *outboxEvent) error
+	delete(id string, event *outboxEvent) error
+	// writeBatch applies all writes atomically, without checking for existence of the entries
+	writeBatch(writes []storageWrite) error
+	// outbox returns up to limit events from the outbox after the given sequence number, in the order of the writes
+	outbox(after uint64, limit int) ([]outboxEvent, error)
+	// removeFromOutbox removes the events up to the given sequence number, once dispatched to all listeners
+	removeFromOutbox(until uint64) error
 	get(id string) (ThingDescription, error)
+	// history returns the previous revisions of a TD, latest first
+	history(id string) ([]ThingDescription, error)
+	// pruneHistory removes the history of the TDs deleted before the given time
+	pruneHistory(deletedBefore time.Time) error
 	list(page, perPage int) ([]ThingDescription, int, error)
+	// listAfter returns up to limit TDs with IDs following the given ID, and whether there are more
+	listAfter(after string, limit int) ([]ThingDescription, bool, error)
 	listAllBytes() ([]byte, error)
 	total() (int, error)
 	iterator() <-chan ThingDescription
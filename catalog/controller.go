@@ -6,10 +6,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	xpath "github.com/antchfx/jsonquery"
@@ -22,14 +26,31 @@ import (
 
 var controllerExpiryCleanupInterval = 60 * time.Second // to be modified in unit tests
 
+// the history of a deleted TD is kept for restoring it, until removed by the cleanup after this period
+var deletedHistoryRetention = 7 * 24 * time.Hour // to be modified in unit tests
+
 type Controller struct {
-	storage   Storage
-	listeners eventHandler
+	storage Storage
+	// the TDs are mirrored from peers and stored by origin and id, see mirrorKey
+	mirrored bool
+	// serializes the writes to allow atomic read-modify-write operations
+	writeLock sync.Mutex
+
+	// the positions of the listeners in the outbox
+	cursors     []*outboxCursor
+	cursorsLock sync.Mutex
+	// sequence number of the last event removed from the outbox
+	removed uint64
+	// closed by Stop
+	stopped chan struct{}
+	// the dispatchers of the listeners
+	dispatchers sync.WaitGroup
 }
 
 func NewController(storage Storage) (CatalogController, error) {
 	c := Controller{
 		storage: storage,
+		stopped: make(chan struct{}),
 	}
 
 	go c.cleanExpired()
@@ -37,11 +58,44 @@ func NewController(storage Storage) (CatalogController, error) {
 	return &c, nil
 }
 
+// AddSubscriber adds a listener of the events
+// Each listener gets the events from the oldest one in the outbox. Until the first listener is added, the events are
+// kept in the outbox.
 func (c *Controller) AddSubscriber(listener EventListener) {
-	c.listeners = append(c.listeners, listener)
+	cursor := &outboxCursor{listener: listener, signal: make(chan struct{}, 1)}
+	c.cursorsLock.Lock()
+	c.cursors = append(c.cursors, cursor)
+	c.cursorsLock.Unlock()
+
+	c.dispatchers.Add(1)
+	go c.dispatchOutbox(cursor)
 }
 
 func (c *Controller) add(td ThingDescription) (string, error) {
+	id, err := c.prepareAdd(td, "")
+	if err != nil {
+		return "", err
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	err = c.continueRevision(id, td)
+	if err != nil {
+		return "", err
+	}
+	err = c.storage.add(id, td, createdEvent(td))
+	if err != nil {
+		return "", err
+	}
+	c.signalOutbox()
+
+	return id, nil
+}
+
+// prepareAdd validates a new TD and sets its id and registration information
+// The origin is set by the directory itself, e.g. for the TDs of the DNS-SD browser. Any origin given in the TD is ignored.
+func (c *Controller) prepareAdd(td ThingDescription, origin string) (string, error) {
 	id, ok := td[wot.KeyThingID].(string)
 	if !ok || id == "" {
 		// System generated id
@@ -59,20 +113,16 @@ func (c *Controller) add(td ThingDescription) (string, error) {
 
 	now := time.Now().UTC()
 	tr := ThingRegistration(td)
+	revision := uint64(1)
 	td[wot.KeyThingRegistration] = wot.ThingRegistration{
 		Created:  &now,
 		Modified: &now,
 		Expires:  computeExpiry(tr, now),
+		Origin:   origin,
+		Revision: &revision,
 		TTL:      ThingTTL(tr),
 	}
 
-	err = c.storage.add(id, td)
-	if err != nil {
-		return "", err
-	}
-
-	go c.listeners.created(td)
-
 	return id, nil
 }
 
@@ -90,12 +140,129 @@ func (c *Controller) get(id string) (ThingDescription, error) {
 	return td, nil
 }
 
-func (c *Controller) update(id string, td ThingDescription) error {
+func (c *Controller) update(id string, td ThingDescription, pre *preconditions) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	oldTD, err := c.storage.get(id)
 	if err != nil {
 		return err
 	}
+	if err := pre.check(oldTD); err != nil {
+		return err
+	}
+
+	err = c.prepareUpdate(oldTD, td)
+	if err != nil {
+		return err
+	}
+
+	err = c.storage.update(id, td, updatedEvent(oldTD, td))
+	if err != nil {
+		return err
+	}
+	c.signalOutbox()
+
+	return nil
+}
+
+// put updates the TD, or creates it with the given id if it does not exist
+// The preconditions are evaluated in the same write as the creation or update. The registration information is set in
+// the given TD, e.g. to compute its entity-tag.
+func (c *Controller) put(id string, td ThingDescription, pre *preconditions) (created bool, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	oldTD, err := c.storage.get(id)
+	if err != nil {
+		if _, notFound := err.(*NotFoundError); !notFound {
+			return false, err
+		}
+		oldTD = nil
+	}
+	if err := pre.check(oldTD); err != nil {
+		return false, err
+	}
+
+	if oldTD == nil {
+		_, err = c.prepareAdd(td, "")
+		if err != nil {
+			return false, err
+		}
+		err = c.continueRevision(id, td)
+		if err != nil {
+			return false, err
+		}
+		err = c.storage.add(id, td, createdEvent(td))
+		if err != nil {
+			return false, err
+		}
+		c.signalOutbox()
+		return true, nil
+	}
+
+	err = c.prepareUpdate(oldTD, td)
+	if err != nil {
+		return false, err
+	}
+	err = c.storage.update(id, td, updatedEvent(oldTD, td))
+	if err != nil {
+		return false, err
+	}
+	c.signalOutbox()
+	return false, nil
+}
+
+// register creates or updates a TD on behalf of the directory itself, with the given origin
+// TDs of other origins, e.g. those registered through the API, are never modified.
+func (c *Controller) register(td ThingDescription, origin string) (created bool, err error) {
+	id, ok := td[wot.KeyThingID].(string)
+	if !ok || id == "" {
+		return false, &BadRequestError{"TD has no id"}
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	oldTD, err := c.storage.get(id)
+	if err != nil {
+		if _, notFound := err.(*NotFoundError); !notFound {
+			return false, err
+		}
+		_, err = c.prepareAdd(td, origin)
+		if err != nil {
+			return false, err
+		}
+		err = c.continueRevision(id, td)
+		if err != nil {
+			return false, err
+		}
+		err = c.storage.add(id, td, createdEvent(td))
+		if err != nil {
+			return false, err
+		}
+		c.signalOutbox()
+		return true, nil
+	}
+
+	if ThingOrigin(ThingRegistration(oldTD)) != origin {
+		return false, &ConflictError{id + " is registered by other means"}
+	}
+	err = c.prepareUpdate(oldTD, td)
+	if err != nil {
+		return false, err
+	}
+	err = c.storage.update(id, td, updatedEvent(oldTD, td))
+	if err != nil {
+		return false, err
+	}
+	c.signalOutbox()
+	return false, nil
+}
 
+// prepareUpdate validates the new version of a TD and sets its registration information
+// The origin of the stored TD is kept.
+func (c *Controller) prepareUpdate(oldTD, td ThingDescription) error {
 	results, err := validateThingDescription(td)
 	if err != nil {
 		return err
@@ -104,101 +271,161 @@ func (c *Controller) update(id string, td ThingDescription) error {
 		return &ValidationError{ValidationErrors: results}
 	}
 
+	//td[wot.KeyThingRegistrationModified] = time.Now().UTC()
 	now := time.Now().UTC()
 	oldTR := ThingRegistration(oldTD)
 	tr := ThingRegistration(td)
+	revision := ThingRevision(oldTR) + 1
 	td[wot.KeyThingRegistration] = wot.ThingRegistration{
 		Created:  oldTR.Created,
 		Modified: &now,
 		Expires:  computeExpiry(tr, now),
+		LastSeen: oldTR.LastSeen,
+		Origin:   ThingOrigin(oldTR),
+		Revision: &revision,
 		TTL:      ThingTTL(tr),
 	}
 
-	err = c.storage.update(id, td)
+	return nil
+}
+
+// patch applies an RFC7396 JSON Merge Patch
+// TODO: Improve patch by reducing the number of (de-)serializations
+func (c *Controller) patch(id string, td ThingDescription, pre *preconditions) error {
+	patchBytes, err := json.Marshal(td)
 	if err != nil {
 		return err
 	}
+	//fmt.Printf("%s", patchBytes)
 
-	go c.listeners.updated(oldTD, td)
-
-	return nil
+	return c.applyPatch(id, pre, func(oldBytes []byte) ([]byte, error) {
+		return jsonpatch.MergePatch(oldBytes, patchBytes)
+	})
 }
 
-// TODO: Improve patch by reducing the number of (de-)serializations
-func (c *Controller) patch(id string, td ThingDescription) error {
-	oldTD, err := c.storage.get(id)
+// jsonPatch applies an RFC6902 JSON Patch
+func (c *Controller) jsonPatch(id string, patchBytes []byte, pre *preconditions) error {
+	patch, err := jsonpatch.DecodePatch(patchBytes)
 	if err != nil {
-		return err
+		return &BadRequestError{fmt.Sprintf("error decoding JSON Patch: %s", err)}
 	}
 
-	// serialize to json for mergepatch input
-	oldBytes, err := json.Marshal(oldTD)
+	return c.applyPatch(id, pre, func(oldBytes []byte) ([]byte, error) {
+		newBytes, err := patch.Apply(oldBytes)
+		if err != nil {
+			switch {
+			case errors.Is(err, jsonpatch.ErrTestFailed),
+				errors.Is(err, jsonpatch.ErrMissing),
+				errors.Is(err, jsonpatch.ErrInvalidIndex):
+				// the patch cannot be applied to the current state of the TD
+				return nil, &ConflictError{fmt.Sprintf("error applying JSON Patch: %s", err)}
+			default:
+				return nil, &BadRequestError{fmt.Sprintf("error applying JSON Patch: %s", err)}
+			}
+		}
+		return newBytes, nil
+	})
+}
+
+// applyPatch updates the TD with the result of the given patch function
+// The patch function takes the serialized stored TD and returns the serialized patched TD.
+func (c *Controller) applyPatch(id string, pre *preconditions, patchFunc func(oldBytes []byte) ([]byte, error)) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	oldTD, err := c.storage.get(id)
 	if err != nil {
 		return err
 	}
-	patchBytes, err := json.Marshal(td)
-	if err != nil {
+	if err := pre.check(oldTD); err != nil {
 		return err
 	}
-	//fmt.Printf("%s", patchBytes)
 
-	newBytes, err := jsonpatch.MergePatch(oldBytes, patchBytes)
+	// serialize to json for patch input
+	oldBytes, err := json.Marshal(oldTD)
 	if err != nil {
 		return err
 	}
-	oldBytes, patchBytes = nil, nil
 
-	td = ThingDescription{}
-	err = json.Unmarshal(newBytes, &td)
+	newBytes, err := patchFunc(oldBytes)
 	if err != nil {
 		return err
 	}
+	oldBytes = nil
 
-	results, err := validateThingDescription(td)
+	td := ThingDescription{}
+	err = json.Unmarshal(newBytes, &td)
 	if err != nil {
 		return err
 	}
-	if len(results) != 0 {
-		return &ValidationError{results}
+	if td[wot.KeyThingID] != id {
+		return &BadRequestError{fmt.Sprintf("Resource id (%s) cannot be changed to %v", id, td[wot.KeyThingID])}
 	}
 
-	//td[wot.KeyThingRegistrationModified] = time.Now().UTC()
-	now := time.Now().UTC()
-	oldTR := ThingRegistration(oldTD)
-	tr := ThingRegistration(td)
-	td[wot.KeyThingRegistration] = wot.ThingRegistration{
-		Created:  oldTR.Created,
-		Modified: &now,
-		Expires:  computeExpiry(tr, now),
-		TTL:      ThingTTL(tr),
+	err = c.prepareUpdate(oldTD, td)
+	if err != nil {
+		return err
 	}
 
-	err = c.storage.update(id, td)
+	err = c.storage.update(id, td, updatedEvent(oldTD, td))
 	if err != nil {
 		return err
 	}
-
-	go c.listeners.updated(oldTD, td)
+	c.signalOutbox()
 
 	return nil
 }
 
-func (c *Controller) delete(id string) error {
+func (c *Controller) delete(id string, pre *preconditions) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	oldTD, err := c.storage.get(id)
 	if err != nil {
 		return err
 	}
+	if err := pre.check(oldTD); err != nil {
+		return err
+	}
 
-	err = c.storage.delete(id)
+	err = c.storage.delete(id, deletedEvent(oldTD))
 	if err != nil {
 		return err
 	}
-
-	go c.listeners.deleted(oldTD)
+	c.signalOutbox()
 
 	return nil
 }
 
+// heartbeat renews the registration of a TD without modifying the TD itself
+// It recomputes the expiry based on the TTL and records the time at which the Thing was last seen.
+// Heartbeats do not change the revision and are not published as events.
+func (c *Controller) heartbeat(id string) (*wot.ThingRegistration, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	td, err := c.storage.get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	tr := ThingRegistration(td)
+	if tr == nil {
+		tr = &wot.ThingRegistration{}
+	}
+	tr.Expires = computeExpiry(tr, now)
+	tr.LastSeen = &now
+	td[wot.KeyThingRegistration] = *tr
+
+	err = c.storage.update(id, td, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return tr, nil
+}
+
 func (c *Controller) list(page, perPage int) ([]ThingDescription, int, error) {
 	tds, total, err := c.storage.list(page, perPage)
 	if err != nil {
@@ -208,6 +435,75 @@ func (c *Controller) list(page, perPage int) ([]ThingDescription, int, error) {
 	return tds, total, nil
 }
 
+func (c *Controller) listAfter(after string, limit int) ([]ThingDescription, string, error) {
+	tds, more, err := c.storage.listAfter(after, limit)
+	if err != nil || !more {
+		return tds, "", err
+	}
+	return tds, c.thingKey(tds[len(tds)-1]), nil
+}
+
+// thingKey returns the key of the TD in the storage, i.e. its id or the origin and id of a mirrored TD
+func (c *Controller) thingKey(td ThingDescription) string {
+	id, _ := td[wot.KeyThingID].(string)
+	if c.mirrored {
+		return mirrorKey(ThingOrigin(ThingRegistration(td)), id)
+	}
+	return id
+}
+
+// listSorted returns a page of TDs sorted by the attribute at the dot-separated path
+func (c *Controller) listSorted(sortBy string, desc bool, page, perPage int) ([]ThingDescription, int, error) {
+	items, err := c.listAllSorted(sortBy, desc)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	offset, limit, err := utils.GetPagingAttr(len(items), page, perPage, MaxPerPage)
+	if err != nil {
+		return nil, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
+	}
+	return items[offset : offset+limit], len(items), nil
+}
+
+// listAllSorted returns all TDs sorted by the attribute at the dot-separated path
+// TDs without the attribute are placed at the end, in both orders.
+func (c *Controller) listAllSorted(sortBy string, desc bool) ([]ThingDescription, error) {
+	pointer := "/" + strings.ReplaceAll(strings.NewReplacer("~", "~0", "/", "~1").Replace(sortBy), ".", "/")
+
+	type sortItem struct {
+		td    ThingDescription
+		value interface{}
+		found bool
+	}
+	var items []sortItem
+	for b := range c.storage.iterateBytes(context.Background()) {
+		var td ThingDescription
+		err := json.Unmarshal(b, &td)
+		if err != nil {
+			return nil, err
+		}
+		value, found := valueAtPointer(map[string]interface{}(td), pointer)
+		items = append(items, sortItem{td, value, found && value != nil})
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		if !items[i].found || !items[j].found {
+			return items[i].found && !items[j].found
+		}
+		if desc {
+			return compareJSONValues(items[i].value, items[j].value) > 0
+		}
+		return compareJSONValues(items[i].value, items[j].value) < 0
+	})
+
+	tds := make([]ThingDescription, len(items))
+	for i := range items {
+		tds[i] = items[i].td
+	}
+	return tds, nil
+}
+
 func (c *Controller) listAll() ([]ThingDescription, int, error) {
 	var items []ThingDescription
 	pp := MaxPerPage
@@ -273,8 +569,8 @@ func (c *Controller) filterJSONPath(path string, page, perPage int) ([]interface
 }
 
 func (c *Controller) filterJSONPathBytes(query string) ([]byte, error) {
-	// query all items
-	b, err := c.listAllBytes()
+	// query all items, or the ones found in the index
+	b, err := c.filterCandidates(parseJSONPathEquality(query))
 	if err != nil {
 		return nil, err
 	}
@@ -336,8 +632,8 @@ func (c *Controller) filterXPath(path string, page, perPage int) ([]interface{},
 }
 
 func (c *Controller) filterXPathBytes(path string) ([]byte, error) {
-	// query all items
-	b, err := c.listAllBytes()
+	// query all items, or the ones found in the index
+	b, err := c.filterCandidates(parseXPathEquality(path))
 	if err != nil {
 		return nil, err
 	}
@@ -367,6 +663,21 @@ func (c *Controller) filterXPathBytes(path string) ([]byte, error) {
 	return b, nil
 }
 
+// filterCandidates returns the serialized TDs to be evaluated by a filter
+// For equality filters on indexed attributes, only the TDs found in the index are returned.
+func (c *Controller) filterCandidates(pointer, value string, isEquality bool) ([]byte, error) {
+	if s, ok := c.storage.(indexedStorage); ok && isEquality {
+		b, indexed, err := s.lookupBytes(pointer, value)
+		if err != nil {
+			return nil, err
+		}
+		if indexed {
+			return b, nil
+		}
+	}
+	return c.listAllBytes()
+}
+
 func (c *Controller) iterateBytes(ctx context.Context) <-chan []byte {
 	return c.storage.iterateBytes(ctx)
 }
@@ -376,6 +687,10 @@ func (c *Controller) iterateBytes(ctx context.Context) <-chan []byte {
 func ThingRegistration(td ThingDescription) *wot.ThingRegistration {
 	_, found := td[wot.KeyThingRegistration]
 	if found && td[wot.KeyThingRegistration] != nil {
+		// set by the controller and not yet serialized
+		if tr, ok := td[wot.KeyThingRegistration].(wot.ThingRegistration); ok {
+			return &tr
+		}
 		if trMap, ok := td[wot.KeyThingRegistration].(map[string]interface{}); ok {
 			var tr wot.ThingRegistration
 			parsedTime := func(t string) *time.Time {
@@ -395,9 +710,19 @@ func ThingRegistration(td ThingDescription) *wot.ThingRegistration {
 			if expires, ok := trMap[wot.KeyThingRegistrationExpires].(string); ok {
 				tr.Expires = parsedTime(expires)
 			}
+			if lastSeen, ok := trMap[wot.KeyThingRegistrationLastSeen].(string); ok {
+				tr.LastSeen = parsedTime(lastSeen)
+			}
 			if ttl, ok := trMap[wot.KeyThingRegistrationTTL].(float64); ok {
 				tr.TTL = &ttl
 			}
+			if revision, ok := trMap[wot.KeyThingRegistrationRevision].(float64); ok {
+				r := uint64(revision)
+				tr.Revision = &r
+			}
+			if origin, ok := trMap[wot.KeyThingRegistrationOrigin].(string); ok {
+				tr.Origin = origin
+			}
 
 			return &tr
 		}
@@ -421,6 +746,14 @@ func computeExpiry(tr *wot.ThingRegistration, now time.Time) *time.Time {
 	return nil
 }
 
+// ThingOrigin returns the source of the TD if registered by the directory itself, e.g. from DNS-SD
+func ThingOrigin(tr *wot.ThingRegistration) string {
+	if tr != nil {
+		return tr.Origin
+	}
+	return ""
+}
+
 func ThingExpires(tr *wot.ThingRegistration) *time.Time {
 	if tr != nil {
 		return tr.Expires
@@ -429,6 +762,15 @@ func ThingExpires(tr *wot.ThingRegistration) *time.Time {
 	return nil
 }
 
+// ThingRevision returns the revision number of the TD
+// The revision is zero for TDs stored before revisions were introduced
+func ThingRevision(tr *wot.ThingRegistration) uint64 {
+	if tr != nil && tr.Revision != nil {
+		return *tr.Revision
+	}
+	return 0
+}
+
 func ThingTTL(tr *wot.ThingRegistration) *float64 {
 	if tr != nil {
 		return tr.TTL
@@ -437,6 +779,58 @@ func ThingTTL(tr *wot.ThingRegistration) *float64 {
 	return nil
 }
 
+// compareJSONValues orders de-serialized JSON values: booleans before numbers, strings, and other types
+// Strings that are RFC3339 timestamps are compared chronologically.
+func compareJSONValues(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case bool:
+			return 0
+		case float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	if rank(a) != rank(b) {
+		return rank(a) - rank(b)
+	}
+
+	switch a := a.(type) {
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	case float64:
+		switch {
+		case a < b.(float64):
+			return -1
+		case a > b.(float64):
+			return 1
+		}
+		return 0
+	case string:
+		ta, errA := time.Parse(time.RFC3339, a)
+		tb, errB := time.Parse(time.RFC3339, b.(string))
+		if errA == nil && errB == nil {
+			switch {
+			case ta.Before(tb):
+				return -1
+			case ta.After(tb):
+				return 1
+			}
+			return 0
+		}
+		return strings.Compare(a, b.(string))
+	}
+	return 0
+}
+
 // basicTypeFromXPathStr is a hack to get the actual data type from xpath.TextNode
 // Note: This might cause unexpected behaviour e.g. if user explicitly set string value to "true" or "false"
 func basicTypeFromXPathStr(strVal string) interface{} {
@@ -493,31 +887,75 @@ func (c *Controller) cleanExpired() {
 	}()
 
 	for t := range time.Tick(controllerExpiryCleanupInterval) {
-		var expiredServices []ThingDescription
+		err := c.storage.pruneHistory(t.Add(-deletedHistoryRetention))
+		if err != nil {
+			log.Printf("cleanExpired() Error removing the history of deleted registrations: %s", err)
+		}
 
-		for td := range c.storage.iterator() {
-			if expires := ThingExpires(ThingRegistration(td)); expires != nil {
-				if t.After(*expires) {
-					expiredServices = append(expiredServices, td)
-				}
-			}
+		expiredIDs, err := c.expiredBefore(t)
+		if err != nil {
+			log.Printf("cleanExpired() Error finding expired registrations: %s", err)
+			continue
 		}
 
-		for i := range expiredServices {
-			id := expiredServices[i][wot.KeyThingID].(string)
-			log.Printf("cleanExpired() Removing expired registration: %s", id)
-			err := c.storage.delete(id)
+		for _, id := range expiredIDs {
+			expiredTD, err := c.deleteExpired(id, t)
 			if err != nil {
 				log.Printf("cleanExpired() Error removing expired registration: %s: %s", id, err)
 				continue
 			}
+			if expiredTD != nil {
+				log.Printf("cleanExpired() Removed expired registration: %s", id)
+			}
+		}
+	}
+}
+
+// expiredBefore returns the IDs of TDs with expiry time before t
+func (c *Controller) expiredBefore(t time.Time) ([]string, error) {
+	if s, ok := c.storage.(indexedStorage); ok {
+		return s.expiredBefore(t)
+	}
+
+	var ids []string
+	for td := range c.storage.iterator() {
+		if expires := ThingExpires(ThingRegistration(td)); expires != nil {
+			if t.After(*expires) {
+				ids = append(ids, td[wot.KeyThingID].(string))
+			}
 		}
 	}
+	return ids, nil
+}
+
+// deleteExpired removes the TD if it is still expired at the given time
+// It returns nil if the registration got renewed in the meantime
+func (c *Controller) deleteExpired(id string, t time.Time) (ThingDescription, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	td, err := c.storage.get(id)
+	if err != nil {
+		return nil, err
+	}
+	expires := ThingExpires(ThingRegistration(td))
+	if expires == nil || !t.After(*expires) {
+		return nil, nil
+	}
+
+	err = c.storage.delete(id, expiredEvent(td))
+	if err != nil {
+		return nil, err
+	}
+	c.signalOutbox()
+	return td, nil
 }
 
 // Stop the controller
+// It waits for the events being dispatched, if any. The remaining events stay in the outbox.
 func (c *Controller) Stop() {
-	//log.Println("Stopped the controller.")
+	close(c.stopped)
+	c.dispatchers.Wait()
 }
 
 // Generate a unique URN
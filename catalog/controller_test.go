@@ -3,6 +3,7 @@
 package catalog
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"reflect"
@@ -11,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/linksmart/thing-directory/wot"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -27,8 +29,10 @@ func setup(t *testing.T) CatalogController {
 	}
 
 	switch TestStorageType {
+	case BackendMemory:
+		storage = NewMemoryStorage(TestHistorySize)
 	case BackendLevelDB:
-		storage, err = NewLevelDBStorage(tempDir, nil)
+		storage, err = NewLevelDBStorage(tempDir, nil, nil, TestHistorySize)
 		if err != nil {
 			t.Fatalf("error creating leveldb storage: %s", err)
 		}
@@ -191,7 +195,7 @@ func TestControllerUpdate(t *testing.T) {
 		td["title"] = "new title"
 		td["description"] = "description of the thing"
 
-		err = controller.update(id, td)
+		err = controller.update(id, td, nil)
 		if err != nil {
 			t.Fatal("Error updating TD:", err.Error())
 		}
@@ -232,14 +236,14 @@ func TestControllerDelete(t *testing.T) {
 	}
 
 	t.Run("delete", func(t *testing.T) {
-		err = controller.delete(id)
+		err = controller.delete(id, nil)
 		if err != nil {
 			t.Fatalf("Error deleting TD: %s", err)
 		}
 	})
 
 	t.Run("delete a deleted TD", func(t *testing.T) {
-		err = controller.delete(id)
+		err = controller.delete(id, nil)
 		if err != nil {
 			switch err.(type) {
 			case *NotFoundError:
@@ -337,6 +341,147 @@ func TestControllerList(t *testing.T) {
 	}
 }
 
+func TestControllerListAfter(t *testing.T) {
+	controller := setup(t)
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		var td = map[string]any{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/thing_" + strconv.Itoa(i),
+			"title":    "example thing",
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		}
+
+		id, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+		ids = append(ids, id)
+	}
+
+	// follow the pages
+	var listed []string
+	after := ""
+	for page := 1; ; page++ {
+		items, next, err := controller.listAfter(after, 2)
+		if err != nil {
+			t.Fatal("Error getting list of TDs:", err.Error())
+		}
+		if page < 3 && (len(items) != 2 || next == "") {
+			t.Fatalf("Page %d has %d entries and next=%q instead of 2 entries and more", page, len(items), next)
+		}
+		for _, td := range items {
+			listed = append(listed, td[wot.KeyThingID].(string))
+		}
+		if next == "" {
+			break
+		}
+		if next != listed[len(listed)-1] {
+			t.Fatalf("Next page after %s instead of %s", next, listed[len(listed)-1])
+		}
+		after = next
+	}
+	if !reflect.DeepEqual(ids, listed) {
+		t.Fatalf("Listed %v instead of %v", listed, ids)
+	}
+
+	// continue after a deleted entry
+	err := controller.delete(ids[2], nil)
+	if err != nil {
+		t.Fatal("Error deleting a TD:", err.Error())
+	}
+	items, next, err := controller.listAfter(ids[2], 10)
+	if err != nil {
+		t.Fatal("Error getting list of TDs:", err.Error())
+	}
+	if next != "" || len(items) != 2 || items[0][wot.KeyThingID] != ids[3] {
+		t.Fatalf("Unexpected list after deleted entry: %v", items)
+	}
+
+	total, err := controller.total()
+	if err != nil {
+		t.Fatalf("Error getting total of TD: %s", err)
+	}
+	if total != 4 {
+		t.Fatalf("Expected total 4 but got %d", total)
+	}
+}
+
+func TestControllerListSorted(t *testing.T) {
+	controller := setup(t)
+
+	titles := []string{"b", "c", "a"}
+	for i, title := range titles {
+		var td = map[string]any{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       "urn:example:test/thing_" + strconv.Itoa(i),
+			"title":    title,
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		}
+		if i != 1 {
+			td["version"] = map[string]any{"instance": strconv.Itoa(i)}
+		}
+
+		_, err := controller.add(td)
+		if err != nil {
+			t.Fatal("Error adding a TD:", err.Error())
+		}
+	}
+
+	listedIDs := func(tds []ThingDescription) (ids []string) {
+		for _, td := range tds {
+			ids = append(ids, td[wot.KeyThingID].(string))
+		}
+		return ids
+	}
+
+	t.Run("ascending", func(t *testing.T) {
+		tds, total, err := controller.listSorted("title", false, 1, 2)
+		if err != nil {
+			t.Fatal("Error listing sorted TDs:", err.Error())
+		}
+		expected := []string{"urn:example:test/thing_2", "urn:example:test/thing_0"}
+		if total != 3 || !reflect.DeepEqual(listedIDs(tds), expected) {
+			t.Fatalf("Listed %v (total %d) instead of %v (total 3)", listedIDs(tds), total, expected)
+		}
+	})
+
+	t.Run("descending", func(t *testing.T) {
+		tds, err := controller.listAllSorted("title", true)
+		if err != nil {
+			t.Fatal("Error listing sorted TDs:", err.Error())
+		}
+		expected := []string{"urn:example:test/thing_1", "urn:example:test/thing_0", "urn:example:test/thing_2"}
+		if !reflect.DeepEqual(listedIDs(tds), expected) {
+			t.Fatalf("Listed %v instead of %v", listedIDs(tds), expected)
+		}
+	})
+
+	t.Run("nested attribute with missing values", func(t *testing.T) {
+		tds, err := controller.listAllSorted("version.instance", true)
+		if err != nil {
+			t.Fatal("Error listing sorted TDs:", err.Error())
+		}
+		expected := []string{"urn:example:test/thing_2", "urn:example:test/thing_0", "urn:example:test/thing_1"}
+		if !reflect.DeepEqual(listedIDs(tds), expected) {
+			t.Fatalf("Listed %v instead of %v", listedIDs(tds), expected)
+		}
+	})
+}
+
 func TestControllerFilter(t *testing.T) {
 	controller := setup(t)
 
@@ -422,6 +567,68 @@ func TestControllerFilter(t *testing.T) {
 		}
 	})
 
+	// equality filters on indexed attributes are answered from the index, if supported by the storage
+	filterBytes := func(t *testing.T, query string, isJSONPath bool) []map[string]any {
+		var b []byte
+		if isJSONPath {
+			b, err = controller.filterJSONPathBytes(query)
+		} else {
+			b, err = controller.filterXPathBytes(query)
+		}
+		if err != nil {
+			t.Fatal("Error filtering:", err.Error())
+		}
+		var TDs []map[string]any
+		err = json.Unmarshal(b, &TDs)
+		if err != nil {
+			t.Fatal("Error parsing filtered TDs:", err.Error())
+		}
+		return TDs
+	}
+
+	t.Run("filter bytes with JSONPath", func(t *testing.T) {
+		TDs := filterBytes(t, "$[?(@.title=='interesting thing')]", true)
+		if len(TDs) != 2 || TDs[0]["id"] != "urn:example:test/thing_x" || TDs[1]["id"] != "urn:example:test/thing_y" {
+			t.Fatalf("Wrong results when filtering based on title:\n%v", TDs)
+		}
+	})
+
+	t.Run("filter bytes with XPath", func(t *testing.T) {
+		TDs := filterBytes(t, "*[title='interesting thing']", false)
+		if len(TDs) != 2 || TDs[0]["id"] != "urn:example:test/thing_x" || TDs[1]["id"] != "urn:example:test/thing_y" {
+			t.Fatalf("Wrong results when filtering based on title:\n%v", TDs)
+		}
+	})
+
+	t.Run("filter bytes after update and delete", func(t *testing.T) {
+		td, err := controller.get("urn:example:test/thing_x")
+		if err != nil {
+			t.Fatal("Error getting a TD:", err.Error())
+		}
+		td["title"] = "boring thing"
+		td["@type"] = []any{"Sensor", "Device"}
+		err = controller.update("urn:example:test/thing_x", td, nil)
+		if err != nil {
+			t.Fatal("Error updating a TD:", err.Error())
+		}
+		err = controller.delete("urn:example:test/thing_y", nil)
+		if err != nil {
+			t.Fatal("Error deleting a TD:", err.Error())
+		}
+
+		if TDs := filterBytes(t, "$[?(@.title=='interesting thing')]", true); len(TDs) != 0 {
+			t.Fatalf("Expected no results after updating the title, got:\n%v", TDs)
+		}
+		if TDs := filterBytes(t, "$[?(@.title=='boring thing')]", true); len(TDs) != 1 {
+			t.Fatalf("Expected one result for the updated title, got:\n%v", TDs)
+		}
+		if TDs := filterBytes(t, "*[title='boring thing']", false); len(TDs) != 1 {
+			t.Fatalf("Expected one result for the updated title, got:\n%v", TDs)
+		}
+		if TDs := filterBytes(t, "*[title='example thing']", false); len(TDs) != 5 {
+			t.Fatalf("Expected 5 results for the unchanged titles, got:\n%v", TDs)
+		}
+	})
 }
 
 func TestControllerTotal(t *testing.T) {
@@ -465,6 +672,8 @@ func TestControllerCleanExpired(t *testing.T) {
 	const wait = 3 * time.Second
 
 	controller := setup(t)
+	listener := &testListener{expired: make(chan ThingDescription, 1)}
+	controller.AddSubscriber(listener)
 
 	var td = ThingDescription{
 		"@context": "https://www.w3.org/2019/wot/td/v1",
@@ -500,4 +709,459 @@ func TestControllerCleanExpired(t *testing.T) {
 	} else {
 		t.Fatalf("Expired TD was not removed")
 	}
+
+	select {
+	case expiredTD := <-listener.expired:
+		if expiredTD[wot.KeyThingID] != id {
+			t.Fatalf("Expire event for %s instead of %s", expiredTD[wot.KeyThingID], id)
+		}
+	case <-time.After(wait):
+		t.Fatalf("No expire event for the removed TD")
+	}
+}
+
+// testListener is an EventListener passing the expired TDs to a channel
+type testListener struct {
+	expired chan ThingDescription
+}
+
+func (l *testListener) CreateHandler(new ThingDescription) error                       { return nil }
+func (l *testListener) UpdateHandler(old ThingDescription, new ThingDescription) error { return nil }
+func (l *testListener) DeleteHandler(old ThingDescription) error                       { return nil }
+func (l *testListener) ExpireHandler(old ThingDescription) error {
+	l.expired <- old
+	return nil
+}
+
+func TestControllerPreconditions(t *testing.T) {
+	controller := setup(t)
+
+	var td = ThingDescription{
+		"@context": "https://www.w3.org/2019/wot/td/v1",
+		"id":       "urn:example:test/thing1",
+		"title":    "example thing",
+		"security": []string{"basic_sc"},
+		"securityDefinitions": map[string]any{
+			"basic_sc": map[string]string{
+				"in":     "header",
+				"scheme": "basic",
+			},
+		},
+	}
+
+	id, err := controller.add(td)
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+	storedTD, err := controller.get(id)
+	if err != nil {
+		t.Fatalf("Error retrieving TD: %s", err)
+	}
+	etag := ThingETag(storedTD)
+	if !strings.HasPrefix(etag, `"1-`) {
+		t.Fatalf("Expected entity-tag of a new TD to start with revision 1 but got %s", etag)
+	}
+
+	t.Run("update with matching entity-tag", func(t *testing.T) {
+		err = controller.update(id, td, &preconditions{ifMatch: etag})
+		if err != nil {
+			t.Fatalf("Error updating TD: %s", err)
+		}
+		storedTD, err := controller.get(id)
+		if err != nil {
+			t.Fatalf("Error retrieving TD: %s", err)
+		}
+		if !strings.HasPrefix(ThingETag(storedTD), `"2-`) {
+			t.Fatalf("Expected entity-tag to start with revision 2 after update but got %s", ThingETag(storedTD))
+		}
+	})
+
+	t.Run("update with stale entity-tag", func(t *testing.T) {
+		err = controller.update(id, td, &preconditions{ifMatch: etag})
+		if _, ok := err.(*PreconditionFailedError); !ok {
+			t.Fatalf("Expected PreconditionFailedError but got %v", err)
+		}
+	})
+
+	t.Run("delete with If-None-Match", func(t *testing.T) {
+		err = controller.delete(id, &preconditions{ifNoneMatch: "*"})
+		if _, ok := err.(*PreconditionFailedError); !ok {
+			t.Fatalf("Expected PreconditionFailedError but got %v", err)
+		}
+	})
+
+	t.Run("recreate", func(t *testing.T) {
+		err = controller.delete(id, nil)
+		if err != nil {
+			t.Fatalf("Error deleting TD: %s", err)
+		}
+		time.Sleep(time.Millisecond)
+		_, err = controller.add(td)
+		if err != nil {
+			t.Fatalf("Error adding a TD: %s", err)
+		}
+		storedTD, err := controller.get(id)
+		if err != nil {
+			t.Fatalf("Error retrieving TD: %s", err)
+		}
+		if ThingETag(storedTD) == etag {
+			t.Fatalf("Recreated TD has the entity-tag of the deleted one: %s", etag)
+		}
+	})
+}
+
+func TestControllerHeartbeat(t *testing.T) {
+	controller := setup(t)
+
+	var td = ThingDescription{
+		"@context": "https://www.w3.org/2019/wot/td/v1",
+		"id":       "urn:example:test/thing1",
+		"title":    "example thing",
+		"security": []string{"basic_sc"},
+		"securityDefinitions": map[string]any{
+			"basic_sc": map[string]string{
+				"in":     "header",
+				"scheme": "basic",
+			},
+		},
+		"registration": map[string]any{
+			"ttl": 60.0,
+		},
+	}
+
+	id, err := controller.add(td)
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+	storedTD, err := controller.get(id)
+	if err != nil {
+		t.Fatalf("Error retrieving TD: %s", err)
+	}
+	oldTD := storedTD
+	oldTR := ThingRegistration(oldTD)
+
+	time.Sleep(10 * time.Millisecond)
+	tr, err := controller.heartbeat(id)
+	if err != nil {
+		t.Fatalf("Error renewing registration: %s", err)
+	}
+	if !tr.Expires.After(*oldTR.Expires) {
+		t.Fatalf("Expiry was not extended: %s is not after %s", tr.Expires, oldTR.Expires)
+	}
+	if tr.LastSeen == nil {
+		t.Fatalf("LastSeen was not set")
+	}
+
+	storedTD, err = controller.get(id)
+	if err != nil {
+		t.Fatalf("Error retrieving TD: %s", err)
+	}
+	newTR := ThingRegistration(storedTD)
+	if !newTR.Modified.Equal(*oldTR.Modified) || ThingRevision(newTR) != ThingRevision(oldTR) {
+		t.Fatalf("Heartbeat modified the TD:\n Before:\n%v\n After:\n%v\n", oldTR, newTR)
+	}
+	if !newTR.Expires.Equal(*tr.Expires) {
+		t.Fatalf("Renewed expiry was not stored. Expected %s but got %s", tr.Expires, newTR.Expires)
+	}
+	if ThingETag(storedTD) == ThingETag(oldTD) {
+		t.Fatalf("Heartbeat did not change the entity-tag %s", ThingETag(storedTD))
+	}
+}
+
+func TestControllerJSONPatch(t *testing.T) {
+	controller := setup(t)
+
+	var td = ThingDescription{
+		"@context": "https://www.w3.org/2019/wot/td/v1",
+		"id":       "urn:example:test/thing1",
+		"title":    "example thing",
+		"security": []string{"basic_sc"},
+		"securityDefinitions": map[string]any{
+			"basic_sc": map[string]string{
+				"in":     "header",
+				"scheme": "basic",
+			},
+		},
+		"links": []map[string]any{
+			{"href": "https://example.com/1"},
+			{"href": "https://example.com/2"},
+		},
+	}
+
+	id, err := controller.add(td)
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+
+	t.Run("remove array element", func(t *testing.T) {
+		patch := `[
+			{"op": "test", "path": "/links/0/href", "value": "https://example.com/1"},
+			{"op": "remove", "path": "/links/0"}
+		]`
+		err = controller.jsonPatch(id, []byte(patch), nil)
+		if err != nil {
+			t.Fatalf("Error patching TD: %s", err)
+		}
+
+		storedTD, err := controller.get(id)
+		if err != nil {
+			t.Fatalf("Error retrieving TD: %s", err)
+		}
+		links := storedTD["links"].([]any)
+		if len(links) != 1 || links[0].(map[string]any)["href"] != "https://example.com/2" {
+			t.Fatalf("Array element was not removed: %v", links)
+		}
+	})
+
+	t.Run("failed test operation", func(t *testing.T) {
+		patch := `[
+			{"op": "test", "path": "/title", "value": "other title"},
+			{"op": "replace", "path": "/title", "value": "new title"}
+		]`
+		err = controller.jsonPatch(id, []byte(patch), nil)
+		if _, ok := err.(*ConflictError); !ok {
+			t.Fatalf("Expected ConflictError but got %v", err)
+		}
+	})
+
+	t.Run("change id", func(t *testing.T) {
+		patch := `[{"op": "replace", "path": "/id", "value": "urn:example:test/thing2"}]`
+		err = controller.jsonPatch(id, []byte(patch), nil)
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError but got %v", err)
+		}
+	})
+}
+
+func TestControllerBatch(t *testing.T) {
+	controller := setup(t)
+
+	newTD := func(id string) ThingDescription {
+		return ThingDescription{
+			"@context": "https://www.w3.org/2019/wot/td/v1",
+			"id":       id,
+			"title":    "example thing",
+			"security": []string{"basic_sc"},
+			"securityDefinitions": map[string]any{
+				"basic_sc": map[string]string{
+					"in":     "header",
+					"scheme": "basic",
+				},
+			},
+		}
+	}
+
+	_, err := controller.add(newTD("urn:example:test/thing1"))
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+
+	t.Run("atomic with failure", func(t *testing.T) {
+		results := controller.batch([]BatchOperation{
+			{Op: BatchOpCreate, TD: newTD("urn:example:test/thing2")},
+			{Op: BatchOpCreate, TD: newTD("urn:example:test/thing1")}, // conflict
+		}, true)
+
+		if _, ok := results[0].err.(*FailedDependencyError); !ok {
+			t.Fatalf("Expected FailedDependencyError for the first operation but got %v", results[0].err)
+		}
+		if _, ok := results[1].err.(*ConflictError); !ok {
+			t.Fatalf("Expected ConflictError for the second operation but got %v", results[1].err)
+		}
+		total, _ := controller.total()
+		if total != 1 {
+			t.Fatalf("Atomic batch was partially applied. Expected total 1 but got %d", total)
+		}
+	})
+
+	t.Run("atomic", func(t *testing.T) {
+		results := controller.batch([]BatchOperation{
+			{Op: BatchOpCreate, TD: newTD("urn:example:test/thing2")},
+			{Op: BatchOpUpdate, ID: "urn:example:test/thing2", TD: newTD("urn:example:test/thing2")},
+			{Op: BatchOpDelete, ID: "urn:example:test/thing1"},
+		}, true)
+
+		for i, r := range results {
+			if r.err != nil {
+				t.Fatalf("Unexpected error for operation %d: %s", i, r.err)
+			}
+		}
+		td, err := controller.get("urn:example:test/thing2")
+		if err != nil {
+			t.Fatalf("Error retrieving TD: %s", err)
+		}
+		if ThingRevision(ThingRegistration(td)) != 2 {
+			t.Fatalf("Expected revision 2 after create and update but got %d", ThingRevision(ThingRegistration(td)))
+		}
+		_, err = controller.get("urn:example:test/thing1")
+		if _, ok := err.(*NotFoundError); !ok {
+			t.Fatalf("Expected NotFoundError for deleted TD but got %v", err)
+		}
+	})
+
+	t.Run("non-atomic", func(t *testing.T) {
+		results := controller.batch([]BatchOperation{
+			{Op: BatchOpCreate, TD: newTD("urn:example:test/thing3")},
+			{Op: BatchOpDelete, ID: "urn:example:test/thing1"}, // not found
+		}, false)
+
+		if results[0].err != nil || !results[0].created {
+			t.Fatalf("Unexpected result for the first operation: %+v", results[0])
+		}
+		if _, ok := results[1].err.(*NotFoundError); !ok {
+			t.Fatalf("Expected NotFoundError for the second operation but got %v", results[1].err)
+		}
+	})
+}
+
+func TestControllerHistory(t *testing.T) {
+	controller := setup(t)
+
+	var td = ThingDescription{
+		"@context": "https://www.w3.org/2019/wot/td/v1",
+		"id":       "urn:example:test/thing1",
+		"title":    "title 1",
+		"security": []string{"basic_sc"},
+		"securityDefinitions": map[string]any{
+			"basic_sc": map[string]string{
+				"in":     "header",
+				"scheme": "basic",
+			},
+		},
+	}
+	id, err := controller.add(td)
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+
+	// revisions 2 to 5
+	for i := 2; i <= 5; i++ {
+		td["title"] = "title " + strconv.Itoa(i)
+		err = controller.update(id, td, nil)
+		if err != nil {
+			t.Fatalf("Error updating the TD: %s", err)
+		}
+	}
+	// heartbeats do not create revisions
+	_, err = controller.heartbeat(id)
+	if err != nil {
+		t.Fatalf("Error renewing registration: %s", err)
+	}
+
+	revisions := func(tds []ThingDescription) (revs []uint64) {
+		for _, td := range tds {
+			revs = append(revs, ThingRevision(ThingRegistration(td)))
+		}
+		return revs
+	}
+
+	t.Run("history", func(t *testing.T) {
+		tds, err := controller.history(id)
+		if err != nil {
+			t.Fatalf("Error getting history: %s", err)
+		}
+		// limited to the history size
+		if expected := []uint64{4, 3, 2}; !reflect.DeepEqual(revisions(tds), expected) {
+			t.Fatalf("History has revisions %v instead of %v", revisions(tds), expected)
+		}
+		if tds[0]["title"] != "title 4" {
+			t.Fatalf("Revision 4 has title %v instead of title 4", tds[0]["title"])
+		}
+
+		_, err = controller.history("urn:example:test/unknown")
+		if _, ok := err.(*NotFoundError); !ok {
+			t.Fatalf("Expected NotFoundError for unknown TD, got: %v", err)
+		}
+	})
+
+	t.Run("get revision", func(t *testing.T) {
+		for revision, title := range map[uint64]string{5: "title 5", 3: "title 3"} {
+			td, err := controller.getRevision(id, revision)
+			if err != nil {
+				t.Fatalf("Error getting revision %d: %s", revision, err)
+			}
+			if td["title"] != title {
+				t.Fatalf("Revision %d has title %v instead of %s", revision, td["title"], title)
+			}
+		}
+		_, err := controller.getRevision(id, 1)
+		if _, ok := err.(*NotFoundError); !ok {
+			t.Fatalf("Expected NotFoundError for pruned revision, got: %v", err)
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		created, err := controller.restore(id, 3, nil)
+		if err != nil || created {
+			t.Fatalf("Error restoring revision 3: created=%t, %v", created, err)
+		}
+		td, err := controller.get(id)
+		if err != nil {
+			t.Fatalf("Error getting the TD: %s", err)
+		}
+		if td["title"] != "title 3" || ThingRevision(ThingRegistration(td)) != 6 {
+			t.Fatalf("Restored TD has title %v and revision %d instead of title 3 and revision 6",
+				td["title"], ThingRevision(ThingRegistration(td)))
+		}
+	})
+
+	t.Run("restore deleted", func(t *testing.T) {
+		err := controller.delete(id, nil)
+		if err != nil {
+			t.Fatalf("Error deleting the TD: %s", err)
+		}
+		tds, err := controller.history(id)
+		if err != nil {
+			t.Fatalf("Error getting history of deleted TD: %s", err)
+		}
+		if expected := []uint64{6, 5, 4}; !reflect.DeepEqual(revisions(tds), expected) {
+			t.Fatalf("History has revisions %v instead of %v", revisions(tds), expected)
+		}
+
+		created, err := controller.restore(id, 6, nil)
+		if err != nil || !created {
+			t.Fatalf("Error restoring deleted TD: created=%t, %v", created, err)
+		}
+		td, err := controller.get(id)
+		if err != nil {
+			t.Fatalf("Error getting the TD: %s", err)
+		}
+		if ThingRevision(ThingRegistration(td)) != 7 {
+			t.Fatalf("Re-created TD has revision %d instead of 7", ThingRevision(ThingRegistration(td)))
+		}
+	})
+
+	t.Run("prune deleted", func(t *testing.T) {
+		td["id"] = "urn:example:test/deleted"
+		deletedID, err := controller.add(td)
+		if err != nil {
+			t.Fatalf("Error adding a TD: %s", err)
+		}
+		err = controller.delete(deletedID, nil)
+		if err != nil {
+			t.Fatalf("Error deleting the TD: %s", err)
+		}
+		storage := controller.(*Controller).storage
+
+		// kept within the retention period
+		err = storage.pruneHistory(time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatalf("Error pruning history: %s", err)
+		}
+		if tds, err := controller.history(deletedID); err != nil || len(tds) != 1 {
+			t.Fatalf("History of the recently deleted TD is %v, %v instead of its last revision", revisions(tds), err)
+		}
+
+		err = storage.pruneHistory(time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("Error pruning history: %s", err)
+		}
+		if _, err := controller.history(deletedID); err == nil {
+			t.Fatalf("History of the deleted TD is kept")
+		}
+		// the history of the re-created TD is kept
+		if tds, err := controller.history(id); err != nil || len(tds) != 3 {
+			t.Fatalf("History of the re-created TD has revisions %v, %v instead of 3", revisions(tds), err)
+		}
+	})
 }
@@ -0,0 +1,174 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const (
+	// query parameters of the W3C WoT Discovery listing
+	QueryParamOffset = "offset"
+	QueryParamFormat = "format"
+	// listing formats
+	ListingFormatArray      = "array"
+	ListingFormatCollection = "collection"
+)
+
+// ThingCollection is a page of TDs in the collection format of the W3C WoT Discovery listing
+type ThingCollection struct {
+	Context string            `json:"@context"`
+	Type    string            `json:"@type"`
+	ID      string            `json:"@id"`
+	Members []json.RawMessage `json:"members"`
+	Total   int               `json:"total"`
+	Next    string            `json:"next,omitempty"`
+}
+
+// ListThings lists entries as specified by the W3C WoT Discovery
+// Without format=collection, offset, or limit, all TDs are streamed as a JSON array.
+// Pages of the array format link to the next page in the Link header.
+func (a *HTTPAPI) ListThings(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query:", err.Error())
+		return
+	}
+	format := req.Form.Get(QueryParamFormat)
+	switch format {
+	case "", ListingFormatArray, ListingFormatCollection:
+	default:
+		ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("%s must be either %s or %s", QueryParamFormat, ListingFormatArray, ListingFormatCollection))
+		return
+	}
+	_, hasOffset := req.Form[QueryParamOffset]
+	_, hasLimit := req.Form[QueryParamLimit]
+	if format != ListingFormatCollection && !hasOffset && !hasLimit {
+		a.GetAll(w, req)
+		return
+	}
+
+	offset, limit, err := parseOffsetLimit(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
+	opts, err := parseListingOptions(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
+
+	members, err := a.listRange(req.Context(), opts, offset, limit)
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			ErrorResponse(w, http.StatusBadRequest, err.Error())
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	total, err := a.controller.total()
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var next string
+	if offset+limit < total {
+		next = nextLink(req, QueryParamOffset, strconv.Itoa(offset+limit))
+	}
+
+	var b []byte
+	if format == ListingFormatCollection {
+		b, err = json.Marshal(&ThingCollection{
+			Context: wot.ContextURLDiscovery,
+			Type:    wot.TypeThingCollection,
+			ID:      req.URL.RequestURI(),
+			Members: members,
+			Total:   total,
+			Next:    next,
+		})
+	} else {
+		if next != "" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next))
+		}
+		b, err = json.Marshal(members)
+	}
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSONLD)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// parseOffsetLimit returns the offset and limit of a listing page, with limit defaulting to MaxPerPage
+func parseOffsetLimit(req *http.Request) (offset, limit int, err error) {
+	if o := req.Form.Get(QueryParamOffset); o != "" {
+		offset, err = strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("%s must be a non-negative integer", QueryParamOffset)
+		}
+	}
+	limit = MaxPerPage
+	if l := req.Form.Get(QueryParamLimit); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > MaxPerPage {
+			return 0, 0, fmt.Errorf("%s must be an integer between 1 and %d", QueryParamLimit, MaxPerPage)
+		}
+	}
+	return offset, limit, nil
+}
+
+// listRange returns up to limit serialized TDs, starting at offset in the order of the listing options
+func (a *HTTPAPI) listRange(ctx context.Context, opts *listingOptions, offset, limit int) ([]json.RawMessage, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var items <-chan []byte
+	if opts.sortBy != "" || opts.fields != nil {
+		var err error
+		items, err = a.sortedProjectedBytes(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		items = a.controller.iterateBytes(ctx)
+	}
+	// stop the iteration once the page is complete, and drain the items sent meanwhile
+	defer func() {
+		cancel()
+		for range items {
+		}
+	}()
+
+	members := []json.RawMessage{}
+	i := 0
+	for item := range items {
+		if i >= offset {
+			members = append(members, item)
+			if len(members) == limit {
+				break
+			}
+		}
+		i++
+	}
+	return members, nil
+}
+
+// SearchSPARQL responds that SPARQL queries are not supported, as specified by the W3C WoT Discovery
+func (a *HTTPAPI) SearchSPARQL(w http.ResponseWriter, req *http.Request) {
+	ErrorResponse(w, http.StatusNotImplemented, "SPARQL search is not supported")
+}
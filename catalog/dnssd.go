@@ -0,0 +1,380 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const (
+	// DNS-SD TXT record keys of the W3C WoT Discovery
+	dnssdTextTD     = "td"
+	dnssdTextScheme = "scheme"
+	// maximum time to wait for the responses to a browse query
+	dnssdBrowseTimeout = 10 * time.Second
+	// maximum time to fetch a TD
+	dnssdFetchTimeout = 10 * time.Second
+	// OriginDNSSD is the origin of the TDs registered by the DNS-SD browser
+	OriginDNSSD = "dnssd"
+)
+
+// DNSSDBrowser registers the TDs of Things advertised with DNS-SD
+// The Things are browsed periodically. Their TDs are fetched from the path of the TXT record and registered with the
+// TTL of the DNS-SD records, so that they expire once the Things are no longer advertised.
+type DNSSDBrowser struct {
+	controller CatalogController
+	domain     string
+	ifaces     []net.Interface
+	interval   time.Duration
+	client     *http.Client
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// NewDNSSDBrowser starts browsing for Things in the domain every interval, on all multicast interfaces if none are given
+func NewDNSSDBrowser(controller CatalogController, domain string, ifaces []net.Interface, interval time.Duration) *DNSSDBrowser {
+	b := &DNSSDBrowser{
+		controller: controller,
+		domain:     domain,
+		ifaces:     ifaces,
+		interval:   interval,
+		client:     &http.Client{Timeout: dnssdFetchTimeout},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *DNSSDBrowser) run() {
+	defer close(b.done)
+	for {
+		err := b.browse()
+		if err != nil {
+			log.Printf("DNS-SD: error browsing: %s", err)
+		}
+		select {
+		case <-time.After(b.interval):
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// browse registers the Things responding to a browse query
+func (b *DNSSDBrowser) browse() error {
+	return browseDNSSD(b.stop, b.ifaces, b.domain, wot.DNSSDServiceSubtypeThing, func(entry *zeroconf.ServiceEntry) {
+		err := b.register(entry)
+		if err != nil {
+			log.Printf("DNS-SD: error registering %s: %s", entry.Instance, err)
+		}
+	})
+}
+
+// browseDNSSD passes the services of the subtype responding to a browse query to the found function
+// It returns once the responses are over or on stop.
+func browseDNSSD(stop <-chan struct{}, ifaces []net.Interface, domain, subtype string, found func(*zeroconf.ServiceEntry)) error {
+	var opts []zeroconf.ClientOption
+	if len(ifaces) > 0 {
+		opts = append(opts, zeroconf.SelectIfaces(ifaces))
+	}
+	resolver, err := zeroconf.NewResolver(opts...)
+	if err != nil {
+		return fmt.Errorf("error creating resolver: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnssdBrowseTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	entries := make(chan *zeroconf.ServiceEntry)
+	err = resolver.Browse(ctx, wot.DNSSDServiceType+","+subtype, domain, entries)
+	if err != nil {
+		return err
+	}
+	// the entries are closed once the context is done
+	for entry := range entries {
+		found(entry)
+	}
+	return nil
+}
+
+// register fetches the TD of the entry and creates or updates it
+// The registration of an unchanged TD is only renewed. TDs registered by other means, i.e. without the DNS-SD origin,
+// are never modified.
+func (b *DNSSDBrowser) register(entry *zeroconf.ServiceEntry) error {
+	tdURL, err := dnssdTDURL(entry)
+	if err != nil {
+		return err
+	}
+	td, err := b.fetch(tdURL)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %s", tdURL, err)
+	}
+	id, ok := td[wot.KeyThingID].(string)
+	if !ok || id == "" {
+		return fmt.Errorf("TD at %s has no id", tdURL)
+	}
+	td[wot.KeyThingRegistration] = map[string]interface{}{
+		wot.KeyThingRegistrationTTL: float64(entry.TTL),
+	}
+
+	stored, err := b.controller.get(id)
+	if err == nil {
+		if ThingOrigin(ThingRegistration(stored)) != OriginDNSSD {
+			return &ConflictError{fmt.Sprintf("%s advertised at %s is registered by other means", id, tdURL)}
+		}
+		if unchangedRegistration(stored, td) {
+			_, err = b.controller.heartbeat(id)
+			return err
+		}
+	} else if _, notFound := err.(*NotFoundError); !notFound {
+		return err
+	}
+
+	// the origin is checked again in the same write, as the TD may have been registered in the meantime
+	created, err := b.controller.register(td, OriginDNSSD)
+	if err == nil && created {
+		log.Printf("DNS-SD: registered %s from %s", id, tdURL)
+	}
+	return err
+}
+
+// fetch retrieves the TD at the URL
+func (b *DNSSDBrowser) fetch(tdURL string) (ThingDescription, error) {
+	req, err := http.NewRequest(http.MethodGet, tdURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", wot.MediaTypeThingDescription+", "+wot.MediaTypeJSON)
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status: %s", res.Status)
+	}
+
+	var td ThingDescription
+	err = json.NewDecoder(res.Body).Decode(&td)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding TD: %s", err)
+	}
+	return td, nil
+}
+
+// dnssdTDURL returns the URL of the TD advertised in the TXT record of the entry
+func dnssdTDURL(entry *zeroconf.ServiceEntry) (string, error) {
+	path, found := dnssdText(entry)[dnssdTextTD]
+	if !found {
+		return "", fmt.Errorf("no %s in TXT record", dnssdTextTD)
+	}
+	base, err := dnssdBaseURL(entry)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return base + path, nil
+}
+
+// dnssdBaseURL returns the URL of the address and port of the entry, with the scheme of the TXT record
+func dnssdBaseURL(entry *zeroconf.ServiceEntry) (string, error) {
+	scheme := dnssdText(entry)[dnssdTextScheme]
+	switch scheme {
+	case "":
+		scheme = "http"
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported scheme: %s", scheme)
+	}
+
+	var host string
+	switch {
+	case len(entry.AddrIPv4) > 0:
+		host = entry.AddrIPv4[0].String()
+	case len(entry.AddrIPv6) > 0:
+		host = entry.AddrIPv6[0].String()
+	default:
+		return "", fmt.Errorf("no address")
+	}
+	return scheme + "://" + net.JoinHostPort(host, strconv.Itoa(entry.Port)), nil
+}
+
+// dnssdText returns the key/value pairs of the TXT record of the entry
+func dnssdText(entry *zeroconf.ServiceEntry) map[string]string {
+	text := make(map[string]string)
+	for _, pair := range entry.Text {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			text[kv[0]] = kv[1]
+		}
+	}
+	return text
+}
+
+// unchangedRegistration checks if the fetched TD and its TTL are the same as stored
+func unchangedRegistration(stored, fetched ThingDescription) bool {
+	storedTTL, fetchedTTL := ThingTTL(ThingRegistration(stored)), ThingTTL(ThingRegistration(fetched))
+	if storedTTL == nil || fetchedTTL == nil || *storedTTL != *fetchedTTL {
+		return false
+	}
+	withoutRegistration := func(td ThingDescription) map[string]interface{} {
+		copied := make(map[string]interface{}, len(td))
+		for k, v := range td {
+			if k != wot.KeyThingRegistration {
+				copied[k] = v
+			}
+		}
+		// serialize to compare the de-serialized and fetched values alike
+		b, _ := json.Marshal(copied)
+		var normalized map[string]interface{}
+		json.Unmarshal(b, &normalized)
+		return normalized
+	}
+	return reflect.DeepEqual(withoutRegistration(stored), withoutRegistration(fetched))
+}
+
+// Stop stops browsing
+func (b *DNSSDBrowser) Stop() {
+	close(b.stop)
+	<-b.done
+}
+
+// DNSSDDirectories keeps the directories advertised with DNS-SD as peers
+// The directories are browsed periodically and kept for the TTL of their records.
+type DNSSDDirectories struct {
+	domain   string
+	ifaces   []net.Interface
+	interval time.Duration
+	// unescaped instance name of the directory itself
+	exclude string
+	stop    chan struct{}
+	done    chan struct{}
+
+	sync.Mutex
+	found map[string]dnssdDirectory
+}
+
+type dnssdDirectory struct {
+	peer    FederationPeer
+	expires time.Time
+}
+
+// NewDNSSDDirectories starts browsing for directories in the domain every interval, on all multicast interfaces if none are given
+// The directory with the excluded instance name, as configured and not escaped, is skipped.
+func NewDNSSDDirectories(domain string, ifaces []net.Interface, interval time.Duration, exclude string) *DNSSDDirectories {
+	d := &DNSSDDirectories{
+		domain:   domain,
+		ifaces:   ifaces,
+		interval: interval,
+		exclude:  exclude,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		found:    make(map[string]dnssdDirectory),
+	}
+	go d.run()
+	return d
+}
+
+func (d *DNSSDDirectories) run() {
+	defer close(d.done)
+	for {
+		err := browseDNSSD(d.stop, d.ifaces, d.domain, wot.DNSSDServiceSubtypeDirectory, d.add)
+		if err != nil {
+			log.Printf("DNS-SD: error browsing directories: %s", err)
+		}
+		select {
+		case <-time.After(d.interval):
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+func (d *DNSSDDirectories) add(entry *zeroconf.ServiceEntry) {
+	instance := unescapeDNSSDInstance(entry.Instance)
+	if instance == d.exclude {
+		return
+	}
+	base, err := dnssdBaseURL(entry)
+	if err != nil {
+		log.Printf("DNS-SD: error adding directory %s: %s", instance, err)
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.found[instance] = dnssdDirectory{
+		peer:    FederationPeer{Name: instance, URL: base},
+		expires: time.Now().Add(time.Duration(entry.TTL) * time.Second),
+	}
+}
+
+// unescapeDNSSDInstance returns the instance name of a received DNS label, e.g. "Thing Directory" for "Thing\ Directory"
+// Special characters are escaped as \c, and non-printable ones as \DDD with the decimal value of the byte.
+func unescapeDNSSDInstance(label string) string {
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 == len(label) {
+			b.WriteByte(label[i])
+			continue
+		}
+		if i+3 < len(label) {
+			if v, err := strconv.ParseUint(label[i+1:i+4], 10, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(label[i+1])
+		i++
+	}
+	return b.String()
+}
+
+// Peers returns the directories with unexpired records, sorted by name
+func (d *DNSSDDirectories) Peers() []FederationPeer {
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	var peers []FederationPeer
+	for instance, directory := range d.found {
+		if now.After(directory.expires) {
+			delete(d.found, instance)
+			continue
+		}
+		peers = append(peers, directory.peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+// Stop stops browsing
+func (d *DNSSDDirectories) Stop() {
+	close(d.stop)
+	<-d.done
+}
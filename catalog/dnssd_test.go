@@ -0,0 +1,175 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+// thingServer serves the TD of a Thing at /td
+type thingServer struct {
+	*httptest.Server
+	sync.Mutex
+	td ThingDescription
+}
+
+func newThingServer(t *testing.T, td ThingDescription) *thingServer {
+	s := &thingServer{td: td}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/td" {
+			http.NotFound(w, req)
+			return
+		}
+		s.Lock()
+		defer s.Unlock()
+		w.Header().Set("Content-Type", wot.MediaTypeThingDescription)
+		json.NewEncoder(w).Encode(s.td)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *thingServer) port(t *testing.T) int {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("error parsing port: %s", err)
+	}
+	return p
+}
+
+func TestDNSSDBrowserRegister(t *testing.T) {
+	controller := setup(t)
+	thing := newThingServer(t, outboxTestTD("urn:example:dnssd"))
+	browser := &DNSSDBrowser{controller: controller, client: http.DefaultClient}
+	entry := &zeroconf.ServiceEntry{
+		Port:     thing.port(t),
+		Text:     []string{"td=/td", "type=Thing"},
+		TTL:      120,
+		AddrIPv4: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	registration := func() *ThingDescription {
+		td, err := controller.get("urn:example:dnssd")
+		if err != nil {
+			t.Fatalf("error getting TD: %s", err)
+		}
+		return &td
+	}
+
+	t.Run("create", func(t *testing.T) {
+		if err := browser.register(entry); err != nil {
+			t.Fatalf("error registering: %s", err)
+		}
+		tr := ThingRegistration(*registration())
+		if ttl := ThingTTL(tr); ttl == nil || *ttl != 120 {
+			t.Fatalf("TTL %v instead of the record TTL", ttl)
+		}
+		if origin := ThingOrigin(tr); origin != OriginDNSSD {
+			t.Fatalf("origin %q instead of %q", origin, OriginDNSSD)
+		}
+	})
+
+	t.Run("renew unchanged", func(t *testing.T) {
+		if err := browser.register(entry); err != nil {
+			t.Fatalf("error registering: %s", err)
+		}
+		tr := ThingRegistration(*registration())
+		if ThingRevision(tr) != 1 || tr.LastSeen == nil {
+			t.Fatalf("unexpected registration after renewal: revision %d, last seen %v", ThingRevision(tr), tr.LastSeen)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		thing.Lock()
+		thing.td["title"] = "changed thing"
+		thing.Unlock()
+		entry.TTL = 60
+		if err := browser.register(entry); err != nil {
+			t.Fatalf("error registering: %s", err)
+		}
+		td := *registration()
+		tr := ThingRegistration(td)
+		if td["title"] != "changed thing" || ThingRevision(tr) != 2 || *ThingTTL(tr) != 60 {
+			t.Fatalf("unexpected update: %v", td)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		thing.Lock()
+		delete(thing.td, "title")
+		thing.Unlock()
+		if err := browser.register(entry); err == nil {
+			t.Fatalf("no error registering an invalid TD")
+		}
+	})
+
+	t.Run("registered by other means", func(t *testing.T) {
+		if _, err := controller.add(outboxTestTD("urn:example:api")); err != nil {
+			t.Fatalf("error adding TD: %s", err)
+		}
+		spoofed := outboxTestTD("urn:example:api")
+		spoofed["title"] = "spoofed thing"
+		spoofing := newThingServer(t, spoofed)
+		spoofingEntry := *entry
+		spoofingEntry.Port = spoofing.port(t)
+		if _, ok := browser.register(&spoofingEntry).(*ConflictError); !ok {
+			t.Fatalf("no conflict registering the TD of another registration")
+		}
+		td, err := controller.get("urn:example:api")
+		if err != nil {
+			t.Fatalf("error getting TD: %s", err)
+		}
+		tr := ThingRegistration(td)
+		if td["title"] != "example thing" || ThingRevision(tr) != 1 || ThingTTL(tr) != nil || tr.LastSeen != nil {
+			t.Fatalf("TD registered by other means was modified: %v", td)
+		}
+	})
+
+	t.Run("no TD path", func(t *testing.T) {
+		if _, err := dnssdTDURL(&zeroconf.ServiceEntry{Text: []string{"type=Thing"}}); err == nil {
+			t.Fatalf("no error without td in the TXT record")
+		}
+	})
+}
+
+func TestDNSSDBrowser(t *testing.T) {
+	controller := setup(t)
+	thing := newThingServer(t, outboxTestTD("urn:example:dnssd-browse"))
+
+	// in-process responder advertising the Thing at the loopback address
+	responder, err := zeroconf.RegisterProxy("test-thing", wot.DNSSDServiceType+","+wot.DNSSDServiceSubtypeThing, "local.",
+		thing.port(t), "test-thing-host", []string{"127.0.0.1"}, []string{"td=/td"}, nil)
+	if err != nil {
+		t.Skipf("multicast DNS is not available: %s", err)
+	}
+	defer responder.Shutdown()
+
+	browser := NewDNSSDBrowser(controller, "local.", nil, time.Hour)
+	defer browser.Stop()
+
+	deadline := time.Now().Add(dnssdBrowseTimeout)
+	for {
+		td, err := controller.get("urn:example:dnssd-browse")
+		if err == nil {
+			if ttl := ThingTTL(ThingRegistration(td)); ttl == nil || *ttl <= 0 {
+				t.Fatalf("TTL %v instead of the record TTL", ttl)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Thing not registered after %s", dnssdBrowseTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -27,6 +27,16 @@ type BadRequestError struct{ S string }
 
 func (e *BadRequestError) Error() string { return e.S }
 
+// Precondition Failed (e.g. entity-tag mismatch)
+type PreconditionFailedError struct{ S string }
+
+func (e *PreconditionFailedError) Error() string { return e.S }
+
+// Failed Dependency (e.g. operation not applied due to failure of a related one)
+type FailedDependencyError struct{ S string }
+
+func (e *FailedDependencyError) Error() string { return e.S }
+
 // Validation error (HTTP Bad Request)
 type ValidationError struct {
 	ValidationErrors []wot.ValidationError
@@ -5,6 +5,7 @@ type EventListener interface {
 	CreateHandler(new ThingDescription) error
 	UpdateHandler(old ThingDescription, new ThingDescription) error
 	DeleteHandler(old ThingDescription) error
+	ExpireHandler(old ThingDescription) error
 }
 
 // eventHandler implements sequential fav-out/fan-in of events from registry
@@ -39,3 +40,13 @@ func (h eventHandler) deleted(old ThingDescription) error {
 	}
 	return nil
 }
+
+func (h eventHandler) expired(old ThingDescription) error {
+	for i := range h {
+		err := h[i].ExpireHandler(old)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
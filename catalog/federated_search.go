@@ -0,0 +1,200 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const (
+	QueryParamScope = "scope"
+	// search scopes
+	ScopeLocal     = "local"
+	ScopeFederated = "federated"
+	// SearchSourceLocal is the source of the results of the directory itself
+	SearchSourceLocal = "local"
+	// search paths of the peers
+	searchPathJSONPath = "/search/jsonpath"
+	searchPathXPath    = "/search/xpath"
+)
+
+// FederatedSearch forwards search queries to peer directories
+// The peers are configured or discovered with DNS-SD. They are queried in the local scope, to avoid forwarding loops.
+type FederatedSearch struct {
+	peers       []FederationPeer
+	directories *DNSSDDirectories
+	timeout     time.Duration
+	client      *http.Client
+}
+
+// FederatedSearchResult is the merged result of a federated search
+type FederatedSearchResult struct {
+	Results []SearchResult `json:"results"`
+	Sources []SearchSource `json:"sources"`
+	// Partial is set if the query failed in any of the sources
+	Partial bool `json:"partial"`
+}
+
+// SearchResult is an item of the result of a query, annotated with the directory it comes from
+type SearchResult struct {
+	Source string          `json:"source"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// SearchSource is the outcome of a query in a directory
+type SearchSource struct {
+	Name    string `json:"name"`
+	URL     string `json:"url,omitempty"`
+	Results int    `json:"results"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewFederatedSearch returns a search of the configured peers and of the directories found with DNS-SD, if given
+// Each peer has to respond within the timeout.
+func NewFederatedSearch(peers []FederationPeer, directories *DNSSDDirectories, timeout time.Duration) *FederatedSearch {
+	trimmed := make([]FederationPeer, len(peers))
+	for i, peer := range peers {
+		trimmed[i] = FederationPeer{Name: peer.Name, URL: strings.TrimSuffix(peer.URL, "/")}
+	}
+	return &FederatedSearch{
+		peers:       trimmed,
+		directories: directories,
+		timeout:     timeout,
+		client:      &http.Client{},
+	}
+}
+
+// targets returns the configured and the discovered peers, each URL once
+func (s *FederatedSearch) targets() []FederationPeer {
+	peers := s.peers
+	if s.directories != nil {
+		peers = append(append([]FederationPeer(nil), peers...), s.directories.Peers()...)
+	}
+	seen := make(map[string]bool, len(peers))
+	targets := make([]FederationPeer, 0, len(peers))
+	for _, peer := range peers {
+		if !seen[peer.URL] {
+			seen[peer.URL] = true
+			targets = append(targets, peer)
+		}
+	}
+	return targets
+}
+
+// search forwards the query to the peers concurrently and merges their results after the local ones
+func (s *FederatedSearch) search(ctx context.Context, path, query string, local []byte) (*FederatedSearchResult, error) {
+	var localResults []json.RawMessage
+	err := json.Unmarshal(local, &localResults)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the local results: %s", err)
+	}
+
+	targets := s.targets()
+	peerResults := make([][]json.RawMessage, len(targets))
+	peerErrors := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, peer := range targets {
+		wg.Add(1)
+		go func(i int, peer FederationPeer) {
+			defer wg.Done()
+			peerResults[i], peerErrors[i] = s.forward(ctx, peer, path, query)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	result := &FederatedSearchResult{
+		Results: make([]SearchResult, 0, len(localResults)),
+		Sources: []SearchSource{{Name: SearchSourceLocal, Results: len(localResults)}},
+	}
+	for _, value := range localResults {
+		result.Results = append(result.Results, SearchResult{Source: SearchSourceLocal, Value: value})
+	}
+	for i, peer := range targets {
+		source := SearchSource{Name: peer.Name, URL: peer.URL, Results: len(peerResults[i])}
+		if peerErrors[i] != nil {
+			source.Error = peerErrors[i].Error()
+			result.Partial = true
+		}
+		for _, value := range peerResults[i] {
+			result.Results = append(result.Results, SearchResult{Source: peer.Name, Value: value})
+		}
+		result.Sources = append(result.Sources, source)
+	}
+	return result, nil
+}
+
+// forward queries a peer within the timeout
+func (s *FederatedSearch) forward(ctx context.Context, peer FederationPeer, path, query string) ([]json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	target := peer.URL + path + "?" + QueryParamSearchQuery + "=" + url.QueryEscape(query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status: %s", res.Status)
+	}
+	var results []json.RawMessage
+	err = json.NewDecoder(res.Body).Decode(&results)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding results: %s", err)
+	}
+	return results, nil
+}
+
+// SetFederatedSearch enables the federated scope of the search APIs
+func (a *HTTPAPI) SetFederatedSearch(search *FederatedSearch) {
+	a.federatedSearch = search
+}
+
+// parseSearchScope returns whether the search is in the federated scope
+func (a *HTTPAPI) parseSearchScope(req *http.Request) (bool, error) {
+	switch scope := req.Form.Get(QueryParamScope); scope {
+	case "", ScopeLocal:
+		return false, nil
+	case ScopeFederated:
+		if a.federatedSearch == nil {
+			return false, fmt.Errorf("federated search is not enabled")
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid %s: %s", QueryParamScope, scope)
+	}
+}
+
+// writeFederatedSearch writes the merged results of the local and the peer directories
+func (a *HTTPAPI) writeFederatedSearch(w http.ResponseWriter, req *http.Request, path, query string, local []byte) {
+	result, err := a.federatedSearch.search(req.Context(), path, query, local)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	w.Header().Set("X-Request-URL", req.RequestURI)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
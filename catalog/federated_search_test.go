@@ -0,0 +1,138 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// searchPeer responds to the search queries with the given results after the delay
+func searchPeer(t *testing.T, results string, delay time.Duration) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != searchPathJSONPath || req.URL.Query().Get(QueryParamSearchQuery) != "$[*].title" {
+			http.Error(w, "unexpected query", http.StatusBadRequest)
+			return
+		}
+		if req.URL.Query().Get(QueryParamScope) != "" {
+			http.Error(w, "forwarded scope", http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+		w.Write([]byte(results))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFederatedSearch(t *testing.T) {
+	controller := setup(t)
+	if _, err := controller.add(outboxTestTD("urn:example:local")); err != nil {
+		t.Fatalf("error adding TD: %s", err)
+	}
+	api := NewHTTPAPI(controller, "")
+
+	search := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, searchPathJSONPath+"?"+query, nil)
+		res := httptest.NewRecorder()
+		api.SearchJSONPath(res, req)
+		return res
+	}
+	query := QueryParamSearchQuery + "=" + url.QueryEscape("$[*].title")
+
+	t.Run("not enabled", func(t *testing.T) {
+		if res := search(query + "&scope=federated"); res.Code != http.StatusBadRequest {
+			t.Fatalf("status %d instead of 400", res.Code)
+		}
+	})
+
+	site := searchPeer(t, `["site thing"]`, 0)
+	slow := searchPeer(t, `["slow thing"]`, time.Second)
+	api.SetFederatedSearch(NewFederatedSearch([]FederationPeer{
+		{Name: "site", URL: site.URL + "/"},
+		{Name: "slow", URL: slow.URL},
+		{Name: "site-duplicate", URL: site.URL},
+	}, nil, 100*time.Millisecond))
+
+	t.Run("invalid scope", func(t *testing.T) {
+		if res := search(query + "&scope=global"); res.Code != http.StatusBadRequest {
+			t.Fatalf("status %d instead of 400", res.Code)
+		}
+	})
+
+	t.Run("local", func(t *testing.T) {
+		res := search(query)
+		if res.Code != http.StatusOK || res.Body.String() != `["example thing"]` {
+			t.Fatalf("unexpected local results: %d %s", res.Code, res.Body)
+		}
+	})
+
+	t.Run("federated", func(t *testing.T) {
+		res := search(query + "&scope=federated")
+		if res.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", res.Code, res.Body)
+		}
+		var result FederatedSearchResult
+		if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+			t.Fatalf("error decoding result: %s", err)
+		}
+
+		expected := []SearchResult{
+			{Source: SearchSourceLocal, Value: json.RawMessage(`"example thing"`)},
+			{Source: "site", Value: json.RawMessage(`"site thing"`)},
+		}
+		if len(result.Results) != len(expected) {
+			t.Fatalf("unexpected results: %s", res.Body)
+		}
+		for i := range expected {
+			if result.Results[i].Source != expected[i].Source || string(result.Results[i].Value) != string(expected[i].Value) {
+				t.Fatalf("unexpected result %d: %s", i, res.Body)
+			}
+		}
+
+		// the slow peer times out, the duplicate is not queried
+		if !result.Partial || len(result.Sources) != 3 {
+			t.Fatalf("unexpected sources: %s", res.Body)
+		}
+		if slow := result.Sources[2]; slow.Name != "slow" || slow.Error == "" || slow.Results != 0 {
+			t.Fatalf("unexpected source of the slow peer: %+v", slow)
+		}
+	})
+}
+
+func TestDNSSDDirectories(t *testing.T) {
+	d := &DNSSDDirectories{exclude: "LinkSmart Thing Directory", found: make(map[string]dnssdDirectory)}
+	entry := func(instance string, ttl uint32) *zeroconf.ServiceEntry {
+		return &zeroconf.ServiceEntry{
+			ServiceRecord: zeroconf.ServiceRecord{Instance: instance},
+			Port:          8081,
+			TTL:           ttl,
+			AddrIPv4:      []net.IP{net.IPv4(192, 0, 2, 1)},
+		}
+	}
+	// the received instance names are escaped
+	d.add(entry(`site\.b`, 120))
+	d.add(entry(`site\ a`, 120))
+	d.add(entry(`site\032c`, 120))
+	d.add(entry(`LinkSmart\ Thing\ Directory`, 120))
+	d.add(entry(`gone`, 0))
+
+	peers := d.Peers()
+	if len(peers) != 3 || peers[0].Name != "site a" || peers[1].Name != "site c" || peers[2].Name != "site.b" {
+		t.Fatalf("unexpected peers: %v", peers)
+	}
+	if peers[0].URL != "http://192.0.2.1:8081" {
+		t.Fatalf("unexpected URL: %s", peers[0].URL)
+	}
+}
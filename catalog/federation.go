@@ -0,0 +1,522 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const (
+	// maximum time to retrieve the listing or a TD of a peer
+	federationFetchTimeout = 30 * time.Second
+)
+
+// FederationPeer is a directory whose TDs are mirrored
+type FederationPeer struct {
+	// Name of the peer, set as the origin of the mirrored TDs
+	Name string `json:"name"`
+	// URL is the base URL of the directory API
+	URL string `json:"url"`
+}
+
+// PeerStatus is the state of the mirroring of a peer
+type PeerStatus struct {
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	Connected bool   `json:"connected"`
+	// LastEventID is the ID of the last applied event, used to resume the subscription
+	LastEventID string     `json:"lastEventID,omitempty"`
+	LastEvent   *time.Time `json:"lastEvent,omitempty"`
+	// LastSync is the time of the last resynchronization from the full listing
+	LastSync *time.Time `json:"lastSync,omitempty"`
+	Syncs    int        `json:"syncs"`
+	// Things is the number of mirrored TDs
+	Things int    `json:"things"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Federation mirrors the TDs of peer directories into a separate catalog
+// The TDs are tagged with the name of the peer as their origin and kept up to date by following the events of the peer.
+// They are stored by origin and id, i.e. the TD of a peer is retrieved from the catalog with the "<origin>/<id>" key.
+// The catalog is resynchronized from the full listing of the peer whenever the events do not follow on from the last
+// applied one, e.g. after a long disconnection or a restart of the peer.
+type Federation struct {
+	mirror *Controller
+	peers  []*federationPeer
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewFederation starts mirroring the peers into the given storage, reconnecting to them after the retry interval
+// The TDs of origins which are no longer configured are removed.
+func NewFederation(storage Storage, peers []FederationPeer, retryInterval time.Duration) (*Federation, error) {
+	// the mirrored TDs expire with the events of the peers, not by themselves
+	mirror := &Controller{
+		storage:  storage,
+		mirrored: true,
+		stopped:  make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Federation{
+		mirror: mirror,
+		cancel: cancel,
+	}
+
+	configured := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		configured[peer.Name] = true
+	}
+	for origin, ids := range mirror.mirroredIDs() {
+		if configured[origin] {
+			continue
+		}
+		for id := range ids {
+			if err := mirror.unmirror(id, origin); err != nil {
+				cancel()
+				return nil, fmt.Errorf("error removing TD %s of %s: %s", id, origin, err)
+			}
+		}
+		log.Printf("Federation: removed %d TDs of %s", len(ids), origin)
+	}
+
+	for _, peer := range peers {
+		peer.URL = strings.TrimSuffix(peer.URL, "/")
+		p := &federationPeer{
+			FederationPeer: peer,
+			mirror:         mirror,
+			retryInterval:  retryInterval,
+			// the event stream has no timeout
+			client: &http.Client{},
+		}
+		f.peers = append(f.peers, p)
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			p.run(ctx)
+		}()
+	}
+	return f, nil
+}
+
+// Controller returns the catalog of the mirrored TDs
+func (f *Federation) Controller() CatalogController {
+	return f.mirror
+}
+
+// Status returns the state of the peers
+func (f *Federation) Status() []PeerStatus {
+	mirrored := f.mirror.mirroredIDs()
+	statuses := make([]PeerStatus, 0, len(f.peers))
+	for _, p := range f.peers {
+		status := p.getStatus()
+		status.Things = len(mirrored[p.Name])
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// GetPeers returns the state of the peers
+func (f *Federation) GetPeers(w http.ResponseWriter, _ *http.Request) {
+	b, err := json.Marshal(f.Status())
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// Stop mirroring
+func (f *Federation) Stop() {
+	f.cancel()
+	f.wg.Wait()
+	f.mirror.Stop()
+}
+
+type federationPeer struct {
+	FederationPeer
+	mirror        *Controller
+	retryInterval time.Duration
+	client        *http.Client
+
+	sync.Mutex
+	status PeerStatus
+}
+
+// federationEvent is a Server-Sent Event of a peer
+type federationEvent struct {
+	name, id string
+	data     []byte
+}
+
+func (p *federationPeer) run(ctx context.Context) {
+	for {
+		err := p.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Federation: disconnected from %s: %s", p.Name, err)
+		p.disconnected(err)
+
+		select {
+		case <-time.After(p.retryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow subscribes to the events of the peer and applies them until the stream ends
+// Without a previous event to resume from, the subscription starts with a resynchronization.
+func (p *federationPeer) follow(ctx context.Context) error {
+	lastEventID := p.getStatus().LastEventID
+	stream, err := p.subscribe(ctx, lastEventID)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	p.connected()
+
+	if lastEventID == "" {
+		// events of the subscription are applied after the listing. Those already included are applied again, to the same effect.
+		err = p.resync(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	reader := bufio.NewReader(stream)
+	for {
+		event, err := readEvent(reader)
+		if err != nil {
+			return err
+		}
+		if lastEventID != "" && !followsEvent(lastEventID, event.id) {
+			log.Printf("Federation: event %s of %s does not follow %s. Resynchronizing.", event.id, p.Name, lastEventID)
+			err = p.resync(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		err = p.apply(ctx, event)
+		if err != nil {
+			// the mirror is no longer consistent
+			p.setLastEventID("")
+			return fmt.Errorf("error applying event %s: %s", event.id, err)
+		}
+		p.setLastEventID(event.id)
+		lastEventID = event.id
+	}
+}
+
+// subscribe opens the event stream of the peer, resuming after the given event
+func (p *federationPeer) subscribe(ctx context.Context, lastEventID string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+"/events?diff=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("event subscription response status: %s", res.Status)
+	}
+	return res.Body, nil
+}
+
+// resync mirrors the full listing of the peer and removes the TDs which are no longer listed
+func (p *federationPeer) resync(ctx context.Context) error {
+	var tds []ThingDescription
+	err := p.fetch(ctx, "/things", &tds)
+	if err != nil {
+		return fmt.Errorf("error retrieving the listing: %s", err)
+	}
+
+	listed := make(map[string]bool, len(tds))
+	for _, td := range tds {
+		id, ok := td[wot.KeyThingID].(string)
+		if !ok || id == "" {
+			continue
+		}
+		err := p.mirror.mirror(td, p.Name)
+		if err != nil {
+			return fmt.Errorf("error mirroring TD %s: %s", id, err)
+		}
+		listed[id] = true
+	}
+	for id := range p.mirror.mirroredIDs()[p.Name] {
+		if !listed[id] {
+			err := p.mirror.unmirror(id, p.Name)
+			if err != nil {
+				return fmt.Errorf("error removing TD %s: %s", id, err)
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	p.Lock()
+	p.status.LastSync = &now
+	p.status.Syncs++
+	p.Unlock()
+	log.Printf("Federation: synchronized %d TDs of %s", len(listed), p.Name)
+	return nil
+}
+
+// apply mirrors the change of a TD
+// Updates are merge patches of the stored TD, the whole TD is retrieved if it is not stored.
+func (p *federationPeer) apply(ctx context.Context, event federationEvent) error {
+	var data ThingDescription
+	err := json.Unmarshal(event.data, &data)
+	if err != nil {
+		return fmt.Errorf("error decoding data: %s", err)
+	}
+	id, ok := data[wot.KeyThingID].(string)
+	if !ok || id == "" {
+		return fmt.Errorf("data has no id")
+	}
+
+	switch federationEventType(event.name) {
+	case wot.EventTypeCreate:
+		return p.mirror.mirror(data, p.Name)
+	case wot.EventTypeUpdate:
+		err := p.mirror.mirrorPatch(id, event.data, p.Name)
+		if _, notFound := err.(*NotFoundError); !notFound {
+			return err
+		}
+		var td ThingDescription
+		err = p.fetch(ctx, "/things/"+id, &td)
+		if err != nil {
+			return fmt.Errorf("error retrieving TD %s: %s", id, err)
+		}
+		return p.mirror.mirror(td, p.Name)
+	case wot.EventTypeDelete:
+		err := p.mirror.unmirror(id, p.Name)
+		if _, notFound := err.(*NotFoundError); notFound {
+			return nil
+		}
+		return err
+	}
+	// unknown events are skipped
+	return nil
+}
+
+// fetch decodes the JSON response of the path of the peer
+func (p *federationPeer) fetch(ctx context.Context, path string, v interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, federationFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("response status: %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (p *federationPeer) getStatus() PeerStatus {
+	p.Lock()
+	defer p.Unlock()
+	status := p.status
+	status.Name, status.URL = p.Name, p.URL
+	return status
+}
+
+func (p *federationPeer) connected() {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Connected = true
+	p.status.Error = ""
+}
+
+func (p *federationPeer) disconnected(err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Connected = false
+	p.status.Error = err.Error()
+}
+
+func (p *federationPeer) setLastEventID(id string) {
+	now := time.Now().UTC()
+	p.Lock()
+	defer p.Unlock()
+	p.status.LastEventID = id
+	if id != "" {
+		p.status.LastEvent = &now
+	}
+}
+
+// readEvent reads the next event of a stream
+func readEvent(reader *bufio.Reader) (federationEvent, error) {
+	var event federationEvent
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return event, fmt.Errorf("end of the event stream")
+			}
+			return event, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if data == nil {
+				continue
+			}
+			event.data = []byte(strings.Join(data, "\n"))
+			return event, nil
+		}
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "event":
+			event.name = value
+		case "id":
+			event.id = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+// federationEventType returns the type of the event with the name in the default or the W3C WoT Discovery API
+func federationEventType(name string) wot.EventType {
+	switch name {
+	case wot.EventTypeCreate, wot.DiscoveryEventCreated:
+		return wot.EventTypeCreate
+	case wot.EventTypeUpdate, wot.DiscoveryEventUpdated:
+		return wot.EventTypeUpdate
+	case wot.EventTypeDelete, wot.EventTypeExpire, wot.DiscoveryEventDeleted:
+		return wot.EventTypeDelete
+	}
+	return wot.EventType(name)
+}
+
+// followsEvent checks if the event IDs are consecutive
+// The IDs of the directory events are hexadecimal sequence numbers.
+func followsEvent(lastID, id string) bool {
+	last, err := strconv.ParseUint(lastID, 16, 64)
+	if err != nil {
+		return false
+	}
+	next, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		return false
+	}
+	return next == last+1
+}
+
+// mirrorKey returns the storage key of a mirrored TD
+// The TDs are keyed by origin and id, so that peers with the same TDs are mirrored side by side.
+func mirrorKey(origin, id string) string {
+	return origin + "/" + id
+}
+
+// mirror stores the TD of a peer as is, with the peer as its origin
+func (c *Controller) mirror(td ThingDescription, origin string) error {
+	id, ok := td[wot.KeyThingID].(string)
+	if !ok || id == "" {
+		return fmt.Errorf("TD has no id")
+	}
+	registration, ok := td[wot.KeyThingRegistration].(map[string]interface{})
+	if !ok {
+		registration = make(map[string]interface{})
+	}
+	registration[wot.KeyThingRegistrationOrigin] = origin
+	td[wot.KeyThingRegistration] = registration
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	// the mirror has no listeners and stores no events
+	key := mirrorKey(origin, id)
+	_, err := c.storage.get(key)
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			return c.storage.add(key, td, nil)
+		default:
+			return err
+		}
+	}
+	return c.storage.update(key, td, nil)
+}
+
+// mirrorPatch applies a merge patch to the TD of the origin
+func (c *Controller) mirrorPatch(id string, patch []byte, origin string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	key := mirrorKey(origin, id)
+	td, err := c.storage.get(key)
+	if err != nil {
+		return err
+	}
+	oldBytes, err := json.Marshal(td)
+	if err != nil {
+		return err
+	}
+	newBytes, err := jsonpatch.MergePatch(oldBytes, patch)
+	if err != nil {
+		return fmt.Errorf("error applying merge patch: %s", err)
+	}
+	var patched ThingDescription
+	err = json.Unmarshal(newBytes, &patched)
+	if err != nil {
+		return err
+	}
+	return c.storage.update(key, patched, nil)
+}
+
+// unmirror removes the TD of the origin
+func (c *Controller) unmirror(id, origin string) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	return c.storage.delete(mirrorKey(origin, id), nil)
+}
+
+// mirroredIDs returns the IDs of the mirrored TDs by origin
+func (c *Controller) mirroredIDs() map[string]map[string]bool {
+	ids := make(map[string]map[string]bool)
+	for td := range c.storage.iterator() {
+		tr := ThingRegistration(td)
+		if tr == nil {
+			continue
+		}
+		if ids[tr.Origin] == nil {
+			ids[tr.Origin] = make(map[string]bool)
+		}
+		ids[tr.Origin][td[wot.KeyThingID].(string)] = true
+	}
+	return ids
+}
@@ -0,0 +1,117 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/wot"
+)
+
+func TestFederationMirror(t *testing.T) {
+	storage := NewMemoryStorage(0)
+	defer storage.Close()
+	f, err := NewFederation(storage, nil, time.Hour)
+	if err != nil {
+		t.Fatalf("error starting federation: %s", err)
+	}
+	mirror := f.mirror
+
+	t.Run("same id from two peers", func(t *testing.T) {
+		for _, origin := range []string{"site-a", "site-b"} {
+			td := outboxTestTD("urn:example:shared")
+			td["title"] = "thing of " + origin
+			if err := mirror.mirror(td, origin); err != nil {
+				t.Fatalf("error mirroring: %s", err)
+			}
+		}
+		if ids := mirror.mirroredIDs(); !ids["site-a"]["urn:example:shared"] || !ids["site-b"]["urn:example:shared"] {
+			t.Fatalf("unexpected mirrored IDs: %v", ids)
+		}
+		if err := mirror.mirrorPatch("urn:example:shared", []byte(`{"title":"patched"}`), "site-b"); err != nil {
+			t.Fatalf("error patching: %s", err)
+		}
+		if err := mirror.unmirror("urn:example:shared", "site-b"); err != nil {
+			t.Fatalf("error removing: %s", err)
+		}
+		td, err := mirror.get(mirrorKey("site-a", "urn:example:shared"))
+		if err != nil {
+			t.Fatalf("TD removed by another origin: %s", err)
+		}
+		if origin := ThingRegistration(td).Origin; origin != "site-a" || td["title"] != "thing of site-a" {
+			t.Fatalf("TD of site-a modified by site-b: %v", td)
+		}
+		if _, err := mirror.get(mirrorKey("site-b", "urn:example:shared")); err == nil {
+			t.Fatalf("TD of site-b is kept after its removal")
+		}
+	})
+
+	t.Run("list by origin and id", func(t *testing.T) {
+		for _, origin := range []string{"site-a", "site-b"} {
+			if err := mirror.mirror(outboxTestTD("urn:example:listed"), origin); err != nil {
+				t.Fatalf("error mirroring: %s", err)
+			}
+		}
+		var listed []string
+		after := ""
+		for {
+			tds, next, err := mirror.listAfter(after, 1)
+			if err != nil {
+				t.Fatalf("error listing: %s", err)
+			}
+			for _, td := range tds {
+				listed = append(listed, mirror.thingKey(td))
+			}
+			if next == "" {
+				break
+			}
+			after = next
+		}
+		expected := []string{"site-a/urn:example:listed", "site-a/urn:example:shared", "site-b/urn:example:listed"}
+		if !reflect.DeepEqual(listed, expected) {
+			t.Fatalf("listed %v instead of %v", listed, expected)
+		}
+	})
+
+	t.Run("remove unconfigured origins", func(t *testing.T) {
+		f.Stop()
+		f, err := NewFederation(storage, []FederationPeer{{Name: "site-a", URL: "http://localhost:0"}}, time.Hour)
+		if err != nil {
+			t.Fatalf("error starting federation: %s", err)
+		}
+		defer f.Stop()
+		if _, err := f.mirror.get(mirrorKey("site-b", "urn:example:listed")); err == nil {
+			t.Fatalf("TD of an unconfigured origin is kept")
+		}
+		if _, err := f.mirror.get(mirrorKey("site-a", "urn:example:listed")); err != nil {
+			t.Fatalf("TD with the same id of a configured origin is removed: %s", err)
+		}
+	})
+}
+
+func TestReadEvent(t *testing.T) {
+	stream := "event: create\nid: 1f\ndata: {\"id\":\ndata: \"urn:example:1\"}\n\n: comment\n\nevent: thing_deleted\nid: 20\ndata: {}\n\n"
+	reader := bufio.NewReader(strings.NewReader(stream))
+
+	first, err := readEvent(reader)
+	if err != nil {
+		t.Fatalf("error reading event: %s", err)
+	}
+	if first.name != "create" || first.id != "1f" || string(first.data) != "{\"id\":\n\"urn:example:1\"}" {
+		t.Fatalf("unexpected event: %+v", first)
+	}
+	second, err := readEvent(reader)
+	if err != nil {
+		t.Fatalf("error reading event: %s", err)
+	}
+	if federationEventType(second.name) != wot.EventTypeDelete || !followsEvent(first.id, second.id) {
+		t.Fatalf("unexpected event following %s: %+v", first.id, second)
+	}
+	if _, err := readEvent(reader); err == nil {
+		t.Fatalf("no error at the end of the stream")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/linksmart/thing-directory/wot"
+)
+
+// archiveRevision tells whether the replaced TD should be kept in history, and returns its revision
+// A TD is archived when it is deleted or replaced by another revision. Heartbeats do not change the revision.
+func archiveRevision(oldBytes, newBytes []byte) (bool, uint64) {
+	revision := func(b []byte) uint64 {
+		var td struct {
+			Registration struct {
+				Revision uint64 `json:"revision"`
+			} `json:"registration"`
+		}
+		// TDs stored without revision are at revision zero
+		json.Unmarshal(b, &td)
+		return td.Registration.Revision
+	}
+
+	oldRevision := revision(oldBytes)
+	if newBytes != nil && revision(newBytes) == oldRevision {
+		return false, oldRevision
+	}
+	return true, oldRevision
+}
+
+// history returns the previous revisions of a TD, latest first
+func (c *Controller) history(id string) ([]ThingDescription, error) {
+	tds, err := c.storage.history(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(tds) == 0 {
+		// distinguish TDs without history from unknown ones
+		if _, err := c.storage.get(id); err != nil {
+			return nil, err
+		}
+		return []ThingDescription{}, nil
+	}
+	return tds, nil
+}
+
+// getRevision returns the given revision of a TD, either the current one or one from history
+func (c *Controller) getRevision(id string, revision uint64) (ThingDescription, error) {
+	td, err := c.storage.get(id)
+	if err == nil && ThingRevision(ThingRegistration(td)) == revision {
+		return td, nil
+	}
+	if _, notFound := err.(*NotFoundError); err != nil && !notFound {
+		return nil, err
+	}
+
+	tds, err := c.storage.history(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, td := range tds {
+		if ThingRevision(ThingRegistration(td)) == revision {
+			return td, nil
+		}
+	}
+	return nil, &NotFoundError{fmt.Sprintf("revision %d of %s is not found", revision, id)}
+}
+
+// restore stores the given revision of a TD as a new revision
+// A deleted TD is re-created, in which case created is true.
+func (c *Controller) restore(id string, revision uint64, pre *preconditions) (created bool, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	oldTD, err := c.storage.get(id)
+	if _, notFound := err.(*NotFoundError); notFound {
+		oldTD = nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := pre.check(oldTD); err != nil {
+		return false, err
+	}
+
+	td, err := c.getRevision(id, revision)
+	if err != nil {
+		return false, err
+	}
+
+	if oldTD == nil {
+		_, err = c.prepareAdd(td, "")
+		if err != nil {
+			return false, err
+		}
+		err = c.continueRevision(id, td)
+		if err != nil {
+			return false, err
+		}
+		err = c.storage.add(id, td, createdEvent(td))
+		if err != nil {
+			return false, err
+		}
+		c.signalOutbox()
+		return true, nil
+	}
+
+	err = c.prepareUpdate(oldTD, td)
+	if err != nil {
+		return false, err
+	}
+	err = c.storage.update(id, td, updatedEvent(oldTD, td))
+	if err != nil {
+		return false, err
+	}
+	c.signalOutbox()
+	return false, nil
+}
+
+// continueRevision sets the revision of a re-created TD to follow the revisions in its history
+// The TD must have been prepared with prepareAdd.
+func (c *Controller) continueRevision(id string, td ThingDescription) error {
+	tds, err := c.storage.history(id)
+	if err != nil || len(tds) == 0 {
+		return err
+	}
+
+	tr := ThingRegistration(td)
+	revision := ThingRevision(ThingRegistration(tds[0])) + 1
+	tr.Revision = &revision
+	td[wot.KeyThingRegistration] = *tr
+	return nil
+}
@@ -3,11 +3,15 @@
 package catalog
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/linksmart/service-catalog/v3/utils"
@@ -22,17 +26,39 @@ const (
 	QueryParamJSONPath    = "jsonpath"
 	QueryParamXPath       = "xpath"
 	QueryParamSearchQuery = "query"
+	QueryParamAtomic      = "atomic"
+	QueryParamAfter       = "after"
+	QueryParamLimit       = "limit"
+	QueryParamSort        = "sort"
+	QueryParamOrder       = "order"
+	QueryParamFields      = "fields"
+	QueryParamRevision    = "revision"
+	// sort orders
+	SortOrderAsc  = "asc"
+	SortOrderDesc = "desc"
 	// Deprecated
 	QueryParamFetchPath = "fetch"
+	// conditional request headers
+	HeaderETag        = "ETag"
+	HeaderIfMatch     = "If-Match"
+	HeaderIfNoneMatch = "If-None-Match"
 )
 
 type ThingDescriptionPage struct {
 	Context string      `json:"@context"`
 	Type    string      `json:"@type"`
 	Items   interface{} `json:"items"`
-	Page    int         `json:"page"`
+	Page    int         `json:"page,omitempty"`
 	PerPage int         `json:"perPage"`
 	Total   int         `json:"total"`
+	Next    string      `json:"next,omitempty"`
+}
+
+// BatchResult is the outcome of one operation in a batch request
+type BatchResult struct {
+	Status int                 `json:"status"`
+	ID     string              `json:"id,omitempty"`
+	Error  *wot.ProblemDetails `json:"error,omitempty"`
 }
 
 type ValidationResult struct {
@@ -42,6 +68,8 @@ type ValidationResult struct {
 
 type HTTPAPI struct {
 	controller CatalogController
+	// forwards the queries of the federated search scope, if enabled
+	federatedSearch *FederatedSearch
 }
 
 func NewHTTPAPI(controller CatalogController, version string) *HTTPAPI {
@@ -92,6 +120,7 @@ func (a *HTTPAPI) Post(w http.ResponseWriter, req *http.Request) {
 	}
 
 	w.Header().Set("Location", id)
+	w.Header().Set(HeaderETag, ThingETag(td))
 	w.WriteHeader(http.StatusCreated)
 }
 
@@ -122,30 +151,14 @@ func (a *HTTPAPI) Put(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = a.controller.update(params["id"], td)
+	created, err := a.controller.put(params["id"], td, parsePreconditions(req))
 	if err != nil {
 		switch err.(type) {
-		case *NotFoundError:
-			// Create a new device with the given id
-			id, err := a.controller.add(td)
-			if err != nil {
-				switch err.(type) {
-				case *ConflictError:
-					ErrorResponse(w, http.StatusConflict, "Error creating the registration:", err.Error())
-					return
-				case *BadRequestError:
-					ErrorResponse(w, http.StatusBadRequest, "Invalid registration:", err.Error())
-					return
-				case *ValidationError:
-					ValidationErrorResponse(w, err.(*ValidationError).ValidationErrors)
-					return
-				default:
-					ErrorResponse(w, http.StatusInternalServerError, "Error creating the registration:", err.Error())
-					return
-				}
-			}
-			w.Header().Set("Location", id)
-			w.WriteHeader(http.StatusCreated)
+		case *PreconditionFailedError:
+			ErrorResponse(w, http.StatusPreconditionFailed, err.Error())
+			return
+		case *ConflictError:
+			ErrorResponse(w, http.StatusConflict, "Error creating the registration:", err.Error())
 			return
 		case *BadRequestError:
 			ErrorResponse(w, http.StatusBadRequest, "Invalid registration:", err.Error())
@@ -159,10 +172,18 @@ func (a *HTTPAPI) Put(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	// the entity-tag of the stored TD, for subsequent conditional requests
+	w.Header().Set(HeaderETag, ThingETag(td))
+	if created {
+		w.Header().Set("Location", params["id"])
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // Patch updates parts or all of an existing item (Response: StatusOK)
+// The patch document is an RFC7396 JSON Merge Patch, or an RFC6902 JSON Patch if indicated by the content type
 func (a *HTTPAPI) Patch(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 
@@ -173,25 +194,36 @@ func (a *HTTPAPI) Patch(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	var td ThingDescription
-	if err := json.Unmarshal(body, &td); err != nil {
-		ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
-		return
-	}
-
-	if id, ok := td[wot.KeyThingID].(string); ok && id == "" {
-		if params["id"] != td[wot.KeyThingID] {
-			ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Resource id in path (%s) does not match the id in body (%s)", params["id"], td[wot.KeyThingID]))
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == wot.MediaTypeJSONPatch {
+		err = a.controller.jsonPatch(params["id"], body, parsePreconditions(req))
+	} else {
+		var td ThingDescription
+		if err := json.Unmarshal(body, &td); err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
 			return
 		}
-	}
 
-	err = a.controller.patch(params["id"], td)
+		if id, ok := td[wot.KeyThingID].(string); ok && id == "" {
+			if params["id"] != td[wot.KeyThingID] {
+				ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Resource id in path (%s) does not match the id in body (%s)", params["id"], td[wot.KeyThingID]))
+				return
+			}
+		}
+
+		err = a.controller.patch(params["id"], td, parsePreconditions(req))
+	}
 	if err != nil {
 		switch err.(type) {
 		case *NotFoundError:
 			ErrorResponse(w, http.StatusNotFound, "Invalid registration:", err.Error())
 			return
+		case *PreconditionFailedError:
+			ErrorResponse(w, http.StatusPreconditionFailed, err.Error())
+			return
+		case *ConflictError:
+			ErrorResponse(w, http.StatusConflict, err.Error())
+			return
 		case *BadRequestError:
 			ErrorResponse(w, http.StatusBadRequest, "Invalid registration:", err.Error())
 			return
@@ -211,7 +243,19 @@ func (a *HTTPAPI) Patch(w http.ResponseWriter, req *http.Request) {
 func (a *HTTPAPI) Get(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 
-	td, err := a.controller.get(params["id"])
+	var td ThingDescription
+	var err error
+	if r := req.URL.Query().Get(QueryParamRevision); r != "" {
+		var revision uint64
+		revision, err = strconv.ParseUint(r, 10, 64)
+		if err != nil {
+			ErrorResponse(w, http.StatusBadRequest, "Invalid revision:", err.Error())
+			return
+		}
+		td, err = a.controller.getRevision(params["id"], revision)
+	} else {
+		td, err = a.controller.get(params["id"])
+	}
 	if err != nil {
 		switch err.(type) {
 		case *NotFoundError:
@@ -223,6 +267,17 @@ func (a *HTTPAPI) Get(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	etag := ThingETag(td)
+	w.Header().Set(HeaderETag, etag)
+	if ifMatch := req.Header.Get(HeaderIfMatch); ifMatch != "" && !matchETag(ifMatch, etag) {
+		ErrorResponse(w, http.StatusPreconditionFailed, "If-Match precondition failed")
+		return
+	}
+	if ifNoneMatch := req.Header.Get(HeaderIfNoneMatch); ifNoneMatch != "" && matchETag(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	b, err := json.Marshal(td)
 	if err != nil {
 		ErrorResponse(w, http.StatusInternalServerError, err.Error())
@@ -240,12 +295,15 @@ func (a *HTTPAPI) Get(w http.ResponseWriter, req *http.Request) {
 func (a *HTTPAPI) Delete(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 
-	err := a.controller.delete(params["id"])
+	err := a.controller.delete(params["id"], parsePreconditions(req))
 	if err != nil {
 		switch err.(type) {
 		case *NotFoundError:
 			ErrorResponse(w, http.StatusNotFound, err.Error())
 			return
+		case *PreconditionFailedError:
+			ErrorResponse(w, http.StatusPreconditionFailed, err.Error())
+			return
 		default:
 			ErrorResponse(w, http.StatusInternalServerError, "Error deleting the registration:", err.Error())
 			return
@@ -255,6 +313,196 @@ func (a *HTTPAPI) Delete(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Heartbeat renews the registration of an item without modifying it
+func (a *HTTPAPI) Heartbeat(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	tr, err := a.controller.heartbeat(params["id"])
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, "Error renewing the registration:", err.Error())
+			return
+		}
+	}
+
+	b, err := json.Marshal(tr)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// History retrieves the previous revisions of a TD, latest first
+// A TD whose id ends with /history is retrieved instead, if it exists, as its path is the same.
+func (a *HTTPAPI) History(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	fullID := params["id"] + "/history"
+	if _, err := a.controller.get(fullID); err == nil {
+		a.Get(w, mux.SetURLVars(req, map[string]string{"id": fullID}))
+		return
+	}
+
+	tds, err := a.controller.history(params["id"])
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, "Error retrieving the history: ", err.Error())
+			return
+		}
+	}
+
+	b, err := json.Marshal(tds)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// Restore stores a previous revision of a TD as its latest revision
+// A deleted TD is re-created from its history.
+func (a *HTTPAPI) Restore(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	revision, err := strconv.ParseUint(req.URL.Query().Get(QueryParamRevision), 10, 64)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Invalid or missing revision:", err.Error())
+		return
+	}
+
+	created, err := a.controller.restore(params["id"], revision, parsePreconditions(req))
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		case *PreconditionFailedError:
+			ErrorResponse(w, http.StatusPreconditionFailed, err.Error())
+			return
+		case *ValidationError:
+			ValidationErrorResponse(w, err.(*ValidationError).ValidationErrors)
+			return
+		default:
+			ErrorResponse(w, http.StatusInternalServerError, "Error restoring the registration:", err.Error())
+			return
+		}
+	}
+
+	if created {
+		w.Header().Set("Location", params["id"])
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Batch performs several create, update, and delete operations and responds with the result of each
+// With the atomic query parameter set to true, either all or none of the operations are applied
+func (a *HTTPAPI) Batch(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query:", err.Error())
+		return
+	}
+	atomic := strings.EqualFold(req.Form.Get(QueryParamAtomic), "true")
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var ops []BatchOperation
+	if err := json.Unmarshal(body, &ops); err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
+		return
+	}
+	if len(ops) > MaxBatchSize {
+		ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Batch has %d operations. Maximum is %d.", len(ops), MaxBatchSize))
+		return
+	}
+
+	results := a.controller.batch(ops, atomic)
+
+	response := make([]BatchResult, len(results))
+	for i, r := range results {
+		response[i].ID = r.id
+		switch {
+		case r.err != nil:
+			pd := errorProblemDetails(r.err)
+			response[i].Status = pd.Status
+			response[i].Error = &pd
+		case r.created:
+			response[i].Status = http.StatusCreated
+		default:
+			response[i].Status = http.StatusNoContent
+		}
+	}
+
+	b, err := json.Marshal(response)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// errorProblemDetails maps errors returned by the controller to problem details
+func errorProblemDetails(err error) wot.ProblemDetails {
+	var status int
+	switch err.(type) {
+	case *NotFoundError:
+		status = http.StatusNotFound
+	case *ConflictError:
+		status = http.StatusConflict
+	case *BadRequestError:
+		status = http.StatusBadRequest
+	case *PreconditionFailedError:
+		status = http.StatusPreconditionFailed
+	case *FailedDependencyError:
+		status = http.StatusFailedDependency
+	case *ValidationError:
+		return wot.ProblemDetails{
+			Title:            http.StatusText(http.StatusBadRequest),
+			Status:           http.StatusBadRequest,
+			Detail:           "The input did not pass the JSON Schema validation",
+			ValidationErrors: err.(*ValidationError).ValidationErrors,
+		}
+	default:
+		status = http.StatusInternalServerError
+	}
+	return wot.ProblemDetails{
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+	}
+}
+
 // GetMany lists entries in a paginated catalog format
 func (a *HTTPAPI) GetMany(w http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
@@ -262,6 +510,28 @@ func (a *HTTPAPI) GetMany(w http.ResponseWriter, req *http.Request) {
 		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query:", err.Error())
 		return
 	}
+	opts, err := parseListingOptions(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
+	// keyset pagination with after and limit
+	_, hasAfter := req.Form[QueryParamAfter]
+	_, hasLimit := req.Form[QueryParamLimit]
+	if hasAfter || hasLimit {
+		if req.Form.Get(QueryParamPage) != "" || req.Form.Get(QueryParamPerPage) != "" ||
+			req.Form.Get(QueryParamJSONPath) != "" || req.Form.Get(QueryParamXPath) != "" || opts.sortBy != "" {
+			ErrorResponse(w, http.StatusBadRequest, "after and limit should not be mixed with page, per_page, jsonpath, xpath, or sort")
+			return
+		}
+		a.getManyAfter(w, req, opts)
+		return
+	}
+	if (opts.sortBy != "" || opts.fields != nil) && (req.Form.Get(QueryParamJSONPath) != "" || req.Form.Get(QueryParamXPath) != "") {
+		ErrorResponse(w, http.StatusBadRequest, "sort and fields should not be mixed with jsonpath or xpath")
+		return
+	}
+
 	page, perPage, err := utils.ParsePagingParams(
 		req.Form.Get(QueryParamPage), req.Form.Get(QueryParamPerPage), MaxPerPage)
 	if err != nil {
@@ -305,7 +575,12 @@ func (a *HTTPAPI) GetMany(w http.ResponseWriter, req *http.Request) {
 		ErrorResponse(w, http.StatusBadRequest, "fetch query parameter is deprecated. Use jsonpath or xpath")
 		return
 	} else {
-		items, total, err = a.controller.list(page, perPage)
+		var tds []ThingDescription
+		if opts.sortBy != "" {
+			tds, total, err = a.controller.listSorted(opts.sortBy, opts.desc, page, perPage)
+		} else {
+			tds, total, err = a.controller.list(page, perPage)
+		}
 		if err != nil {
 			switch err.(type) {
 			case *BadRequestError:
@@ -316,6 +591,7 @@ func (a *HTTPAPI) GetMany(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 		}
+		items = opts.projectAll(tds)
 	}
 
 	coll := &ThingDescriptionPage{
@@ -326,6 +602,60 @@ func (a *HTTPAPI) GetMany(w http.ResponseWriter, req *http.Request) {
 		PerPage: perPage,
 		Total:   total,
 	}
+	if page*perPage < total {
+		coll.Next = nextLink(req, QueryParamPage, strconv.Itoa(page+1))
+	}
+
+	b, err := json.Marshal(coll)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", wot.MediaTypeJSONLD)
+	w.Header().Set("X-Request-URL", req.RequestURI)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+// getManyAfter lists the entries following the one with the given ID
+func (a *HTTPAPI) getManyAfter(w http.ResponseWriter, req *http.Request, opts *listingOptions) {
+	limit := MaxPerPage
+	if l := req.Form.Get(QueryParamLimit); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > MaxPerPage {
+			ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("%s must be an integer between 1 and %d", QueryParamLimit, MaxPerPage))
+			return
+		}
+	}
+
+	items, next, err := a.controller.listAfter(req.Form.Get(QueryParamAfter), limit)
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	total, err := a.controller.total()
+	if err != nil {
+		ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if items == nil {
+		items = []ThingDescription{}
+	}
+
+	coll := &ThingDescriptionPage{
+		Context: ResponseContextURL,
+		Type:    ResponseType,
+		Items:   opts.projectAll(items),
+		PerPage: limit,
+		Total:   total,
+	}
+	if next != "" {
+		coll.Next = nextLink(req, QueryParamAfter, next)
+	}
 
 	b, err := json.Marshal(coll)
 	if err != nil {
@@ -341,6 +671,88 @@ func (a *HTTPAPI) GetMany(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// listingOptions are the sorting and projection parameters of listing requests
+type listingOptions struct {
+	// dot-separated path of the attribute to sort by
+	sortBy string
+	desc   bool
+	// dot-separated paths of the attributes to include; all if nil
+	fields []string
+}
+
+func parseListingOptions(req *http.Request) (*listingOptions, error) {
+	opts := &listingOptions{
+		sortBy: req.Form.Get(QueryParamSort),
+	}
+	switch order := req.Form.Get(QueryParamOrder); order {
+	case "", SortOrderAsc:
+	case SortOrderDesc:
+		opts.desc = true
+	default:
+		return nil, fmt.Errorf("%s must be either %s or %s", QueryParamOrder, SortOrderAsc, SortOrderDesc)
+	}
+	if opts.desc && opts.sortBy == "" {
+		return nil, fmt.Errorf("%s requires %s", QueryParamOrder, QueryParamSort)
+	}
+	if fields := req.Form.Get(QueryParamFields); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				opts.fields = append(opts.fields, field)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// project returns a TD with only the requested fields
+func (opts *listingOptions) project(td ThingDescription) ThingDescription {
+	if opts.fields == nil {
+		return td
+	}
+	projected := make(ThingDescription)
+	for _, field := range opts.fields {
+		src, dst := map[string]interface{}(td), map[string]interface{}(projected)
+		keys := strings.Split(field, ".")
+		for i, key := range keys {
+			v, found := src[key]
+			if !found {
+				break
+			}
+			if i == len(keys)-1 {
+				dst[key] = v
+				break
+			}
+			next, ok := v.(map[string]interface{})
+			if !ok {
+				break
+			}
+			if _, ok := dst[key].(map[string]interface{}); !ok {
+				dst[key] = make(map[string]interface{})
+			}
+			src, dst = next, dst[key].(map[string]interface{})
+		}
+	}
+	return projected
+}
+
+func (opts *listingOptions) projectAll(tds []ThingDescription) []ThingDescription {
+	if opts.fields == nil {
+		return tds
+	}
+	projected := make([]ThingDescription, len(tds))
+	for i := range tds {
+		projected[i] = opts.project(tds[i])
+	}
+	return projected
+}
+
+// nextLink returns the path and query of the request, with the given query parameter replaced
+func nextLink(req *http.Request, key, value string) string {
+	query := req.URL.Query()
+	query.Set(key, value)
+	return req.URL.Path + "?" + query.Encode()
+}
+
 // GetAll lists entries in a paginated catalog format
 func (a *HTTPAPI) GetAll(w http.ResponseWriter, req *http.Request) {
 	//flusher, ok := w.(http.Flusher)
@@ -348,16 +760,41 @@ func (a *HTTPAPI) GetAll(w http.ResponseWriter, req *http.Request) {
 	//	panic("expected http.ResponseWriter to be an http.Flusher")
 	//}
 
+	err := req.ParseForm()
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing the query:", err.Error())
+		return
+	}
+	opts, err := parseListingOptions(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
+
+	items := a.controller.iterateBytes(req.Context())
+	if opts.sortBy != "" || opts.fields != nil {
+		items, err = a.sortedProjectedBytes(req.Context(), opts)
+		if err != nil {
+			switch err.(type) {
+			case *BadRequestError:
+				ErrorResponse(w, http.StatusBadRequest, err.Error())
+			default:
+				ErrorResponse(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", wot.MediaTypeJSONLD)
 	w.Header().Set("X-Content-Type-Options", "nosniff") // tell clients not to infer content type from partial body
 
-	_, err := fmt.Fprintf(w, "[")
+	_, err = fmt.Fprintf(w, "[")
 	if err != nil {
 		log.Printf("ERROR writing HTTP response: %s", err)
 	}
 
 	first := true
-	for item := range a.controller.iterateBytes(req.Context()) {
+	for item := range items {
 		select {
 		case <-req.Context().Done():
 			log.Println("Cancelled by client.")
@@ -391,6 +828,60 @@ func (a *HTTPAPI) GetAll(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// sortedProjectedBytes returns the serialized TDs in the order and with the fields of the listing options
+// Without sorting, the TDs are streamed from the storage and projected one by one.
+func (a *HTTPAPI) sortedProjectedBytes(ctx context.Context, opts *listingOptions) (<-chan []byte, error) {
+	var sorted []ThingDescription
+	if opts.sortBy != "" {
+		var err error
+		sorted, err = a.controller.listAllSorted(opts.sortBy, opts.desc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bytesCh := make(chan []byte)
+	go func() {
+		defer close(bytesCh)
+
+		send := func(td ThingDescription) bool {
+			b, err := json.Marshal(opts.project(td))
+			if err != nil {
+				log.Printf("Error serializing TD: %s", err)
+				return false
+			}
+			select {
+			case <-ctx.Done():
+				return false
+			case bytesCh <- b:
+				return true
+			}
+		}
+
+		if opts.sortBy != "" {
+			for _, td := range sorted {
+				if !send(td) {
+					return
+				}
+			}
+			return
+		}
+		for b := range a.controller.iterateBytes(ctx) {
+			var td ThingDescription
+			err := json.Unmarshal(b, &td)
+			if err != nil {
+				log.Printf("Error de-serializing TD: %s", err)
+				return
+			}
+			if !send(td) {
+				return
+			}
+		}
+	}()
+
+	return bytesCh, nil
+}
+
 // SearchJSONPath returns the JSONPath query result
 func (a *HTTPAPI) SearchJSONPath(w http.ResponseWriter, req *http.Request) {
 	err := req.ParseForm()
@@ -405,6 +896,11 @@ func (a *HTTPAPI) SearchJSONPath(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	w.Header().Add("X-Request-Query", query)
+	federated, err := a.parseSearchScope(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	b, err := a.controller.filterJSONPathBytes(query)
 	if err != nil {
@@ -417,6 +913,10 @@ func (a *HTTPAPI) SearchJSONPath(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 	}
+	if federated {
+		a.writeFederatedSearch(w, req, searchPathJSONPath, query, b)
+		return
+	}
 
 	w.Header().Set("Content-Type", wot.MediaTypeJSON)
 	w.Header().Set("X-Request-URL", req.RequestURI)
@@ -441,6 +941,11 @@ func (a *HTTPAPI) SearchXPath(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	w.Header().Add("X-Request-Query", query)
+	federated, err := a.parseSearchScope(req)
+	if err != nil {
+		ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	b, err := a.controller.filterXPathBytes(query)
 	if err != nil {
@@ -453,6 +958,10 @@ func (a *HTTPAPI) SearchXPath(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 	}
+	if federated {
+		a.writeFederatedSearch(w, req, searchPathXPath, query, b)
+		return
+	}
 
 	w.Header().Set("Content-Type", wot.MediaTypeJSON)
 	w.Header().Set("X-Request-URL", req.RequestURI)
@@ -463,6 +972,18 @@ func (a *HTTPAPI) SearchXPath(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// parsePreconditions returns the preconditions of a conditional request, or nil if the request is unconditional
+func parsePreconditions(req *http.Request) *preconditions {
+	pre := preconditions{
+		ifMatch:     req.Header.Get(HeaderIfMatch),
+		ifNoneMatch: req.Header.Get(HeaderIfNoneMatch),
+	}
+	if pre.ifMatch == "" && pre.ifNoneMatch == "" {
+		return nil
+	}
+	return &pre
+}
+
 // GetValidation handler gets validation for the request body
 func (a *HTTPAPI) GetValidation(w http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
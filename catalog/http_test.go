@@ -0,0 +1,300 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+func TestListingOptions(t *testing.T) {
+	td := ThingDescription{
+		"id":    "urn:example:test/thing_0",
+		"title": "example thing",
+		"registration": map[string]any{
+			"created": "2020-01-01T00:00:00Z",
+			"ttl":     60.0,
+		},
+		"properties": map[string]any{},
+	}
+
+	t.Run("projection", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/things?fields=id,registration.ttl,description", nil)
+		req.ParseForm()
+		opts, err := parseListingOptions(req)
+		if err != nil {
+			t.Fatal("Error parsing listing options:", err)
+		}
+
+		expected := ThingDescription{
+			"id":           "urn:example:test/thing_0",
+			"registration": map[string]any{"ttl": 60.0},
+		}
+		if projected := opts.project(td); !reflect.DeepEqual(projected, expected) {
+			t.Fatalf("Projected %v instead of %v", projected, expected)
+		}
+	})
+
+	t.Run("invalid order", func(t *testing.T) {
+		for _, query := range []string{"sort=title&order=up", "order=desc"} {
+			req := httptest.NewRequest("GET", "/things?"+query, nil)
+			req.ParseForm()
+			_, err := parseListingOptions(req)
+			if err == nil {
+				t.Fatalf("No error for %s", query)
+			}
+		}
+	})
+}
+
+func TestGetRevision(t *testing.T) {
+	controller := setup(t)
+	td := outboxTestTD("urn:example:revisions")
+	id, err := controller.add(td)
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+	// prune the first revisions from the history
+	for i := 0; i < TestHistorySize+1; i++ {
+		err = controller.update(id, td, nil)
+		if err != nil {
+			t.Fatalf("Error updating TD: %s", err)
+		}
+	}
+	api := NewHTTPAPI(controller, "")
+
+	get := func(id, revision string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/things/"+id+"?revision="+revision, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		res := httptest.NewRecorder()
+		api.Get(res, req)
+		return res
+	}
+
+	t.Run("stored revision", func(t *testing.T) {
+		if res := get(id, "3"); res.Code != http.StatusOK {
+			t.Fatalf("Status %d instead of 200: %s", res.Code, res.Body)
+		}
+	})
+
+	t.Run("unknown id", func(t *testing.T) {
+		if res := get("urn:nope", "5"); res.Code != http.StatusNotFound {
+			t.Fatalf("Status %d instead of 404: %s", res.Code, res.Body)
+		}
+	})
+
+	t.Run("pruned revision", func(t *testing.T) {
+		if res := get(id, "1"); res.Code != http.StatusNotFound {
+			t.Fatalf("Status %d instead of 404: %s", res.Code, res.Body)
+		}
+	})
+}
+
+func TestPutETag(t *testing.T) {
+	controller := setup(t)
+	api := NewHTTPAPI(controller, "")
+	id := "urn:example:put"
+
+	put := func(header, value string) *httptest.ResponseRecorder {
+		body, err := json.Marshal(outboxTestTD(id))
+		if err != nil {
+			t.Fatalf("Error marshalling TD: %s", err)
+		}
+		req := httptest.NewRequest(http.MethodPut, "/things/"+id, bytes.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		res := httptest.NewRecorder()
+		api.Put(res, req)
+		return res
+	}
+	storedETag := func() string {
+		stored, err := controller.get(id)
+		if err != nil {
+			t.Fatalf("Error getting TD: %s", err)
+		}
+		return ThingETag(stored)
+	}
+
+	var etag string
+	t.Run("create", func(t *testing.T) {
+		res := put("If-None-Match", "*")
+		if res.Code != http.StatusCreated {
+			t.Fatalf("Status %d instead of 201: %s", res.Code, res.Body)
+		}
+		etag = res.Header().Get(HeaderETag)
+		if etag != storedETag() {
+			t.Fatalf("ETag %s instead of %s", etag, storedETag())
+		}
+	})
+
+	t.Run("create existing", func(t *testing.T) {
+		if res := put("If-None-Match", "*"); res.Code != http.StatusPreconditionFailed {
+			t.Fatalf("Status %d instead of 412: %s", res.Code, res.Body)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		res := put("If-Match", etag)
+		if res.Code != http.StatusNoContent {
+			t.Fatalf("Status %d instead of 204: %s", res.Code, res.Body)
+		}
+		updated := res.Header().Get(HeaderETag)
+		if updated == etag || updated != storedETag() {
+			t.Fatalf("ETag %s instead of %s", updated, storedETag())
+		}
+	})
+
+	t.Run("update stale", func(t *testing.T) {
+		if res := put("If-Match", etag); res.Code != http.StatusPreconditionFailed {
+			t.Fatalf("Status %d instead of 412: %s", res.Code, res.Body)
+		}
+	})
+}
+
+func TestPutConcurrentCreate(t *testing.T) {
+	controller := setup(t)
+	id := "urn:example:concurrent"
+
+	const writers = 10
+	var (
+		wg      sync.WaitGroup
+		created int32
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := controller.put(id, outboxTestTD(id), &preconditions{ifNoneMatch: "*"})
+			if err != nil {
+				if _, failed := err.(*PreconditionFailedError); !failed {
+					t.Errorf("Unexpected error: %s", err)
+				}
+				return
+			}
+			if ok {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if created != 1 {
+		t.Fatalf("Created %d times instead of once", created)
+	}
+}
+
+func TestOriginNotWritable(t *testing.T) {
+	controller := setup(t)
+	api := NewHTTPAPI(controller, "")
+
+	claiming := func(id, origin string) []byte {
+		td := outboxTestTD(id)
+		if id == "" {
+			delete(td, wot.KeyThingID)
+		}
+		td[wot.KeyThingRegistration] = map[string]any{wot.KeyThingRegistrationOrigin: origin}
+		body, err := json.Marshal(td)
+		if err != nil {
+			t.Fatalf("Error marshalling TD: %s", err)
+		}
+		return body
+	}
+	put := func(id, origin string) {
+		req := httptest.NewRequest(http.MethodPut, "/things/"+id, bytes.NewReader(claiming(id, origin)))
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		res := httptest.NewRecorder()
+		api.Put(res, req)
+		if res.Code != http.StatusCreated && res.Code != http.StatusNoContent {
+			t.Fatalf("Status %d: %s", res.Code, res.Body)
+		}
+	}
+	storedOrigin := func(id string) string {
+		td, err := controller.get(id)
+		if err != nil {
+			t.Fatalf("Error getting TD: %s", err)
+		}
+		return ThingOrigin(ThingRegistration(td))
+	}
+
+	t.Run("post", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/things/", bytes.NewReader(claiming("", OriginDNSSD)))
+		res := httptest.NewRecorder()
+		api.Post(res, req)
+		if res.Code != http.StatusCreated {
+			t.Fatalf("Status %d instead of 201: %s", res.Code, res.Body)
+		}
+		if origin := storedOrigin(res.Header().Get("Location")); origin != "" {
+			t.Fatalf("Origin %q set by the client", origin)
+		}
+	})
+
+	t.Run("put create", func(t *testing.T) {
+		put("urn:example:claimed", OriginDNSSD)
+		if origin := storedOrigin("urn:example:claimed"); origin != "" {
+			t.Fatalf("Origin %q set by the client", origin)
+		}
+	})
+
+	t.Run("put update", func(t *testing.T) {
+		if _, err := controller.register(outboxTestTD("urn:example:owned"), OriginDNSSD); err != nil {
+			t.Fatalf("Error registering TD: %s", err)
+		}
+		put("urn:example:owned", "")
+		if origin := storedOrigin("urn:example:owned"); origin != OriginDNSSD {
+			t.Fatalf("Origin %q instead of %q after an update by the client", origin, OriginDNSSD)
+		}
+	})
+}
+
+func TestHistoryPath(t *testing.T) {
+	controller := setup(t)
+	api := NewHTTPAPI(controller, "")
+	for _, id := range []string{"urn:example:log", "urn:example:log/history"} {
+		if _, err := controller.add(outboxTestTD(id)); err != nil {
+			t.Fatalf("Error adding a TD: %s", err)
+		}
+	}
+
+	// requests /things/{id}/history
+	history := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/things/"+id+"/history", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		res := httptest.NewRecorder()
+		api.History(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("Status %d instead of 200: %s", res.Code, res.Body)
+		}
+		return res
+	}
+
+	t.Run("TD with the path of a history", func(t *testing.T) {
+		var td ThingDescription
+		if err := json.Unmarshal(history("urn:example:log").Body.Bytes(), &td); err != nil {
+			t.Fatalf("Error decoding the TD: %s", err)
+		}
+		if td[wot.KeyThingID] != "urn:example:log/history" {
+			t.Fatalf("Retrieved %v instead of the TD urn:example:log/history", td)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		var tds []ThingDescription
+		if err := json.Unmarshal(history("urn:example:log/history").Body.Bytes(), &tds); err != nil {
+			t.Fatalf("Error decoding the history: %s", err)
+		}
+		if len(tds) != 0 {
+			t.Fatalf("History of %d revisions instead of none", len(tds))
+		}
+	})
+}
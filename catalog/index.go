@@ -0,0 +1,188 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	IndexPointerType     = "/@type"
+	IndexPointerTitle    = "/title"
+	IndexPointerCreated  = "/registration/created"
+	IndexPointerModified = "/registration/modified"
+	IndexPointerExpires  = "/registration/expires"
+)
+
+// DefaultIndexes are the JSON Pointers indexed by the storages that support secondary indexes
+var DefaultIndexes = []string{
+	IndexPointerType,
+	IndexPointerTitle,
+	IndexPointerCreated,
+	IndexPointerModified,
+	IndexPointerExpires,
+}
+
+// indexTimeLayout is a fixed-width layout for indexed timestamps so that their lexicographic order is chronological
+const indexTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// indexedStorage is implemented by storages that maintain secondary indexes
+type indexedStorage interface {
+	// lookupBytes returns the serialized TDs that may have the given value at the JSON Pointer, in storage order.
+	// The result is a superset of the matching TDs and must be filtered further.
+	// ok is false if the pointer is not indexed.
+	lookupBytes(pointer, value string) (b []byte, ok bool, err error)
+	// expiredBefore returns the IDs of TDs with expiry time before t
+	expiredBefore(t time.Time) ([]string, error)
+}
+
+// indexEntries returns the index entries of the value at the JSON Pointer in the given document.
+// Scalars are prefixed with "=", arrays of scalars result in one entry per item and one for their concatenation.
+// Any other non-scalar results in the wildcard entry "*", which has to be considered for all lookups.
+func indexEntries(doc interface{}, pointer string) []string {
+	v, found := valueAtPointer(doc, pointer)
+	if !found {
+		return nil
+	}
+	if v == nil {
+		// null has an empty string value in xpath
+		return []string{"="}
+	}
+	if s, ok := indexScalar(v, pointer); ok {
+		return []string{"=" + s}
+	}
+	if arr, ok := v.([]interface{}); ok {
+		var entries []string
+		var concat strings.Builder
+		for _, item := range arr {
+			s, ok := indexScalar(item, pointer)
+			if !ok {
+				return []string{"*"}
+			}
+			entries = append(entries, "="+s)
+			concat.WriteString(s)
+		}
+		if len(arr) != 1 {
+			// xpath compares the string value of an array element, which is the concatenation of its items
+			entries = append(entries, "="+concat.String())
+		}
+		return entries
+	}
+	return []string{"*"}
+}
+
+// indexScalar encodes a scalar JSON value as an index value
+func indexScalar(v interface{}, pointer string) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		if isTimeIndex(pointer) {
+			return indexTime(v), true
+		}
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+func isTimeIndex(pointer string) bool {
+	return pointer == IndexPointerCreated || pointer == IndexPointerModified || pointer == IndexPointerExpires
+}
+
+// indexTime normalizes an RFC3339 timestamp, leaving other strings as they are
+func indexTime(s string) string {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return s
+	}
+	return t.UTC().Format(indexTimeLayout)
+}
+
+// valueAtPointer returns the value referenced by the JSON Pointer (RFC6901)
+func valueAtPointer(doc interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" {
+		return doc, true
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, false
+	}
+	v := doc
+	for _, token := range strings.Split(pointer[1:], "/") {
+		token = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+		switch node := v.(type) {
+		case map[string]interface{}:
+			var found bool
+			if v, found = node[token]; !found {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+var (
+	// e.g. $[?(@.title=='x')], $[?(@['@type']=="x")], $[?(@.registration.ttl==60)]
+	jsonPathEqualityRegexp = regexp.MustCompile(`^\$\[\?\(@((?:\.[A-Za-z_][A-Za-z0-9_]*|\['[^'\\]+'\])+)\s*==\s*('[^'\\]*'|"[^"\\]*"|-?[0-9.eE+-]+|true|false)\s*\)\]$`)
+	jsonPathSegmentRegexp  = regexp.MustCompile(`\.([A-Za-z_][A-Za-z0-9_]*)|\['([^'\\]+)'\]`)
+	// e.g. *[title='x']
+	xPathEqualityRegexp = regexp.MustCompile(`^\*\[([A-Za-z_][A-Za-z0-9_]*)\s*=\s*('[^']*'|"[^"]*")\]$`)
+)
+
+// parseJSONPathEquality returns the JSON Pointer and index value of a jsonpath query
+// that only filters the top-level items by equality of one attribute
+func parseJSONPathEquality(query string) (pointer, value string, ok bool) {
+	m := jsonPathEqualityRegexp.FindStringSubmatch(strings.TrimSpace(query))
+	if m == nil {
+		return "", "", false
+	}
+	for _, s := range jsonPathSegmentRegexp.FindAllStringSubmatch(m[1], -1) {
+		key := s[1] + s[2]
+		pointer += "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+	}
+
+	switch literal := m[2]; {
+	case strings.HasPrefix(literal, "'") || strings.HasPrefix(literal, `"`):
+		value = literal[1 : len(literal)-1]
+		if isTimeIndex(pointer) {
+			value = indexTime(value)
+		}
+	case literal == "true" || literal == "false":
+		value = literal
+	default:
+		f, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return "", "", false
+		}
+		value = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return pointer, value, true
+}
+
+// parseXPathEquality returns the JSON Pointer and index value of an xpath query
+// that only filters the top-level items by equality of one attribute
+func parseXPathEquality(query string) (pointer, value string, ok bool) {
+	m := xPathEqualityRegexp.FindStringSubmatch(strings.TrimSpace(query))
+	if m == nil {
+		return "", "", false
+	}
+	pointer = "/" + m[1]
+	value = m[2][1 : len(m[2])-1]
+	// xpath compares string values; numbers and booleans may have other textual representations
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return "", "", false
+	}
+	return pointer, value, true
+}
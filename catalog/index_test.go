@@ -0,0 +1,75 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPathEquality(t *testing.T) {
+	tests := []struct {
+		query, pointer, value string
+		ok                    bool
+	}{
+		{`$[?(@.title=='example')]`, "/title", "example", true},
+		{`$[?(@['@type'] == "Sensor")]`, "/@type", "Sensor", true},
+		{`$[?(@.registration.ttl==60.0)]`, "/registration/ttl", "60", true},
+		{`$[?(@.registration.expires=='2020-01-01T01:00:00+01:00')]`, "/registration/expires", "2020-01-01T00:00:00.000000000Z", true},
+		{`$[?(@.title=='a' && @.id=='b')]`, "", "", false},
+		{`$..title`, "", "", false},
+	}
+	for _, test := range tests {
+		pointer, value, ok := parseJSONPathEquality(test.query)
+		if pointer != test.pointer || value != test.value || ok != test.ok {
+			t.Errorf("%s: got (%s, %s, %t), expected (%s, %s, %t)", test.query, pointer, value, ok, test.pointer, test.value, test.ok)
+		}
+	}
+}
+
+func TestParseXPathEquality(t *testing.T) {
+	tests := []struct {
+		query, pointer, value string
+		ok                    bool
+	}{
+		{`*[title='example']`, "/title", "example", true},
+		{`*[title="example"]`, "/title", "example", true},
+		{`*[version='1.0']`, "", "", false},
+		{`//*[title='example']`, "", "", false},
+	}
+	for _, test := range tests {
+		pointer, value, ok := parseXPathEquality(test.query)
+		if pointer != test.pointer || value != test.value || ok != test.ok {
+			t.Errorf("%s: got (%s, %s, %t), expected (%s, %s, %t)", test.query, pointer, value, ok, test.pointer, test.value, test.ok)
+		}
+	}
+}
+
+func TestIndexEntries(t *testing.T) {
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{"title":"example","@type":["a","b"],"version":{"instance":"1.0"},"n":1.5,"x/y":true,"z":null}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pointer string
+		entries []string
+	}{
+		{"/title", []string{"=example"}},
+		{"/@type", []string{"=a", "=b", "=ab"}},
+		{"/version", []string{"*"}},
+		{"/version/instance", []string{"=1.0"}},
+		{"/n", []string{"=1.5"}},
+		{"/x~1y", []string{"=true"}},
+		{"/z", []string{"="}},
+		{"/missing", nil},
+	}
+	for _, test := range tests {
+		entries := indexEntries(doc, test.pointer)
+		if !reflect.DeepEqual(entries, test.entries) {
+			t.Errorf("%s: got %v, expected %v", test.pointer, entries, test.entries)
+		}
+	}
+}
@@ -10,20 +10,51 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/linksmart/service-catalog/v3/utils"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // LevelDB storage
+// TDs are stored with their IDs as keys. Keys of internal keyspaces such as the indexes start with 0x00.
 type LevelDBStorage struct {
-	db *leveldb.DB
-	wg sync.WaitGroup
+	db          *leveldb.DB
+	wg          sync.WaitGroup
+	indexes     []string
+	historySize int
+	// serializes the writes to keep the indexes consistent with the TDs
+	writeLock sync.Mutex
+	// the sequence number of the last event added to the outbox
+	eventSeq uint64
 }
 
-func NewLevelDBStorage(dsn string, opts *opt.Options) (Storage, error) {
+var (
+	// the range of TD keys
+	tdRange = &util.Range{Start: []byte{0x01}}
+	// index keys: 0x00 i <pointer> 0x00 <entry> 0x00 <id>
+	indexKeyPrefix = []byte("\x00i")
+	// the list of indexed pointers, used to detect configuration changes
+	metaIndexesKey = []byte("\x00m\x00indexes")
+	// the number of stored TDs
+	metaCountKey = []byte("\x00m\x00count")
+	// history keys: 0x00 h <id> 0x00 <zero-padded revision>
+	historyKeyPrefix = []byte("\x00h")
+	// deletion keys of the TDs kept in history: 0x00 d <id>, with the time of the deletion
+	deletedKeyPrefix = []byte("\x00d")
+	// outbox keys: 0x00 o <zero-padded sequence number>
+	outboxKeyPrefix = []byte("\x00o")
+)
+
+// NewLevelDBStorage opens the storage at the given DSN
+// The TDs are indexed by DefaultIndexes and the given additional JSON Pointers.
+// Up to historySize previous revisions of each TD are kept.
+func NewLevelDBStorage(dsn string, opts *opt.Options, indexes []string, historySize int) (Storage, error) {
 	url, err := url.Parse(dsn)
 	if err != nil {
 		return nil, err
@@ -35,20 +66,51 @@ func NewLevelDBStorage(dsn string, opts *opt.Options) (Storage, error) {
 		return nil, err
 	}
 
-	return &LevelDBStorage{db: db}, nil
+	s := &LevelDBStorage{db: db, indexes: append([]string{}, DefaultIndexes...), historySize: historySize}
+	for _, pointer := range indexes {
+		if !s.isIndexed(pointer) {
+			s.indexes = append(s.indexes, pointer)
+		}
+	}
+
+	err = s.buildIndexes()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error building indexes: %s", err)
+	}
+
+	err = s.initCount()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error counting entries: %s", err)
+	}
+
+	err = s.initOutbox()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error reading the event outbox: %s", err)
+	}
+
+	return s, nil
 }
 
 // CRUD
-func (s *LevelDBStorage) add(id string, td ThingDescription) error {
+func (s *LevelDBStorage) add(id string, td ThingDescription, event *outboxEvent) error {
 	if id == "" {
 		return fmt.Errorf("ID is not set")
 	}
+	if id[0] == 0x00 {
+		return &BadRequestError{"ID must not start with a null character"}
+	}
 
 	bytes, err := json.Marshal(td)
 	if err != nil {
 		return err
 	}
 
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
 	found, err := s.db.Has([]byte(id), nil)
 	if err != nil {
 		return err
@@ -57,12 +119,23 @@ func (s *LevelDBStorage) add(id string, td ThingDescription) error {
 		return &ConflictError{id + " is not unique"}
 	}
 
-	err = s.db.Put([]byte(id), bytes, nil)
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(id), bytes)
+	batch.Delete(deletedKey(id))
+	err = s.indexBatch(batch, id, nil, bytes)
+	if err != nil {
+		return err
+	}
+	err = s.countBatch(batch, 1)
+	if err != nil {
+		return err
+	}
+	err = s.outboxBatch(batch, event)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return s.db.Write(batch, nil)
 }
 
 func (s *LevelDBStorage) get(id string) (ThingDescription, error) {
@@ -83,44 +156,141 @@ func (s *LevelDBStorage) get(id string) (ThingDescription, error) {
 	return td, nil
 }
 
-func (s *LevelDBStorage) update(id string, td ThingDescription) error {
+func (s *LevelDBStorage) update(id string, td ThingDescription, event *outboxEvent) error {
 
 	bytes, err := json.Marshal(td)
 	if err != nil {
 		return err
 	}
 
-	found, err := s.db.Has([]byte(id), nil)
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	oldBytes, err := s.db.Get([]byte(id), nil)
+	if err == leveldb.ErrNotFound {
+		return &NotFoundError{id + " is not found"}
+	} else if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(id), bytes)
+	err = s.indexBatch(batch, id, oldBytes, bytes)
 	if err != nil {
 		return err
 	}
-	if !found {
-		return &NotFoundError{id + " is not found"}
+	err = s.historyBatch(batch, id, oldBytes, bytes, nil)
+	if err != nil {
+		return err
 	}
-
-	err = s.db.Put([]byte(id), bytes, nil)
+	err = s.outboxBatch(batch, event)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return s.db.Write(batch, nil)
 }
 
-func (s *LevelDBStorage) delete(id string) error {
-	found, err := s.db.Has([]byte(id), nil)
+func (s *LevelDBStorage) delete(id string, event *outboxEvent) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	oldBytes, err := s.db.Get([]byte(id), nil)
+	if err == leveldb.ErrNotFound {
+		return &NotFoundError{id + " is not found"}
+	} else if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(id))
+	err = s.indexBatch(batch, id, oldBytes, nil)
 	if err != nil {
 		return err
 	}
-	if !found {
-		return &NotFoundError{id + " is not found"}
+	err = s.historyBatch(batch, id, oldBytes, nil, nil)
+	if err != nil {
+		return err
+	}
+	err = s.countBatch(batch, -1)
+	if err != nil {
+		return err
+	}
+	err = s.outboxBatch(batch, event)
+	if err != nil {
+		return err
 	}
 
-	err = s.db.Delete([]byte(id), nil)
+	return s.db.Write(batch, nil)
+}
+
+func (s *LevelDBStorage) writeBatch(writes []storageWrite) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	// serialized TDs written earlier in this batch; nil for deleted ones
+	pending := make(map[string][]byte)
+
+	// history keys added earlier in this batch
+	archived := make(map[string][][]byte)
+
+	batch := new(leveldb.Batch)
+	delta := 0
+	for _, w := range writes {
+		if w.id == "" || w.id[0] == 0x00 {
+			return &BadRequestError{fmt.Sprintf("invalid ID: %q", w.id)}
+		}
+		oldBytes, found := pending[w.id]
+		if !found {
+			var err error
+			oldBytes, err = s.db.Get([]byte(w.id), nil)
+			if err != nil && err != leveldb.ErrNotFound {
+				return err
+			}
+		}
+
+		var bytes []byte
+		if w.td == nil {
+			batch.Delete([]byte(w.id))
+		} else {
+			var err error
+			bytes, err = json.Marshal(w.td)
+			if err != nil {
+				return err
+			}
+			batch.Put([]byte(w.id), bytes)
+			if oldBytes == nil {
+				batch.Delete(deletedKey(w.id))
+			}
+		}
+
+		err := s.indexBatch(batch, w.id, oldBytes, bytes)
+		if err != nil {
+			return err
+		}
+		err = s.historyBatch(batch, w.id, oldBytes, bytes, archived)
+		if err != nil {
+			return err
+		}
+		err = s.outboxBatch(batch, w.event)
+		if err != nil {
+			return err
+		}
+		switch {
+		case oldBytes == nil && bytes != nil:
+			delta++
+		case oldBytes != nil && bytes == nil:
+			delta--
+		}
+		pending[w.id] = bytes
+	}
+
+	err := s.countBatch(batch, delta)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return s.db.Write(batch, nil)
 }
 
 func (s *LevelDBStorage) list(page int, perPage int) ([]ThingDescription, int, error) {
@@ -134,28 +304,24 @@ func (s *LevelDBStorage) list(page int, perPage int) ([]ThingDescription, int, e
 		return nil, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
 	}
 
-	// TODO: is there a better way to do this?
-	// github.com/syndtr/goleveldb/leveldb/iterator
-	devices := make([]ThingDescription, limit)
 	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
-	i := 0
-	for iter.Next() {
+	defer s.wg.Done()
+	iter := s.db.NewIterator(tdRange, nil)
+	defer iter.Release()
+
+	// skip the entries before offset without de-serializing them
+	devices := make([]ThingDescription, 0, limit)
+	for i := 0; len(devices) < limit && iter.Next(); i++ {
+		if i < offset {
+			continue
+		}
 		var td ThingDescription
 		err = json.Unmarshal(iter.Value(), &td)
 		if err != nil {
 			return nil, 0, err
 		}
-
-		if i >= offset && i < offset+limit {
-			devices[i-offset] = td
-		} else if i >= offset+limit {
-			break
-		}
-		i++
+		devices = append(devices, td)
 	}
-	iter.Release()
-	s.wg.Done()
 	err = iter.Error()
 	if err != nil {
 		return nil, 0, err
@@ -164,10 +330,42 @@ func (s *LevelDBStorage) list(page int, perPage int) ([]ThingDescription, int, e
 	return devices, total, nil
 }
 
+func (s *LevelDBStorage) listAfter(after string, limit int) ([]ThingDescription, bool, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	iter := s.db.NewIterator(tdRange, nil)
+	defer iter.Release()
+
+	var ok bool
+	if after == "" {
+		ok = iter.First()
+	} else {
+		ok = iter.Seek([]byte(after))
+		if ok && string(iter.Key()) == after {
+			ok = iter.Next()
+		}
+	}
+
+	var devices []ThingDescription
+	for ; ok; ok = iter.Next() {
+		if len(devices) == limit {
+			return devices, true, nil
+		}
+		var td ThingDescription
+		err := json.Unmarshal(iter.Value(), &td)
+		if err != nil {
+			return nil, false, err
+		}
+		devices = append(devices, td)
+	}
+
+	return devices, false, iter.Error()
+}
+
 func (s *LevelDBStorage) listAllBytes() ([]byte, error) {
 
 	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(tdRange, nil)
 
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
@@ -194,19 +392,44 @@ func (s *LevelDBStorage) listAllBytes() ([]byte, error) {
 }
 
 func (s *LevelDBStorage) total() (int, error) {
+	b, err := s.db.Get(metaCountKey, nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
+
+// countBatch adds the updated number of TDs to the batch
+func (s *LevelDBStorage) countBatch(batch *leveldb.Batch, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	c, err := s.total()
+	if err != nil {
+		return err
+	}
+	batch.Put(metaCountKey, []byte(strconv.Itoa(c+delta)))
+	return nil
+}
+
+// initCount counts the TDs if the storage has no counter yet
+func (s *LevelDBStorage) initCount() error {
+	found, err := s.db.Has(metaCountKey, nil)
+	if err != nil || found {
+		return err
+	}
+
 	c := 0
-	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(tdRange, nil)
 	for iter.Next() {
 		c++
 	}
 	iter.Release()
-	s.wg.Done()
-	err := iter.Error()
+	err = iter.Error()
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return c, nil
+	return s.db.Put(metaCountKey, []byte(strconv.Itoa(c)), nil)
 }
 
 func (s *LevelDBStorage) iterator() <-chan ThingDescription {
@@ -217,7 +440,7 @@ func (s *LevelDBStorage) iterator() <-chan ThingDescription {
 
 		s.wg.Add(1)
 		defer s.wg.Done()
-		iter := s.db.NewIterator(nil, nil)
+		iter := s.db.NewIterator(tdRange, nil)
 		defer iter.Release()
 
 		for iter.Next() {
@@ -247,7 +470,7 @@ func (s *LevelDBStorage) iterateBytes(ctx context.Context) <-chan []byte {
 
 		s.wg.Add(1)
 		defer s.wg.Done()
-		iter := s.db.NewIterator(nil, nil)
+		iter := s.db.NewIterator(tdRange, nil)
 		defer iter.Release()
 
 	Loop:
@@ -272,6 +495,360 @@ func (s *LevelDBStorage) iterateBytes(ctx context.Context) <-chan []byte {
 	return bytesCh
 }
 
+// INDEXES
+
+func (s *LevelDBStorage) isIndexed(pointer string) bool {
+	for _, p := range s.indexes {
+		if p == pointer {
+			return true
+		}
+	}
+	return false
+}
+
+func indexKey(pointer, entry, id string) []byte {
+	return []byte(string(indexKeyPrefix) + pointer + "\x00" + entry + "\x00" + id)
+}
+
+// indexKeys returns the index keys of a serialized TD
+func (s *LevelDBStorage) indexKeys(id string, b []byte) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	if b == nil {
+		return keys, nil
+	}
+	var doc interface{}
+	err := json.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, pointer := range s.indexes {
+		for _, entry := range indexEntries(doc, pointer) {
+			keys[string(indexKey(pointer, entry, id))] = true
+		}
+	}
+	return keys, nil
+}
+
+// indexBatch adds the index changes of replacing oldBytes with newBytes to the batch
+// A nil oldBytes is an addition, a nil newBytes a deletion.
+func (s *LevelDBStorage) indexBatch(batch *leveldb.Batch, id string, oldBytes, newBytes []byte) error {
+	oldKeys, err := s.indexKeys(id, oldBytes)
+	if err != nil {
+		return err
+	}
+	newKeys, err := s.indexKeys(id, newBytes)
+	if err != nil {
+		return err
+	}
+	for k := range oldKeys {
+		if !newKeys[k] {
+			batch.Delete([]byte(k))
+		}
+	}
+	for k := range newKeys {
+		if !oldKeys[k] {
+			batch.Put([]byte(k), nil)
+		}
+	}
+	return nil
+}
+
+// buildIndexes rebuilds the indexes if the indexed pointers have changed since the last start
+func (s *LevelDBStorage) buildIndexes() error {
+	indexes, err := json.Marshal(s.indexes)
+	if err != nil {
+		return err
+	}
+	stored, err := s.db.Get(metaIndexesKey, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	if bytes.Equal(stored, indexes) {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	iter := s.db.NewIterator(util.BytesPrefix(indexKeyPrefix), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	iter = s.db.NewIterator(tdRange, nil)
+	for iter.Next() {
+		err = s.indexBatch(batch, string(iter.Key()), nil, iter.Value())
+		if err != nil {
+			iter.Release()
+			return err
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	batch.Put(metaIndexesKey, indexes)
+	if flag.Lookup("test.v") == nil {
+		log.Printf("Indexing %d keys for %v", batch.Len(), s.indexes)
+	}
+	return s.db.Write(batch, nil)
+}
+
+func (s *LevelDBStorage) lookupBytes(pointer, value string) ([]byte, bool, error) {
+	if !s.isIndexed(pointer) {
+		return nil, false, nil
+	}
+
+	s.wg.Add(1)
+	defer s.wg.Done()
+	snapshot, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, false, err
+	}
+	defer snapshot.Release()
+
+	// non-scalar values are indexed with the wildcard entry and may match any value
+	var ids []string
+	for _, entry := range []string{"=" + value, "*"} {
+		prefix := indexKey(pointer, entry, "")
+		iter := snapshot.NewIterator(util.BytesPrefix(prefix), nil)
+		for iter.Next() {
+			ids = append(ids, string(iter.Key()[len(prefix):]))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, false, err
+		}
+	}
+	sort.Strings(ids)
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, id := range ids {
+		if i > 0 && ids[i-1] == id {
+			continue
+		}
+		b, err := snapshot.Get([]byte(id), nil)
+		if err != nil {
+			return nil, false, err
+		}
+		if buffer.Len() > 1 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(b)
+	}
+	buffer.WriteString("]")
+
+	return buffer.Bytes(), true, nil
+}
+
+func (s *LevelDBStorage) expiredBefore(t time.Time) ([]string, error) {
+	prefix := []byte(string(indexKeyPrefix) + IndexPointerExpires + "\x00=")
+	limit := append(append([]byte{}, prefix...), t.UTC().Format(indexTimeLayout)...)
+
+	s.wg.Add(1)
+	defer s.wg.Done()
+	iter := s.db.NewIterator(&util.Range{Start: prefix, Limit: limit}, nil)
+	defer iter.Release()
+
+	var ids []string
+	for iter.Next() {
+		// <expires> 0x00 <id>
+		entry := iter.Key()[len(prefix):]
+		if i := bytes.IndexByte(entry, 0x00); i != -1 {
+			ids = append(ids, string(entry[i+1:]))
+		}
+	}
+	return ids, iter.Error()
+}
+
+// HISTORY
+
+func historyPrefix(id string) []byte {
+	return []byte(string(historyKeyPrefix) + id + "\x00")
+}
+
+func historyKey(id string, revision uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", historyPrefix(id), revision))
+}
+
+// historyBatch adds the archival of the replaced TD to the batch, if its revision is replaced or deleted
+// Revisions exceeding the history size are removed. archived holds the history keys added earlier in the same batch.
+func (s *LevelDBStorage) historyBatch(batch *leveldb.Batch, id string, oldBytes, newBytes []byte, archived map[string][][]byte) error {
+	if s.historySize <= 0 || oldBytes == nil {
+		return nil
+	}
+	archive, revision := archiveRevision(oldBytes, newBytes)
+	if !archive {
+		return nil
+	}
+
+	key := historyKey(id, revision)
+	batch.Put(key, oldBytes)
+	if newBytes == nil {
+		batch.Put(deletedKey(id), []byte(time.Now().UTC().Format(time.RFC3339Nano)))
+	}
+
+	// the stored, earlier archived, and new keys in ascending order of revisions
+	var keys [][]byte
+	iter := s.db.NewIterator(util.BytesPrefix(historyPrefix(id)), nil)
+	for iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if archived != nil {
+		keys = append(keys, archived[id]...)
+		archived[id] = append(archived[id], key)
+	}
+	keys = append(keys, key)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	unique := keys[:0]
+	for i := range keys {
+		if i == 0 || !bytes.Equal(keys[i], keys[i-1]) {
+			unique = append(unique, keys[i])
+		}
+	}
+	for len(unique) > s.historySize {
+		batch.Delete(unique[0])
+		unique = unique[1:]
+	}
+	return nil
+}
+
+func (s *LevelDBStorage) history(id string) ([]ThingDescription, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	iter := s.db.NewIterator(util.BytesPrefix(historyPrefix(id)), nil)
+	defer iter.Release()
+
+	var tds []ThingDescription
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		var td ThingDescription
+		err := json.Unmarshal(iter.Value(), &td)
+		if err != nil {
+			return nil, err
+		}
+		tds = append(tds, td)
+	}
+	return tds, iter.Error()
+}
+
+func deletedKey(id string) []byte {
+	return []byte(string(deletedKeyPrefix) + id)
+}
+
+func (s *LevelDBStorage) pruneHistory(deletedBefore time.Time) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	batch := new(leveldb.Batch)
+	iter := s.db.NewIterator(util.BytesPrefix(deletedKeyPrefix), nil)
+	for iter.Next() {
+		deleted, err := time.Parse(time.RFC3339Nano, string(iter.Value()))
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		if !deleted.Before(deletedBefore) {
+			continue
+		}
+		id := string(iter.Key()[len(deletedKeyPrefix):])
+		history := s.db.NewIterator(util.BytesPrefix(historyPrefix(id)), nil)
+		for history.Next() {
+			batch.Delete(append([]byte{}, history.Key()...))
+		}
+		history.Release()
+		if err := history.Error(); err != nil {
+			iter.Release()
+			return err
+		}
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return s.db.Write(batch, nil)
+}
+
+// OUTBOX
+
+func outboxKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", outboxKeyPrefix, seq))
+}
+
+// initOutbox continues the sequence of the events left in the outbox
+func (s *LevelDBStorage) initOutbox() error {
+	iter := s.db.NewIterator(util.BytesPrefix(outboxKeyPrefix), nil)
+	defer iter.Release()
+	if iter.Last() {
+		seq, err := strconv.ParseUint(string(iter.Key()[len(outboxKeyPrefix):]), 10, 64)
+		if err != nil {
+			return err
+		}
+		s.eventSeq = seq
+	}
+	return iter.Error()
+}
+
+// outboxBatch adds the event to the batch, if any
+// The caller must hold the write lock. Sequence numbers of failed writes are skipped.
+func (s *LevelDBStorage) outboxBatch(batch *leveldb.Batch, event *outboxEvent) error {
+	b, err := marshalOutboxEvent(event)
+	if err != nil || b == nil {
+		return err
+	}
+	s.eventSeq++
+	batch.Put(outboxKey(s.eventSeq), b)
+	return nil
+}
+
+func (s *LevelDBStorage) outbox(after uint64, limit int) ([]outboxEvent, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	iter := s.db.NewIterator(&util.Range{Start: outboxKey(after + 1), Limit: util.BytesPrefix(outboxKeyPrefix).Limit}, nil)
+	defer iter.Release()
+
+	var events []outboxEvent
+	for len(events) < limit && iter.Next() {
+		seq, err := strconv.ParseUint(string(iter.Key()[len(outboxKeyPrefix):]), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		e, err := unmarshalOutboxEvent(seq, iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, iter.Error()
+}
+
+func (s *LevelDBStorage) removeFromOutbox(until uint64) error {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	iter := s.db.NewIterator(&util.Range{Start: outboxKeyPrefix, Limit: outboxKey(until + 1)}, nil)
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return s.db.Write(batch, nil)
+}
+
 func (s *LevelDBStorage) Close() {
 	s.wg.Wait()
 	err := s.db.Close()
@@ -20,10 +20,11 @@ type any = interface{}
 
 var (
 	TestSupportedBackends = map[string]bool{
-		BackendMemory:  false,
+		BackendMemory:  true,
 		BackendLevelDB: true,
 	}
 	TestStorageType string
+	TestHistorySize = 3
 )
 
 func loadSchema() error {
@@ -0,0 +1,415 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/linksmart/service-catalog/v3/utils"
+)
+
+// In-memory storage
+// TDs are kept serialized and listed in lexicographic order of their IDs, similar to LevelDB
+type MemoryStorage struct {
+	sync.RWMutex
+	data map[string][]byte
+	keys []string // sorted
+	// previous revisions of each TD, in ascending order
+	revisions   map[string][][]byte
+	historySize int
+	// deletion time of the TDs kept in history
+	deleted map[string]time.Time
+	// serialized events, in the order of the writes
+	events   []memoryOutboxEntry
+	eventSeq uint64
+}
+
+type memoryOutboxEntry struct {
+	seq   uint64
+	event []byte
+}
+
+// NewMemoryStorage creates an in-memory storage that keeps up to historySize previous revisions of each TD
+func NewMemoryStorage(historySize int) Storage {
+	return &MemoryStorage{
+		data:        make(map[string][]byte),
+		revisions:   make(map[string][][]byte),
+		historySize: historySize,
+		deleted:     make(map[string]time.Time),
+	}
+}
+
+// CRUD
+func (s *MemoryStorage) add(id string, td ThingDescription, event *outboxEvent) error {
+	if id == "" {
+		return fmt.Errorf("ID is not set")
+	}
+
+	bytes, err := json.Marshal(td)
+	if err != nil {
+		return err
+	}
+	eventBytes, err := marshalOutboxEvent(event)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, found := s.data[id]; found {
+		return &ConflictError{id + " is not unique"}
+	}
+
+	s.data[id] = bytes
+	delete(s.deleted, id)
+	i := sort.SearchStrings(s.keys, id)
+	s.keys = append(s.keys, "")
+	copy(s.keys[i+1:], s.keys[i:])
+	s.keys[i] = id
+	s.addEvent(eventBytes)
+
+	return nil
+}
+
+func (s *MemoryStorage) get(id string) (ThingDescription, error) {
+	s.RLock()
+	bytes, found := s.data[id]
+	s.RUnlock()
+	if !found {
+		return nil, &NotFoundError{id + " is not found"}
+	}
+
+	var td ThingDescription
+	err := json.Unmarshal(bytes, &td)
+	if err != nil {
+		return nil, err
+	}
+
+	return td, nil
+}
+
+func (s *MemoryStorage) update(id string, td ThingDescription, event *outboxEvent) error {
+
+	bytes, err := json.Marshal(td)
+	if err != nil {
+		return err
+	}
+	eventBytes, err := marshalOutboxEvent(event)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	oldBytes, found := s.data[id]
+	if !found {
+		return &NotFoundError{id + " is not found"}
+	}
+
+	s.archive(id, oldBytes, bytes)
+	s.data[id] = bytes
+	s.addEvent(eventBytes)
+
+	return nil
+}
+
+func (s *MemoryStorage) delete(id string, event *outboxEvent) error {
+	eventBytes, err := marshalOutboxEvent(event)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	oldBytes, found := s.data[id]
+	if !found {
+		return &NotFoundError{id + " is not found"}
+	}
+
+	s.archive(id, oldBytes, nil)
+	delete(s.data, id)
+	i := sort.SearchStrings(s.keys, id)
+	s.keys = append(s.keys[:i], s.keys[i+1:]...)
+	s.addEvent(eventBytes)
+
+	return nil
+}
+
+func (s *MemoryStorage) writeBatch(writes []storageWrite) error {
+	serialized := make([][]byte, len(writes))
+	events := make([][]byte, len(writes))
+	for i := range writes {
+		var err error
+		events[i], err = marshalOutboxEvent(writes[i].event)
+		if err != nil {
+			return err
+		}
+		if writes[i].td == nil {
+			continue
+		}
+		serialized[i], err = json.Marshal(writes[i].td)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for i, w := range writes {
+		oldBytes, found := s.data[w.id]
+		if found {
+			s.archive(w.id, oldBytes, serialized[i])
+		}
+		j := sort.SearchStrings(s.keys, w.id)
+		switch {
+		case serialized[i] == nil && found:
+			delete(s.data, w.id)
+			s.keys = append(s.keys[:j], s.keys[j+1:]...)
+		case serialized[i] != nil && !found:
+			s.keys = append(s.keys, "")
+			copy(s.keys[j+1:], s.keys[j:])
+			s.keys[j] = w.id
+			delete(s.deleted, w.id)
+			fallthrough
+		case serialized[i] != nil:
+			s.data[w.id] = serialized[i]
+		}
+		s.addEvent(events[i])
+	}
+
+	return nil
+}
+
+func (s *MemoryStorage) list(page int, perPage int) ([]ThingDescription, int, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	total := len(s.keys)
+	offset, limit, err := utils.GetPagingAttr(total, page, perPage, MaxPerPage)
+	if err != nil {
+		return nil, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
+	}
+
+	devices := make([]ThingDescription, limit)
+	for i, id := range s.keys[offset : offset+limit] {
+		var td ThingDescription
+		err = json.Unmarshal(s.data[id], &td)
+		if err != nil {
+			return nil, 0, err
+		}
+		devices[i] = td
+	}
+
+	return devices, total, nil
+}
+
+func (s *MemoryStorage) listAfter(after string, limit int) ([]ThingDescription, bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	i := sort.SearchStrings(s.keys, after)
+	if i < len(s.keys) && s.keys[i] == after {
+		i++
+	}
+	keys := s.keys[i:]
+	more := len(keys) > limit
+	if more {
+		keys = keys[:limit]
+	}
+
+	devices := make([]ThingDescription, len(keys))
+	for i, id := range keys {
+		var td ThingDescription
+		err := json.Unmarshal(s.data[id], &td)
+		if err != nil {
+			return nil, false, err
+		}
+		devices[i] = td
+	}
+
+	return devices, more, nil
+}
+
+func (s *MemoryStorage) listAllBytes() ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, id := range s.keys {
+		if i != 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.Write(s.data[id])
+	}
+	buffer.WriteString("]")
+
+	return buffer.Bytes(), nil
+}
+
+func (s *MemoryStorage) total() (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.keys), nil
+}
+
+// snapshot returns the serialized TDs in key order.
+// The stored slices are never modified in place, so they can be used after releasing the lock.
+func (s *MemoryStorage) snapshot() [][]byte {
+	s.RLock()
+	defer s.RUnlock()
+
+	values := make([][]byte, len(s.keys))
+	for i, id := range s.keys {
+		values[i] = s.data[id]
+	}
+	return values
+}
+
+func (s *MemoryStorage) iterator() <-chan ThingDescription {
+	serviceIter := make(chan ThingDescription)
+
+	go func() {
+		defer close(serviceIter)
+
+		for _, b := range s.snapshot() {
+			var td ThingDescription
+			err := json.Unmarshal(b, &td)
+			if err != nil {
+				log.Printf("Memory storage error: %s", err)
+				return
+			}
+			serviceIter <- td
+		}
+	}()
+
+	return serviceIter
+}
+
+func (s *MemoryStorage) iterateBytes(ctx context.Context) <-chan []byte {
+	bytesCh := make(chan []byte, 0) // must be zero
+
+	go func() {
+		defer close(bytesCh)
+
+	Loop:
+		for _, b := range s.snapshot() {
+			select {
+			case <-ctx.Done():
+				break Loop
+			case bytesCh <- b:
+			}
+		}
+	}()
+
+	return bytesCh
+}
+
+// archive keeps the replaced TD in history, if its revision is replaced or deleted
+// The caller must hold the lock.
+func (s *MemoryStorage) archive(id string, oldBytes, newBytes []byte) {
+	if s.historySize <= 0 {
+		return
+	}
+	if archive, _ := archiveRevision(oldBytes, newBytes); !archive {
+		return
+	}
+
+	revisions := append(s.revisions[id], oldBytes)
+	if len(revisions) > s.historySize {
+		revisions = append([][]byte{}, revisions[len(revisions)-s.historySize:]...)
+	}
+	s.revisions[id] = revisions
+	if newBytes == nil {
+		s.deleted[id] = time.Now().UTC()
+	}
+}
+
+func (s *MemoryStorage) history(id string) ([]ThingDescription, error) {
+	s.RLock()
+	revisions := s.revisions[id]
+	s.RUnlock()
+
+	tds := make([]ThingDescription, len(revisions))
+	for i := range revisions {
+		var td ThingDescription
+		err := json.Unmarshal(revisions[i], &td)
+		if err != nil {
+			return nil, err
+		}
+		tds[len(revisions)-1-i] = td
+	}
+	return tds, nil
+}
+
+func (s *MemoryStorage) pruneHistory(deletedBefore time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for id, deleted := range s.deleted {
+		if deleted.Before(deletedBefore) {
+			delete(s.revisions, id)
+			delete(s.deleted, id)
+		}
+	}
+	return nil
+}
+
+// addEvent adds the serialized event to the outbox, if any
+// The caller must hold the lock.
+func (s *MemoryStorage) addEvent(b []byte) {
+	if b == nil {
+		return
+	}
+	s.eventSeq++
+	s.events = append(s.events, memoryOutboxEntry{s.eventSeq, b})
+}
+
+func (s *MemoryStorage) outbox(after uint64, limit int) ([]outboxEvent, error) {
+	s.RLock()
+	entries := s.events
+	for len(entries) > 0 && entries[0].seq <= after {
+		entries = entries[1:]
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	entries = append([]memoryOutboxEntry{}, entries...)
+	s.RUnlock()
+
+	events := make([]outboxEvent, len(entries))
+	for i := range entries {
+		var err error
+		events[i], err = unmarshalOutboxEvent(entries[i].seq, entries[i].event)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (s *MemoryStorage) removeFromOutbox(until uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	i := 0
+	for i < len(s.events) && s.events[i].seq <= until {
+		i++
+	}
+	s.events = append([]memoryOutboxEntry{}, s.events[i:]...)
+	return nil
+}
+
+func (s *MemoryStorage) Close() {}
@@ -0,0 +1,175 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const outboxBatchSize = 100
+
+var (
+	// retry intervals of failed dispatches, to be modified in unit tests
+	outboxInitialBackoff = time.Second
+	outboxMaxBackoff     = time.Minute
+	// outboxMaxAttempts is the number of dispatches to a listener before the event is given up for it
+	outboxMaxAttempts = 10
+)
+
+// outboxEvent is an event stored in the outbox of the storage, in the same atomic write as the change of the TD
+// The events are dispatched to each listener in the order of the writes and removed once dispatched to all of them.
+type outboxEvent struct {
+	// seq is the position of the event in the outbox, set by the storage
+	seq  uint64
+	Type wot.EventType    `json:"type"`
+	Old  ThingDescription `json:"old,omitempty"`
+	New  ThingDescription `json:"new,omitempty"`
+}
+
+func createdEvent(new ThingDescription) *outboxEvent {
+	return &outboxEvent{Type: wot.EventTypeCreate, New: new}
+}
+
+func updatedEvent(old, new ThingDescription) *outboxEvent {
+	return &outboxEvent{Type: wot.EventTypeUpdate, Old: old, New: new}
+}
+
+func deletedEvent(old ThingDescription) *outboxEvent {
+	return &outboxEvent{Type: wot.EventTypeDelete, Old: old}
+}
+
+func expiredEvent(old ThingDescription) *outboxEvent {
+	return &outboxEvent{Type: wot.EventTypeExpire, Old: old}
+}
+
+// marshalOutboxEvent serializes the event, or returns nil for no event
+func marshalOutboxEvent(e *outboxEvent) ([]byte, error) {
+	if e == nil {
+		return nil, nil
+	}
+	return json.Marshal(e)
+}
+
+func unmarshalOutboxEvent(seq uint64, b []byte) (outboxEvent, error) {
+	var e outboxEvent
+	err := json.Unmarshal(b, &e)
+	e.seq = seq
+	return e, err
+}
+
+// handle passes the event to the listeners
+func (e outboxEvent) handle(h eventHandler) error {
+	switch e.Type {
+	case wot.EventTypeCreate:
+		return h.created(e.New)
+	case wot.EventTypeUpdate:
+		return h.updated(e.Old, e.New)
+	case wot.EventTypeDelete:
+		return h.deleted(e.Old)
+	case wot.EventTypeExpire:
+		return h.expired(e.Old)
+	}
+	return fmt.Errorf("unknown event type: %s", e.Type)
+}
+
+// outboxCursor is the position of a listener in the outbox
+type outboxCursor struct {
+	listener EventListener
+	// sequence number of the last event dispatched to the listener or given up
+	seq uint64
+	// signals new events in the outbox
+	signal chan struct{}
+}
+
+// signalOutbox wakes up the dispatchers after a write
+func (c *Controller) signalOutbox() {
+	c.cursorsLock.Lock()
+	defer c.cursorsLock.Unlock()
+	for _, cursor := range c.cursors {
+		select {
+		case cursor.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dispatchOutbox passes the events of the outbox to a listener, one at a time and in the order of the writes
+// A failed dispatch is retried up to outboxMaxAttempts. Each listener has its own dispatcher, so that the retries of a
+// failing listener do not delay the other listeners.
+func (c *Controller) dispatchOutbox(cursor *outboxCursor) {
+	defer c.dispatchers.Done()
+	for {
+		events, err := c.storage.outbox(cursor.seq, outboxBatchSize)
+		if err != nil {
+			log.Printf("Error reading the event outbox: %s", err)
+		}
+		for _, e := range events {
+			if !c.dispatch(cursor.listener, e) {
+				return
+			}
+			c.acknowledge(cursor, e.seq)
+		}
+		if len(events) == outboxBatchSize {
+			continue
+		}
+		select {
+		case <-cursor.signal:
+		case <-time.After(outboxInitialBackoff):
+			// retry reading after errors
+		case <-c.stopped:
+			return
+		}
+	}
+}
+
+// dispatch returns false if the controller is stopped before the event is dispatched
+func (c *Controller) dispatch(listener EventListener, e outboxEvent) bool {
+	for attempt, backoff := 1, outboxInitialBackoff; ; attempt++ {
+		err := e.handle(eventHandler{listener})
+		if err == nil {
+			return true
+		}
+		if attempt == outboxMaxAttempts {
+			log.Printf("Dropping %s event %d for %T after %d attempts: %s", e.Type, e.seq, listener, attempt, err)
+			return true
+		}
+		log.Printf("Error dispatching %s event %d to %T: %s. Retry in %v", e.Type, e.seq, listener, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-c.stopped:
+			return false
+		}
+		if backoff *= 2; backoff > outboxMaxBackoff {
+			backoff = outboxMaxBackoff
+		}
+	}
+}
+
+// acknowledge moves the cursor past the event and removes the events dispatched to all listeners from the outbox
+// The events are dispatched again after a restart if not removed.
+func (c *Controller) acknowledge(cursor *outboxCursor, seq uint64) {
+	c.cursorsLock.Lock()
+	defer c.cursorsLock.Unlock()
+	cursor.seq = seq
+
+	until := seq
+	for _, other := range c.cursors {
+		if other.seq < until {
+			until = other.seq
+		}
+	}
+	if until <= c.removed {
+		return
+	}
+	err := c.storage.removeFromOutbox(until)
+	if err != nil {
+		log.Printf("Error removing the events up to %d from the outbox: %s", until, err)
+		return
+	}
+	c.removed = until
+}
@@ -0,0 +1,301 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/wot"
+	uuid "github.com/satori/go.uuid"
+)
+
+// recordingListener passes all events to a channel, failing the first calls if set
+type recordingListener struct {
+	events chan outboxEvent
+	sync.Mutex
+	failures int
+}
+
+func (l *recordingListener) record(e outboxEvent) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.failures > 0 {
+		l.failures--
+		return fmt.Errorf("failing on purpose")
+	}
+	l.events <- e
+	return nil
+}
+
+func (l *recordingListener) CreateHandler(new ThingDescription) error {
+	return l.record(*createdEvent(new))
+}
+func (l *recordingListener) UpdateHandler(old ThingDescription, new ThingDescription) error {
+	return l.record(*updatedEvent(old, new))
+}
+func (l *recordingListener) DeleteHandler(old ThingDescription) error {
+	return l.record(*deletedEvent(old))
+}
+func (l *recordingListener) ExpireHandler(old ThingDescription) error {
+	return l.record(*expiredEvent(old))
+}
+
+func (l *recordingListener) receive(t *testing.T, n int) []outboxEvent {
+	var events []outboxEvent
+	for len(events) < n {
+		select {
+		case e := <-l.events:
+			events = append(events, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout after receiving %d events instead of %d", len(events), n)
+		}
+	}
+	return events
+}
+
+func outboxTestTD(id string) ThingDescription {
+	return ThingDescription{
+		"@context": "https://www.w3.org/2019/wot/td/v1",
+		"id":       id,
+		"title":    "example thing",
+		"security": []string{"nosec_sc"},
+		"securityDefinitions": map[string]any{
+			"nosec_sc": map[string]string{
+				"scheme": "nosec",
+			},
+		},
+	}
+}
+
+func TestControllerEventOrder(t *testing.T) {
+	controller := setup(t)
+	listener := &recordingListener{events: make(chan outboxEvent, 100)}
+	controller.AddSubscriber(listener)
+
+	id, err := controller.add(outboxTestTD("urn:example:test/thing1"))
+	if err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+
+	// concurrent writes are dispatched in the order of their commits
+	const updates = 20
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			td := outboxTestTD(id)
+			td["title"] = fmt.Sprintf("update %d", i)
+			if err := controller.update(id, td, nil); err != nil {
+				t.Errorf("Error updating the TD: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	results := controller.batch([]BatchOperation{
+		{Op: BatchOpDelete, ID: id},
+		{Op: BatchOpCreate, TD: outboxTestTD(id)},
+	}, true)
+	for _, r := range results {
+		if r.err != nil {
+			t.Fatalf("Error in batch: %s", r.err)
+		}
+	}
+
+	events := listener.receive(t, updates+3)
+	if events[0].Type != wot.EventTypeCreate || events[updates+1].Type != wot.EventTypeDelete || events[updates+2].Type != wot.EventTypeCreate {
+		t.Fatalf("Unexpected event types: %v, %v, %v", events[0].Type, events[updates+1].Type, events[updates+2].Type)
+	}
+	for i, e := range events[1 : updates+1] {
+		if e.Type != wot.EventTypeUpdate {
+			t.Fatalf("Unexpected event type %s", e.Type)
+		}
+		old, new := ThingRevision(ThingRegistration(e.Old)), ThingRevision(ThingRegistration(e.New))
+		if old != uint64(i+1) || new != uint64(i+2) {
+			t.Fatalf("Update %d from revision %d to %d", i, old, new)
+		}
+	}
+}
+
+func TestControllerEventRetry(t *testing.T) {
+	// restored after the controller is stopped
+	backoff := outboxInitialBackoff
+	t.Cleanup(func() {
+		outboxInitialBackoff = backoff
+	})
+	outboxInitialBackoff = 10 * time.Millisecond
+
+	controller := setup(t)
+	listener := &recordingListener{events: make(chan outboxEvent, 10), failures: 3}
+	controller.AddSubscriber(listener)
+
+	for _, id := range []string{"urn:example:test/thing1", "urn:example:test/thing2"} {
+		if _, err := controller.add(outboxTestTD(id)); err != nil {
+			t.Fatalf("Error adding a TD: %s", err)
+		}
+	}
+
+	// the failed event is retried before the next one
+	events := listener.receive(t, 2)
+	if events[0].New[wot.KeyThingID] != "urn:example:test/thing1" || events[1].New[wot.KeyThingID] != "urn:example:test/thing2" {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+}
+
+func TestControllerEventRetryBounded(t *testing.T) {
+	// restored after the controller is stopped
+	backoff, attempts := outboxInitialBackoff, outboxMaxAttempts
+	t.Cleanup(func() {
+		outboxInitialBackoff, outboxMaxAttempts = backoff, attempts
+	})
+	outboxInitialBackoff, outboxMaxAttempts = time.Millisecond, 3
+
+	controller := setup(t)
+	failing := &recordingListener{events: make(chan outboxEvent, 10), failures: 1000}
+	listener := &recordingListener{events: make(chan outboxEvent, 10)}
+	controller.AddSubscriber(listener)
+	controller.AddSubscriber(failing)
+
+	for _, id := range []string{"urn:example:test/thing1", "urn:example:test/thing2"} {
+		if _, err := controller.add(outboxTestTD(id)); err != nil {
+			t.Fatalf("Error adding a TD: %s", err)
+		}
+	}
+
+	// the failing listener does not block the outbox, nor causes duplicates for the other listeners
+	events := listener.receive(t, 2)
+	if events[0].New[wot.KeyThingID] != "urn:example:test/thing1" || events[1].New[wot.KeyThingID] != "urn:example:test/thing2" {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	select {
+	case e := <-listener.events:
+		t.Fatalf("Duplicate event: %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	dispatches := func() int {
+		failing.Lock()
+		defer failing.Unlock()
+		return 1000 - failing.failures
+	}
+	for deadline := time.Now().Add(5 * time.Second); dispatches() < 2*outboxMaxAttempts; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d dispatches to the failing listener instead of %d", dispatches(), 2*outboxMaxAttempts)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := dispatches(); n != 2*outboxMaxAttempts {
+		t.Fatalf("%d dispatches to the failing listener instead of %d", n, 2*outboxMaxAttempts)
+	}
+}
+
+func TestControllerEventFailingListener(t *testing.T) {
+	// restored after the controller is stopped
+	backoff := outboxInitialBackoff
+	t.Cleanup(func() {
+		outboxInitialBackoff = backoff
+	})
+	outboxInitialBackoff = time.Hour
+
+	storage := NewMemoryStorage(0)
+	controller, err := NewController(storage)
+	if err != nil {
+		t.Fatalf("Error creating controller: %s", err)
+	}
+	t.Cleanup(controller.Stop)
+	err = loadSchema()
+	if err != nil {
+		t.Fatalf("error loading WoT Thing Description schema: %s", err)
+	}
+	failing := &recordingListener{events: make(chan outboxEvent, 10), failures: 1000}
+	listener := &recordingListener{events: make(chan outboxEvent, 10)}
+	controller.AddSubscriber(failing)
+	controller.AddSubscriber(listener)
+
+	for _, id := range []string{"urn:example:test/thing1", "urn:example:test/thing2"} {
+		if _, err := controller.add(outboxTestTD(id)); err != nil {
+			t.Fatalf("Error adding a TD: %s", err)
+		}
+	}
+
+	// the healthy listener gets the events while the failing one waits for its retry
+	events := listener.receive(t, 2)
+	if events[0].New[wot.KeyThingID] != "urn:example:test/thing1" || events[1].New[wot.KeyThingID] != "urn:example:test/thing2" {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	// and the events stay in the outbox until given up for the failing listener
+	pending, err := storage.outbox(0, outboxBatchSize)
+	if err != nil {
+		t.Fatalf("Error reading the outbox: %s", err)
+	}
+	if len(pending) != 2 {
+		t.Fatalf("%d events in the outbox instead of 2", len(pending))
+	}
+}
+
+func TestLevelDBStorageOutbox(t *testing.T) {
+	if TestStorageType != BackendLevelDB {
+		t.Skipf("outbox persistence is specific to %s", BackendLevelDB)
+	}
+	err := loadSchema()
+	if err != nil {
+		t.Fatalf("error loading WoT Thing Description schema: %s", err)
+	}
+	tempDir := fmt.Sprintf("%s/thing-directory/test-%s-ldb", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4())
+	defer os.RemoveAll(tempDir)
+
+	// events of writes without listeners stay in the outbox
+	storage, err := NewLevelDBStorage(tempDir, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("error creating leveldb storage: %s", err)
+	}
+	controller, _ := NewController(storage)
+	for _, id := range []string{"urn:example:test/thing1", "urn:example:test/thing2"} {
+		if _, err := controller.add(outboxTestTD(id)); err != nil {
+			t.Fatalf("Error adding a TD: %s", err)
+		}
+	}
+	controller.Stop()
+	storage.Close()
+
+	// and are dispatched after a restart
+	storage, err = NewLevelDBStorage(tempDir, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("error opening leveldb storage: %s", err)
+	}
+	defer storage.Close()
+	controller, _ = NewController(storage)
+	defer controller.Stop()
+	listener := &recordingListener{events: make(chan outboxEvent, 10)}
+	controller.AddSubscriber(listener)
+
+	if _, err := controller.add(outboxTestTD("urn:example:test/thing3")); err != nil {
+		t.Fatalf("Error adding a TD: %s", err)
+	}
+	events := listener.receive(t, 3)
+	for i, e := range events {
+		if id := fmt.Sprintf("urn:example:test/thing%d", i+1); e.New[wot.KeyThingID] != id {
+			t.Fatalf("Event %d for %s instead of %s", i, e.New[wot.KeyThingID], id)
+		}
+	}
+
+	// dispatched events are removed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, err := storage.outbox(0, outboxBatchSize)
+		if err != nil {
+			t.Fatalf("Error reading the outbox: %s", err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events left in the outbox", len(pending))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
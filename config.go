@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"strings"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/linksmart/go-sec/auth/obtainer"
 	"github.com/linksmart/go-sec/auth/validator"
 	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/notification"
 )
 
 type Config struct {
@@ -22,6 +24,9 @@ type Config struct {
 	DNSSD          DNSSDConfig    `json:"dnssd"`
 	Storage        StorageConfig  `json:"storage"`
 	ServiceCatalog ServiceCatalog `json:"serviceCatalog"`
+	MQTT           MQTTConfig     `json:"mqtt"`
+	Notification   Notification   `json:"notification"`
+	Federation     Federation     `json:"federation"`
 }
 
 type Validation struct {
@@ -34,8 +39,16 @@ type HTTPConfig struct {
 	BindPort       int            `json:"bindPort"`
 	TLSConfig      *TLSConfig     `json:"tls"`
 	Auth           validator.Conf `json:"auth"`
+	// Conformance selects the API surface. With wot-discovery, the deprecated and non-standard variants are replaced by the W3C WoT Discovery Directory API.
+	Conformance string `json:"conformance"`
 }
 
+// API conformance modes
+const (
+	ConformanceDefault      = ""
+	ConformanceWoTDiscovery = "wot-discovery"
+)
+
 type TLSConfig struct {
 	Enabled  bool   `json:"enabled"`
 	KeyFile  string `json:"keyFile"`
@@ -57,15 +70,63 @@ type DNSSDConfig struct {
 		Domain     string   `json:"domain"`
 		Interfaces []string `json:"interfaces"`
 	}
+	// Browse registers the Things advertised with DNS-SD
+	Browse struct {
+		Enabled    bool     `json:"enabled"`
+		Domain     string   `json:"domain"`
+		Interfaces []string `json:"interfaces"`
+		// Interval between browse queries in seconds
+		Interval int `json:"interval"`
+	}
+}
+
+type Notification struct {
+	BufferSize     int                         `json:"bufferSize"`
+	OverflowPolicy notification.OverflowPolicy `json:"overflowPolicy"`
+	// HistorySize is the number of events kept for replay and the history API
+	HistorySize int `json:"historySize"`
+	// StorageType of the event history, memory or leveldb. Defaults to the type of the catalog storage.
+	StorageType string `json:"storageType"`
+	// Webhooks enables the webhook subscriptions, stored with LevelDB under the storage DSN
+	Webhooks Webhooks `json:"webhooks"`
+}
+
+type Webhooks struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Federation mirrors the TDs of peer directories
+type Federation struct {
+	Enabled bool                     `json:"enabled"`
+	Peers   []catalog.FederationPeer `json:"peers"`
+	// RetryInterval between reconnections to a peer in seconds
+	RetryInterval int `json:"retryInterval"`
+	// Search forwards the queries of the federated search scope
+	Search FederatedSearch `json:"search"`
+}
+
+type FederatedSearch struct {
+	Enabled bool                     `json:"enabled"`
+	Peers   []catalog.FederationPeer `json:"peers"`
+	// DNSSD adds the directories advertised with DNS-SD, browsed in the domain and on the interfaces of dnssd.browse
+	DNSSD bool `json:"dnssd"`
+	// Timeout of each peer in seconds
+	Timeout int `json:"timeout"`
+}
+
+type MQTTConfig struct {
+	Publish notification.MQTTConf `json:"publish"`
 }
 
 type StorageConfig struct {
-	Type string `json:"type"`
-	DSN  string `json:"dsn"`
+	Type        string   `json:"type"`
+	DSN         string   `json:"dsn"`
+	Indexes     []string `json:"indexes"`
+	HistorySize int      `json:"historySize"`
 }
 
 var supportedBackends = map[string]bool{
-	catalog.BackendMemory:  false,
+	catalog.BackendMemory:  true,
 	catalog.BackendLevelDB: true,
 }
 
@@ -77,6 +138,11 @@ func (c *Config) Validate() error {
 	if err != nil {
 		return fmt.Errorf("PublicEndpoint should be a valid URL")
 	}
+	switch c.HTTP.Conformance {
+	case ConformanceDefault, ConformanceWoTDiscovery:
+	default:
+		return fmt.Errorf("unsupported HTTP conformance: %s", c.HTTP.Conformance)
+	}
 	if c.HTTP.Auth.Enabled {
 		// Validate ticket validator config
 		err = c.HTTP.Auth.Validate()
@@ -92,6 +158,56 @@ func (c *Config) Validate() error {
 	if !supportedBackends[c.Storage.Type] {
 		return fmt.Errorf("unsupported storage backend")
 	}
+	if c.Storage.HistorySize < 0 {
+		return fmt.Errorf("storage historySize should not be negative")
+	}
+	for _, pointer := range c.Storage.Indexes {
+		if !strings.HasPrefix(pointer, "/") {
+			return fmt.Errorf("storage index should be a JSON Pointer starting with /: %s", pointer)
+		}
+	}
+
+	if c.Notification.BufferSize < 0 {
+		return fmt.Errorf("notification bufferSize should not be negative")
+	}
+	if c.Notification.OverflowPolicy != "" && !c.Notification.OverflowPolicy.IsValid() {
+		return fmt.Errorf("unsupported notification overflowPolicy: %s", c.Notification.OverflowPolicy)
+	}
+	if c.Notification.HistorySize < 0 {
+		return fmt.Errorf("notification historySize should not be negative")
+	}
+	if c.Notification.StorageType != "" && !supportedBackends[c.Notification.StorageType] {
+		return fmt.Errorf("unsupported notification storage backend")
+	}
+
+	if c.DNSSD.Browse.Interval < 0 {
+		return fmt.Errorf("DNS-SD browse interval should not be negative")
+	}
+
+	if components := c.levelDBComponents(); len(components) > 0 && c.Storage.DSN == "" {
+		return fmt.Errorf("storage DSN is required for the LevelDB storage of the %s", strings.Join(components, ", "))
+	}
+
+	if c.Federation.RetryInterval < 0 {
+		return fmt.Errorf("federation retryInterval should not be negative")
+	}
+	if c.Federation.Enabled {
+		if err := validatePeers(c.Federation.Peers); err != nil {
+			return fmt.Errorf("invalid federation peers: %s", err)
+		}
+	}
+	if c.Federation.Search.Timeout < 0 {
+		return fmt.Errorf("federated search timeout should not be negative")
+	}
+	if c.Federation.Search.Enabled {
+		if err := validatePeers(c.Federation.Search.Peers); err != nil {
+			return fmt.Errorf("invalid federated search peers: %s", err)
+		}
+	}
+
+	if err := c.MQTT.Publish.Validate(); err != nil {
+		return fmt.Errorf("invalid MQTT publish config: %s", err)
+	}
 
 	if c.ServiceCatalog.Enabled {
 		if c.ServiceCatalog.Endpoint == "" && c.ServiceCatalog.Discover {
@@ -112,6 +228,48 @@ func (c *Config) Validate() error {
 	return err
 }
 
+// levelDBComponents returns the components stored with LevelDB, under the storage DSN
+func (c *Config) levelDBComponents() []string {
+	var components []string
+	if c.Storage.Type == catalog.BackendLevelDB {
+		components = append(components, "catalog")
+	}
+	eventQueueType := c.Notification.StorageType
+	if eventQueueType == "" {
+		eventQueueType = c.Storage.Type
+	}
+	if eventQueueType == catalog.BackendLevelDB {
+		components = append(components, "event history")
+	}
+	if c.Notification.Webhooks.Enabled {
+		components = append(components, "webhook subscriptions")
+	}
+	if c.Federation.Enabled && c.Storage.Type == catalog.BackendLevelDB {
+		components = append(components, "federation")
+	}
+	return components
+}
+
+// validatePeers checks that the peers have unique names and HTTP URLs
+// The names are part of the paths of the mirrored TDs and cannot contain slashes.
+func validatePeers(peers []catalog.FederationPeer) error {
+	names := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		if peer.Name == "" || names[peer.Name] {
+			return fmt.Errorf("peers should have unique names")
+		}
+		if strings.Contains(peer.Name, "/") {
+			return fmt.Errorf("peer name %s should not contain a slash", peer.Name)
+		}
+		names[peer.Name] = true
+		u, err := url.Parse(peer.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("peer %s should have an HTTP URL", peer.Name)
+		}
+	}
+	return nil
+}
+
 func loadConfig(path string) (*Config, error) {
 	file, err := ioutil.ReadFile(path)
 	if err != nil {
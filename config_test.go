@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/linksmart/thing-directory/catalog"
+)
+
+func TestConfigStorageDSN(t *testing.T) {
+	newConfig := func(storageType string) *Config {
+		conf := &Config{}
+		conf.HTTP.BindAddr = "0.0.0.0"
+		conf.HTTP.BindPort = 8081
+		conf.HTTP.PublicEndpoint = "http://localhost:8081"
+		conf.Storage.Type = storageType
+		return conf
+	}
+
+	// the component stored with LevelDB, if any
+	tests := []struct {
+		name      string
+		config    func() *Config
+		component string
+	}{
+		{"memory", func() *Config { return newConfig(catalog.BackendMemory) }, ""},
+		{"leveldb catalog", func() *Config { return newConfig(catalog.BackendLevelDB) }, "catalog"},
+		{"leveldb event history", func() *Config {
+			conf := newConfig(catalog.BackendMemory)
+			conf.Notification.StorageType = catalog.BackendLevelDB
+			return conf
+		}, "event history"},
+		{"webhooks", func() *Config {
+			conf := newConfig(catalog.BackendMemory)
+			conf.Notification.Webhooks.Enabled = true
+			return conf
+		}, "webhook subscriptions"},
+		{"federation", func() *Config {
+			conf := newConfig(catalog.BackendLevelDB)
+			conf.Notification.StorageType = catalog.BackendMemory
+			conf.Federation.Enabled = true
+			return conf
+		}, "federation"},
+		{"memory federation", func() *Config {
+			conf := newConfig(catalog.BackendMemory)
+			conf.Federation.Enabled = true
+			return conf
+		}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config().Validate()
+			if test.component == "" && err != nil {
+				t.Fatalf("error validating: %s", err)
+			}
+			if test.component != "" && (err == nil || !strings.Contains(err.Error(), test.component)) {
+				t.Fatalf("no error for the %s without a storage DSN: %v", test.component, err)
+			}
+
+			// all are valid with a DSN
+			conf := test.config()
+			conf.Storage.DSN = "./data"
+			if err := conf.Validate(); err != nil {
+				t.Fatalf("error validating with a storage DSN: %s", err)
+			}
+		})
+	}
+}
+
+func TestValidatePeers(t *testing.T) {
+	tests := []struct {
+		name  string
+		peers []catalog.FederationPeer
+		valid bool
+	}{
+		{"valid", []catalog.FederationPeer{{Name: "site-a", URL: "http://a"}, {Name: "site-b", URL: "https://b"}}, true},
+		{"duplicate name", []catalog.FederationPeer{{Name: "site", URL: "http://a"}, {Name: "site", URL: "http://b"}}, false},
+		{"slash in name", []catalog.FederationPeer{{Name: "site/a", URL: "http://a"}}, false},
+		{"no HTTP URL", []catalog.FederationPeer{{Name: "site", URL: "mqtt://a"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validatePeers(test.peers); (err == nil) != test.valid {
+				t.Fatalf("validation error %v for valid=%t", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/notification"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const testSchemaPath = "wot/wot_td_schema.json"
+
+// newConformanceServer starts a directory in the wot-discovery conformance mode
+func newConformanceServer(t *testing.T) *httptest.Server {
+	config := &Config{ServiceID: "test", Description: "test directory"}
+	config.HTTP.PublicEndpoint = "http://localhost"
+	config.HTTP.Conformance = ConformanceWoTDiscovery
+	server := httptest.NewServer(newTestDirectory(t, config, 100, nil))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestDirectory returns the HTTP handler of a directory with memory storage and the given size of event history
+func newTestDirectory(t *testing.T, config *Config, historySize uint64, federation *catalog.Federation) http.Handler {
+	if !wot.LoadedJSONSchemas() {
+		if err := wot.LoadJSONSchemas([]string{testSchemaPath}); err != nil {
+			t.Fatalf("error loading schema: %s", err)
+		}
+	}
+
+	controller, err := catalog.NewController(catalog.NewMemoryStorage(0))
+	if err != nil {
+		t.Fatalf("error creating controller: %s", err)
+	}
+	notificationController := notification.NewController(notification.NewMemoryEventQueue(historySize), 0, "")
+	webhookManager, err := notification.NewWebhookManager(notificationController, "", t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("error creating webhook manager: %s", err)
+	}
+	controller.AddSubscriber(notificationController)
+
+	router, err := setupHTTPRouter(&config.HTTP, directoryTD(config),
+		catalog.NewHTTPAPI(controller, ""),
+		notification.NewSSEAPI(notificationController, "", ""),
+		notification.NewWebSocketAPI(notificationController, ""),
+		notification.NewWebhookAPI(webhookManager),
+		federation)
+	if err != nil {
+		t.Fatalf("error setting up router: %s", err)
+	}
+	// stopped after the server, as registered first
+	t.Cleanup(func() {
+		controller.Stop()
+		webhookManager.Close()
+		notificationController.Stop()
+	})
+	return router
+}
+
+func conformanceTD(id string) map[string]interface{} {
+	td := map[string]interface{}{
+		"@context":            "https://www.w3.org/2019/wot/td/v1",
+		"title":               "example thing",
+		"securityDefinitions": map[string]interface{}{"nosec_sc": map[string]interface{}{"scheme": "nosec"}},
+		"security":            []string{"nosec_sc"},
+	}
+	if id != "" {
+		td[wot.KeyThingID] = id
+	}
+	return td
+}
+
+func request(t *testing.T, method, target, contentType string, body interface{}) *http.Response {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			t.Fatalf("error serializing body: %s", err)
+		}
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("error creating request: %s", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error sending request: %s", err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func expectStatus(t *testing.T, res *http.Response, status int) {
+	t.Helper()
+	if res.StatusCode != status {
+		b, _ := ioutil.ReadAll(res.Body)
+		t.Fatalf("%s %s: status %d instead of %d: %s", res.Request.Method, res.Request.URL, res.StatusCode, status, b)
+	}
+}
+
+func expectContentType(t *testing.T, res *http.Response, contentType string) {
+	t.Helper()
+	if got := res.Header.Get("Content-Type"); !strings.HasPrefix(got, contentType) {
+		t.Fatalf("%s %s: content type %s instead of %s", res.Request.Method, res.Request.URL, got, contentType)
+	}
+}
+
+func decode(t *testing.T, res *http.Response, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		t.Fatalf("error decoding response: %s", err)
+	}
+}
+
+type sseEvent struct {
+	name, id string
+	data     map[string]interface{}
+}
+
+// subscribe opens an event stream and returns the received events
+func subscribe(t *testing.T, target string) (*http.Response, <-chan sseEvent) {
+	res, err := http.Get(target)
+	if err != nil {
+		t.Fatalf("error subscribing: %s", err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	events := make(chan sseEvent)
+	go func() {
+		defer close(events)
+		var event sseEvent
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.data)
+			case line == "":
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+	return res, events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("event stream closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for event")
+	}
+	return sseEvent{}
+}
+
+// TestWoTDiscoveryConformance covers the W3C WoT Discovery assertions claimed by the wot-discovery conformance mode
+// The claimed assertions are listed in the README.
+func TestWoTDiscoveryConformance(t *testing.T) {
+	server := newConformanceServer(t)
+	base := server.URL
+
+	tests := []struct {
+		assertion string
+		test      func(t *testing.T)
+	}{
+		{"tdd-well-known-td", func(t *testing.T) {
+			res := request(t, "GET", base+wot.WellKnownPath, "", nil)
+			expectStatus(t, res, http.StatusOK)
+			expectContentType(t, res, wot.MediaTypeThingDescription)
+			var td map[string]interface{}
+			decode(t, res, &td)
+			if td["@type"] != wot.TypeThingDirectory {
+				t.Fatalf("type %v instead of %s", td["@type"], wot.TypeThingDirectory)
+			}
+		}},
+		{"tdd-things-create-anonymous-id", func(t *testing.T) {
+			res := request(t, "POST", base+"/things", wot.MediaTypeThingDescription, conformanceTD(""))
+			expectStatus(t, res, http.StatusCreated)
+			id := res.Header.Get("Location")
+			if !strings.HasPrefix(id, "urn:uuid:") {
+				t.Fatalf("location %s is not a system-generated ID", id)
+			}
+			res = request(t, "GET", base+"/things/"+id, "", nil)
+			expectStatus(t, res, http.StatusOK)
+
+			// anonymous TDs should not have an ID
+			res = request(t, "POST", base+"/things", wot.MediaTypeThingDescription, conformanceTD("urn:example:anonymous"))
+			expectStatus(t, res, http.StatusBadRequest)
+		}},
+		{"tdd-things-create-known-td", func(t *testing.T) {
+			res := request(t, "PUT", base+"/things/urn:example:create", wot.MediaTypeThingDescription, conformanceTD("urn:example:create"))
+			expectStatus(t, res, http.StatusCreated)
+		}},
+		{"tdd-things-retrieve-resp", func(t *testing.T) {
+			request(t, "PUT", base+"/things/urn:example:retrieve", wot.MediaTypeThingDescription, conformanceTD("urn:example:retrieve"))
+			res := request(t, "GET", base+"/things/urn:example:retrieve", "", nil)
+			expectStatus(t, res, http.StatusOK)
+			expectContentType(t, res, wot.MediaTypeThingDescription)
+			var td map[string]interface{}
+			decode(t, res, &td)
+			if td[wot.KeyThingID] != "urn:example:retrieve" {
+				t.Fatalf("retrieved %v", td[wot.KeyThingID])
+			}
+		}},
+		{"tdd-things-update-resp", func(t *testing.T) {
+			request(t, "PUT", base+"/things/urn:example:update", wot.MediaTypeThingDescription, conformanceTD("urn:example:update"))
+			res := request(t, "PUT", base+"/things/urn:example:update", wot.MediaTypeThingDescription, conformanceTD("urn:example:update"))
+			expectStatus(t, res, http.StatusNoContent)
+		}},
+		{"tdd-things-update-partial-mergepatch", func(t *testing.T) {
+			request(t, "PUT", base+"/things/urn:example:patch", wot.MediaTypeThingDescription, conformanceTD("urn:example:patch"))
+			res := request(t, "PATCH", base+"/things/urn:example:patch", wot.MediaTypeMergePatch, map[string]interface{}{"title": "patched"})
+			expectStatus(t, res, http.StatusNoContent)
+
+			var td map[string]interface{}
+			decode(t, request(t, "GET", base+"/things/urn:example:patch", "", nil), &td)
+			if td["title"] != "patched" {
+				t.Fatalf("title %v after patch", td["title"])
+			}
+		}},
+		{"tdd-things-delete-resp", func(t *testing.T) {
+			request(t, "PUT", base+"/things/urn:example:delete", wot.MediaTypeThingDescription, conformanceTD("urn:example:delete"))
+			res := request(t, "DELETE", base+"/things/urn:example:delete", "", nil)
+			expectStatus(t, res, http.StatusNoContent)
+			res = request(t, "GET", base+"/things/urn:example:delete", "", nil)
+			expectStatus(t, res, http.StatusNotFound)
+		}},
+		{"tdd-http-error-response", func(t *testing.T) {
+			res := request(t, "DELETE", base+"/things/urn:example:non-existing", "", nil)
+			expectStatus(t, res, http.StatusNotFound)
+			expectContentType(t, res, "application/problem+json")
+			var pd wot.ProblemDetails
+			decode(t, res, &pd)
+			if pd.Status != http.StatusNotFound || pd.Title == "" {
+				t.Fatalf("unexpected problem details: %+v", pd)
+			}
+		}},
+		{"tdd-validation-response", func(t *testing.T) {
+			td := conformanceTD("urn:example:invalid")
+			delete(td, "title")
+			res := request(t, "PUT", base+"/things/urn:example:invalid", wot.MediaTypeThingDescription, td)
+			expectStatus(t, res, http.StatusBadRequest)
+			var pd wot.ProblemDetails
+			decode(t, res, &pd)
+			if len(pd.ValidationErrors) == 0 {
+				t.Fatalf("no validation errors: %+v", pd)
+			}
+		}},
+		{"tdd-things-list-resp", func(t *testing.T) {
+			res := request(t, "GET", base+"/things", "", nil)
+			expectStatus(t, res, http.StatusOK)
+			expectContentType(t, res, wot.MediaTypeJSONLD)
+			var tds []map[string]interface{}
+			decode(t, res, &tds)
+			if len(tds) == 0 {
+				t.Fatalf("empty listing")
+			}
+		}},
+		{"tdd-things-list-pagination-limit", func(t *testing.T) {
+			res := request(t, "GET", base+"/things?format=array&limit=1", "", nil)
+			expectStatus(t, res, http.StatusOK)
+			var tds []map[string]interface{}
+			decode(t, res, &tds)
+			if len(tds) != 1 {
+				t.Fatalf("%d TDs instead of 1", len(tds))
+			}
+		}},
+		{"tdd-things-list-pagination-header-nextlink", func(t *testing.T) {
+			var first, second []map[string]interface{}
+			res := request(t, "GET", base+"/things?limit=1", "", nil)
+			decode(t, res, &first)
+			link := res.Header.Get("Link")
+			if !strings.HasSuffix(link, `>; rel="next"`) {
+				t.Fatalf("no next link: %s", link)
+			}
+			next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+			res = request(t, "GET", base+next, "", nil)
+			expectStatus(t, res, http.StatusOK)
+			decode(t, res, &second)
+			if len(second) != 1 || second[0][wot.KeyThingID] == first[0][wot.KeyThingID] {
+				t.Fatalf("next page %v after %v", second, first)
+			}
+		}},
+		{"tdd-things-list-pagination-collection", func(t *testing.T) {
+			res := request(t, "GET", base+"/things?format=collection&limit=1", "", nil)
+			expectStatus(t, res, http.StatusOK)
+			expectContentType(t, res, wot.MediaTypeJSONLD)
+			var collection catalog.ThingCollection
+			decode(t, res, &collection)
+			if collection.Type != wot.TypeThingCollection || len(collection.Members) != 1 || collection.Total < 2 || collection.Next == "" {
+				t.Fatalf("unexpected collection: %+v", collection)
+			}
+
+			res = request(t, "GET", base+"/things?format=table", "", nil)
+			expectStatus(t, res, http.StatusBadRequest)
+		}},
+		{"tdd-search-jsonpath-response", func(t *testing.T) {
+			res := request(t, "GET", base+"/search/jsonpath?query="+url.QueryEscape("$[?(@.id=='urn:example:retrieve')].id"), "", nil)
+			expectStatus(t, res, http.StatusOK)
+			expectContentType(t, res, wot.MediaTypeJSON)
+			var ids []string
+			decode(t, res, &ids)
+			if len(ids) != 1 || ids[0] != "urn:example:retrieve" {
+				t.Fatalf("unexpected result: %v", ids)
+			}
+
+			res = request(t, "GET", base+"/search/jsonpath?query="+url.QueryEscape("$["), "", nil)
+			expectStatus(t, res, http.StatusBadRequest)
+		}},
+		{"tdd-search-xpath-response", func(t *testing.T) {
+			res := request(t, "GET", base+"/search/xpath?query="+url.QueryEscape("*[id='urn:example:retrieve']/id"), "", nil)
+			expectStatus(t, res, http.StatusOK)
+			expectContentType(t, res, wot.MediaTypeJSON)
+			var ids []string
+			decode(t, res, &ids)
+			if len(ids) != 1 || ids[0] != "urn:example:retrieve" {
+				t.Fatalf("unexpected result: %v", ids)
+			}
+		}},
+		{"tdd-search-sparql-not-implemented", func(t *testing.T) {
+			res := request(t, "GET", base+"/search/sparql?query="+url.QueryEscape("SELECT * WHERE {?s ?p ?o}"), "", nil)
+			expectStatus(t, res, http.StatusNotImplemented)
+		}},
+		{"tdd-notification-sse", func(t *testing.T) {
+			res, _ := subscribe(t, base+"/events")
+			expectStatus(t, res, http.StatusOK)
+			expectContentType(t, res, "text/event-stream")
+		}},
+		{"tdd-notification-filter-type", func(t *testing.T) {
+			_, events := subscribe(t, base+"/events/"+wot.DiscoveryEventDeleted)
+			request(t, "PUT", base+"/things/urn:example:filter", wot.MediaTypeThingDescription, conformanceTD("urn:example:filter"))
+			request(t, "DELETE", base+"/things/urn:example:filter", "", nil)
+			if event := nextEvent(t, events); event.name != wot.DiscoveryEventDeleted {
+				t.Fatalf("%s event instead of %s", event.name, wot.DiscoveryEventDeleted)
+			}
+
+			res := request(t, "GET", base+"/events/"+wot.EventTypeCreate, "", nil)
+			expectStatus(t, res, http.StatusBadRequest)
+		}},
+		{"tdd-notification-data-id", func(t *testing.T) {
+			_, events := subscribe(t, base+"/events")
+			request(t, "PUT", base+"/things/urn:example:events", wot.MediaTypeThingDescription, conformanceTD("urn:example:events"))
+			request(t, "PATCH", base+"/things/urn:example:events", wot.MediaTypeMergePatch, map[string]interface{}{"title": "patched"})
+			request(t, "DELETE", base+"/things/urn:example:events", "", nil)
+			for _, name := range []string{wot.DiscoveryEventCreated, wot.DiscoveryEventUpdated, wot.DiscoveryEventDeleted} {
+				event := nextEvent(t, events)
+				if event.name != name || event.id == "" {
+					t.Fatalf("%s event with ID %s instead of %s", event.name, event.id, name)
+				}
+				if len(event.data) != 1 || event.data[wot.KeyThingID] != "urn:example:events" {
+					t.Fatalf("unexpected %s data: %v", name, event.data)
+				}
+			}
+		}},
+		{"tdd-notification-data-diff", func(t *testing.T) {
+			_, events := subscribe(t, base+"/events?diff=true")
+			request(t, "PUT", base+"/things/urn:example:diff", wot.MediaTypeThingDescription, conformanceTD("urn:example:diff"))
+			request(t, "PATCH", base+"/things/urn:example:diff", wot.MediaTypeMergePatch, map[string]interface{}{"title": "patched"})
+
+			// the created TD is sent in full
+			if created := nextEvent(t, events); created.data["title"] != "example thing" || created.data["security"] == nil {
+				t.Fatalf("unexpected %s data: %v", created.name, created.data)
+			}
+			// the update is sent as a merge patch
+			updated := nextEvent(t, events)
+			if updated.data[wot.KeyThingID] != "urn:example:diff" || updated.data["title"] != "patched" || updated.data["security"] != nil {
+				t.Fatalf("unexpected %s data: %v", updated.name, updated.data)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.assertion, test.test)
+	}
+
+	t.Run("deprecated routes", func(t *testing.T) {
+		// the catch-all OPTIONS route makes the router respond with 405 instead of 404
+		res := request(t, "GET", base+"/td", "", nil)
+		if res.StatusCode < http.StatusBadRequest {
+			t.Fatalf("GET /td: status %d", res.StatusCode)
+		}
+	})
+}
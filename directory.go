@@ -0,0 +1,260 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/notification"
+	"github.com/linksmart/thing-directory/wot"
+	uuid "github.com/satori/go.uuid"
+)
+
+type object = map[string]interface{}
+
+// directoryTD returns the Thing Description of the directory itself, generated from the configuration
+// The interaction affordances follow the Thing Description Directory template of the W3C WoT Discovery, with the terms of
+// TD 1.0 only, as the TDs are validated against the TD 1.0 schema.
+func directoryTD(conf *Config) catalog.ThingDescription {
+	securityDefinitions, security, alternative := directorySecurity(conf)
+	td := catalog.ThingDescription{
+		"@context":            wot.ContextURLTD,
+		"@type":               wot.TypeThingDirectory,
+		wot.KeyThingID:        directoryID(conf.ServiceID),
+		"title":               conf.Description,
+		"base":                conf.HTTP.PublicEndpoint,
+		"support":             SourceCodeRepo,
+		"securityDefinitions": securityDefinitions,
+		"security":            security,
+		"properties": object{
+			"things": directoryListing(conf.HTTP.Conformance),
+		},
+		"actions": directoryActions(),
+		"events":  directoryEvents(conf.HTTP.Conformance),
+	}
+	if Version != "" {
+		td["version"] = object{"instance": Version}
+	}
+	if alternative != "" {
+		addAlternativeForms(td, alternative)
+	}
+	return td
+}
+
+// directoryID returns a URI for the service ID, which is a UUID unless configured otherwise
+func directoryID(serviceID string) string {
+	if _, err := uuid.FromString(serviceID); err == nil {
+		return "urn:uuid:" + serviceID
+	}
+	if u, err := url.Parse(serviceID); err == nil && u.Scheme != "" {
+		return serviceID
+	}
+	return "urn:" + url.PathEscape(serviceID)
+}
+
+// directorySecurity returns the security schemes of the authentication configuration, and the alternative one if any
+// Bearer tokens of the provider are always accepted, Basic Authentication only if enabled. TD 1.0 has no scheme to accept
+// either of them, so Basic Authentication is the alternative of additional forms.
+func directorySecurity(conf *Config) (definitions object, security, alternative string) {
+	auth := conf.HTTP.Auth
+	if !auth.Enabled {
+		return object{"nosec_sc": object{"scheme": "nosec"}}, "nosec_sc", ""
+	}
+
+	definitions = object{
+		"bearer_sc": object{
+			"scheme":        "bearer",
+			"in":            "header",
+			"format":        "jwt",
+			"authorization": auth.ProviderURL,
+		},
+	}
+	if !auth.BasicEnabled {
+		return definitions, "bearer_sc", ""
+	}
+	definitions["basic_sc"] = object{"scheme": "basic", "in": "header"}
+	return definitions, "bearer_sc", "basic_sc"
+}
+
+// addAlternativeForms adds a copy of each form of the interaction affordances, with the alternative security scheme
+func addAlternativeForms(td catalog.ThingDescription, security string) {
+	for _, kind := range []string{"properties", "actions", "events"} {
+		for _, affordance := range td[kind].(object) {
+			forms := affordance.(object)["forms"].([]interface{})
+			for _, f := range forms {
+				alternative := make(object, len(f.(object))+1)
+				for k, v := range f.(object) {
+					alternative[k] = v
+				}
+				alternative["security"] = security
+				forms = append(forms, alternative)
+			}
+			affordance.(object)["forms"] = forms
+		}
+	}
+}
+
+func directoryListing(conformance string) object {
+	listing := object{
+		"description": "Retrieve all Thing Descriptions",
+		"readOnly":    true,
+		"type":        "array",
+	}
+	if conformance == ConformanceWoTDiscovery {
+		listing["uriVariables"] = object{
+			catalog.QueryParamOffset: object{"type": "number", "minimum": 0},
+			catalog.QueryParamLimit:  object{"type": "number", "minimum": 1, "maximum": catalog.MaxPerPage},
+			catalog.QueryParamFormat: object{"type": "string", "enum": []string{catalog.ListingFormatArray, catalog.ListingFormatCollection}},
+		}
+		listing["forms"] = []interface{}{
+			form("GET", "/things{?offset,limit,format}", wot.MediaTypeJSONLD, http.StatusOK),
+		}
+		return listing
+	}
+	listing["forms"] = []interface{}{
+		form("GET", "/things", wot.MediaTypeJSONLD, http.StatusOK),
+	}
+	return listing
+}
+
+func directoryActions() object {
+	id := object{
+		wot.KeyThingID: object{"title": "Thing Description ID", "type": "string", "format": "iri-reference"},
+	}
+	query := object{
+		catalog.QueryParamSearchQuery: object{"type": "string"},
+	}
+	return object{
+		"createThing": object{
+			"description":  "Create a Thing Description with a known ID",
+			"uriVariables": id,
+			"input":        object{"type": "object"},
+			"forms":        []interface{}{form("PUT", "/things/{id}", wot.MediaTypeThingDescription, http.StatusCreated)},
+		},
+		"createAnonymousThing": object{
+			"description": "Create a Thing Description with a system-generated ID, returned in the Location header",
+			"input":       object{"type": "object"},
+			"forms":       []interface{}{form("POST", "/things", wot.MediaTypeThingDescription, http.StatusCreated)},
+		},
+		"retrieveThing": object{
+			"description":  "Retrieve a Thing Description",
+			"uriVariables": id,
+			"output":       object{"type": "object"},
+			"safe":         true,
+			"idempotent":   true,
+			"forms":        []interface{}{form("GET", "/things/{id}", wot.MediaTypeThingDescription, http.StatusOK)},
+		},
+		"updateThing": object{
+			"description":  "Update a Thing Description",
+			"uriVariables": id,
+			"input":        object{"type": "object"},
+			"forms":        []interface{}{form("PUT", "/things/{id}", wot.MediaTypeThingDescription, http.StatusNoContent)},
+		},
+		"partiallyUpdateThing": object{
+			"description":  "Partially update a Thing Description",
+			"uriVariables": id,
+			"input":        object{"type": "object"},
+			"forms":        []interface{}{form("PATCH", "/things/{id}", wot.MediaTypeMergePatch, http.StatusNoContent)},
+		},
+		"deleteThing": object{
+			"description":  "Delete a Thing Description",
+			"uriVariables": id,
+			"idempotent":   true,
+			"forms":        []interface{}{form("DELETE", "/things/{id}", "", http.StatusNoContent)},
+		},
+		"searchJSONPath": object{
+			"description":  "JSONPath syntactic search",
+			"uriVariables": query,
+			"output":       object{"type": "array"},
+			"safe":         true,
+			"idempotent":   true,
+			"forms":        []interface{}{form("GET", "/search/jsonpath{?query}", wot.MediaTypeJSON, http.StatusOK)},
+		},
+		"searchXPath": object{
+			"description":  "XPath syntactic search",
+			"uriVariables": query,
+			"output":       object{"type": "array"},
+			"safe":         true,
+			"idempotent":   true,
+			"forms":        []interface{}{form("GET", "/search/xpath{?query}", wot.MediaTypeJSON, http.StatusOK)},
+		},
+	}
+}
+
+// directoryEvents returns the Server-Sent Events of the /events/{type} paths
+func directoryEvents(conformance string) object {
+	types := []struct {
+		name, description string
+		// path in the default and the wot-discovery conformance mode
+		path, discoveryPath string
+	}{
+		{"thingCreated", "Registration of Thing Descriptions inside the directory", wot.EventTypeCreate, wot.DiscoveryEventCreated},
+		{"thingUpdated", "Updates to Thing Descriptions within the directory", wot.EventTypeUpdate, wot.DiscoveryEventUpdated},
+		{"thingDeleted", "Deletion of Thing Descriptions from the directory, including expiry", wot.EventTypeDelete, wot.DiscoveryEventDeleted},
+	}
+
+	events := make(object)
+	for _, t := range types {
+		path := t.path
+		if conformance == ConformanceWoTDiscovery {
+			path = t.discoveryPath
+		}
+		events[t.name] = object{
+			"description": t.description,
+			"uriVariables": object{
+				"diff": object{"type": "string", "enum": []string{"true", "false", string(notification.DiffMergePatch), string(notification.DiffJSONPatch)}},
+			},
+			"data": object{"type": "object"},
+			"forms": []interface{}{
+				object{
+					"op":          "subscribeevent",
+					"href":        "/events/" + path + "{?diff}",
+					"subprotocol": "sse",
+					"contentType": "text/event-stream",
+					"htv:headers": []interface{}{
+						object{"htv:fieldName": "Last-Event-ID", "description": "ID of the last event for reconnection"},
+					},
+				},
+			},
+		}
+	}
+	return events
+}
+
+// form returns an HTTP form with the method, content type, and status code of a successful response
+func form(method, href, contentType string, status int) object {
+	f := object{
+		"href":           href,
+		"htv:methodName": method,
+		"response": object{
+			"htv:statusCodeValue": status,
+		},
+	}
+	if contentType != "" {
+		f["contentType"] = contentType
+	}
+	if status == http.StatusOK {
+		// only successful retrievals have a response body
+		f["response"].(object)["contentType"] = contentType
+	}
+	return f
+}
+
+// wellKnownHandler serves the TD of the directory
+func wellKnownHandler(td catalog.ThingDescription) http.HandlerFunc {
+	b, err := json.Marshal(td)
+	if err != nil {
+		log.Fatalf("Error serializing the directory TD: %s", err)
+	}
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", wot.MediaTypeThingDescription)
+		_, err := w.Write(b)
+		if err != nil {
+			log.Printf("ERROR writing HTTP response: %s", err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/linksmart/thing-directory/wot"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// the schemas of the TD validation, as configured in the deployments
+var directorySchemaPaths = []string{testSchemaPath, "wot/discovery_schema.json"}
+
+func TestDirectoryTD(t *testing.T) {
+	newConfig := func() *Config {
+		conf := &Config{ServiceID: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", Description: "test directory"}
+		conf.HTTP.PublicEndpoint = "http://example.com:8081"
+		return conf
+	}
+
+	t.Run("metadata", func(t *testing.T) {
+		td := directoryTD(newConfig())
+		if td[wot.KeyThingID] != "urn:uuid:6ba7b810-9dad-11d1-80b4-00c04fd430c8" {
+			t.Fatalf("unexpected id: %v", td[wot.KeyThingID])
+		}
+		if td["base"] != "http://example.com:8081" || td["title"] != "test directory" {
+			t.Fatalf("unexpected base or title: %v, %v", td["base"], td["title"])
+		}
+		for _, action := range []string{"createThing", "createAnonymousThing", "retrieveThing", "updateThing", "partiallyUpdateThing", "deleteThing", "searchJSONPath", "searchXPath"} {
+			if _, found := td["actions"].(object)[action]; !found {
+				t.Fatalf("missing action %s", action)
+			}
+		}
+	})
+
+	t.Run("schema", func(t *testing.T) {
+		var schemas []*gojsonschema.Schema
+		for _, path := range directorySchemaPaths {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("error reading schema: %s", err)
+			}
+			schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(b))
+			if err != nil {
+				t.Fatalf("error loading schema %s: %s", path, err)
+			}
+			schemas = append(schemas, schema)
+		}
+
+		for _, serviceID := range []string{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", "site directory"} {
+			for _, auth := range []string{"none", "bearer", "basic"} {
+				conf := newConfig()
+				conf.ServiceID = serviceID
+				conf.HTTP.Auth.Enabled = auth != "none"
+				conf.HTTP.Auth.ProviderURL = "https://provider-url"
+				conf.HTTP.Auth.BasicEnabled = auth == "basic"
+				for _, conformance := range []string{ConformanceDefault, ConformanceWoTDiscovery} {
+					conf.HTTP.Conformance = conformance
+					td := directoryTD(conf)
+					for i, schema := range schemas {
+						result, err := schema.Validate(gojsonschema.NewGoLoader(td))
+						if err != nil {
+							t.Fatalf("error validating: %s", err)
+						}
+						if !result.Valid() {
+							t.Fatalf("TD of %s with %s auth in conformance mode %q is invalid against %s: %v",
+								serviceID, auth, conformance, directorySchemaPaths[i], result.Errors())
+						}
+					}
+				}
+			}
+		}
+		if id := directoryID("site directory"); id != "urn:site%20directory" {
+			t.Fatalf("unexpected id of a service ID that is not a UUID: %s", id)
+		}
+	})
+
+	t.Run("security", func(t *testing.T) {
+		conf := newConfig()
+		if _, security, _ := directorySecurity(conf); security != "nosec_sc" {
+			t.Fatalf("security %s without auth", security)
+		}
+
+		conf.HTTP.Auth.Enabled = true
+		conf.HTTP.Auth.ProviderURL = "https://provider-url"
+		definitions, security, alternative := directorySecurity(conf)
+		if security != "bearer_sc" || alternative != "" || definitions["bearer_sc"].(object)["authorization"] != "https://provider-url" {
+			t.Fatalf("unexpected bearer security: %s, %v", security, definitions)
+		}
+
+		conf.HTTP.Auth.BasicEnabled = true
+		definitions, security, alternative = directorySecurity(conf)
+		if security != "bearer_sc" || alternative != "basic_sc" || definitions["basic_sc"] == nil {
+			t.Fatalf("unexpected security with Basic Authentication: %s, %s, %v", security, alternative, definitions)
+		}
+		forms := directoryTD(conf)["actions"].(object)["retrieveThing"].(object)["forms"].([]interface{})
+		if len(forms) != 2 || forms[1].(object)["security"] != "basic_sc" || forms[1].(object)["href"] != forms[0].(object)["href"] {
+			t.Fatalf("unexpected forms with Basic Authentication: %v", forms)
+		}
+	})
+
+	t.Run("event paths", func(t *testing.T) {
+		conf := newConfig()
+		href := func() string {
+			event := directoryTD(conf)["events"].(object)["thingCreated"].(object)
+			return event["forms"].([]interface{})[0].(object)["href"].(string)
+		}
+		if h := href(); h != "/events/create{?diff}" {
+			t.Fatalf("unexpected href: %s", h)
+		}
+		conf.HTTP.Conformance = ConformanceWoTDiscovery
+		if h := href(); h != "/events/thing_created{?diff}" {
+			t.Fatalf("unexpected href in the conformance mode: %s", h)
+		}
+	})
+}
@@ -7,14 +7,21 @@ import (
 	"log"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/grandcat/zeroconf"
 	"github.com/linksmart/go-sec/auth/obtainer"
 	sc "github.com/linksmart/service-catalog/v3/catalog"
 	"github.com/linksmart/service-catalog/v3/client"
+	"github.com/linksmart/thing-directory/catalog"
 	"github.com/linksmart/thing-directory/wot"
 )
 
+const (
+	defaultDNSSDBrowseInterval = time.Minute
+	defaultSearchTimeout       = 5 * time.Second
+)
+
 // escape special characters as recommended by https://tools.ietf.org/html/rfc6763#section-4.3
 func escapeDNSSDServiceInstance(instance string) (escaped string) {
 	// replace \ by \\
@@ -24,26 +31,78 @@ func escapeDNSSDServiceInstance(instance string) (escaped string) {
 	return escaped
 }
 
-// register as a DNS-SD Service
-func registerDNSSDService(conf *Config) (func(), error) {
-	instance := escapeDNSSDServiceInstance(conf.DNSSD.Publish.Instance)
-
-	log.Printf("DNS-SD: registering as \"%s.%s.%s\", subtype: %s",
-		instance, wot.DNSSDServiceType, conf.DNSSD.Publish.Domain, wot.DNSSDServiceSubtypeDirectory)
-
+// multicastInterfaces returns the network interfaces with the given names
+func multicastInterfaces(names []string) ([]net.Interface, error) {
 	var ifs []net.Interface
-
-	for _, name := range conf.DNSSD.Publish.Interfaces {
+	for _, name := range names {
 		iface, err := net.InterfaceByName(name)
 		if err != nil {
 			return nil, fmt.Errorf("error finding interface %s: %s", name, err)
 		}
-		if (iface.Flags & net.FlagMulticast) > 0 {
-			ifs = append(ifs, *iface)
-		} else {
+		if (iface.Flags & net.FlagMulticast) == 0 {
 			return nil, fmt.Errorf("interface %s does not support multicast", name)
 		}
-		log.Printf("DNS-SD: will register to interface: %s", name)
+		ifs = append(ifs, *iface)
+	}
+	return ifs, nil
+}
+
+// browse DNS-SD for Things and register their TDs
+func browseDNSSDThings(conf *Config, controller catalog.CatalogController) (*catalog.DNSSDBrowser, error) {
+	ifs, err := multicastInterfaces(conf.DNSSD.Browse.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultDNSSDBrowseInterval
+	if conf.DNSSD.Browse.Interval > 0 {
+		interval = time.Duration(conf.DNSSD.Browse.Interval) * time.Second
+	}
+	domain := conf.DNSSD.Browse.Domain
+	if domain == "" {
+		domain = "local."
+	}
+
+	log.Printf("DNS-SD: browsing for \"%s._sub.%s.%s\" every %s", wot.DNSSDServiceSubtypeThing, wot.DNSSDServiceType, domain, interval)
+	return catalog.NewDNSSDBrowser(controller, domain, ifs, interval), nil
+}
+
+// browse DNS-SD for other directories, in the domain and on the interfaces of the Things browsing
+func browseDNSSDDirectories(conf *Config) (*catalog.DNSSDDirectories, error) {
+	ifs, err := multicastInterfaces(conf.DNSSD.Browse.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	interval := defaultDNSSDBrowseInterval
+	if conf.DNSSD.Browse.Interval > 0 {
+		interval = time.Duration(conf.DNSSD.Browse.Interval) * time.Second
+	}
+	domain := conf.DNSSD.Browse.Domain
+	if domain == "" {
+		domain = "local."
+	}
+	// skip the directory itself
+	var exclude string
+	if conf.DNSSD.Publish.Enabled {
+		exclude = conf.DNSSD.Publish.Instance
+	}
+
+	log.Printf("DNS-SD: browsing for \"%s._sub.%s.%s\" every %s", wot.DNSSDServiceSubtypeDirectory, wot.DNSSDServiceType, domain, interval)
+	return catalog.NewDNSSDDirectories(domain, ifs, interval, exclude), nil
+}
+
+// register as a DNS-SD Service
+func registerDNSSDService(conf *Config) (func(), error) {
+	instance := escapeDNSSDServiceInstance(conf.DNSSD.Publish.Instance)
+
+	log.Printf("DNS-SD: registering as \"%s.%s.%s\", subtype: %s",
+		instance, wot.DNSSDServiceType, conf.DNSSD.Publish.Domain, wot.DNSSDServiceSubtypeDirectory)
+
+	ifs, err := multicastInterfaces(conf.DNSSD.Publish.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifs {
+		log.Printf("DNS-SD: will register to interface: %s", iface.Name)
 	}
 
 	if len(ifs) == 0 {
@@ -55,7 +114,7 @@ func registerDNSSDService(conf *Config) (func(), error) {
 		wot.DNSSDServiceType+","+wot.DNSSDServiceSubtypeDirectory,
 		conf.DNSSD.Publish.Domain,
 		conf.HTTP.BindPort,
-		[]string{"td=/td", "version=" + Version},
+		[]string{"td=" + wot.WellKnownPath, "type=Directory", "version=" + Version},
 		ifs,
 	)
 	if err != nil {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+// gatedDirectory rejects the event subscriptions while closed, to keep a peer from reconnecting
+type gatedDirectory struct {
+	http.Handler
+	closed int32
+}
+
+func (d *gatedDirectory) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&d.closed) == 1 && req.URL.Path == "/events" {
+		http.Error(w, "closed", http.StatusServiceUnavailable)
+		return
+	}
+	d.Handler.ServeHTTP(w, req)
+}
+
+func eventually(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", description)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestFederation(t *testing.T) {
+	// the site keeps only a few events, which are lost during long disconnections
+	siteConfig := &Config{ServiceID: "site", Description: "site directory"}
+	site := &gatedDirectory{Handler: newTestDirectory(t, siteConfig, 3, nil)}
+	siteServer := httptest.NewServer(site)
+	t.Cleanup(siteServer.Close)
+
+	put := func(id string) {
+		t.Helper()
+		expectStatus(t, request(t, http.MethodPut, siteServer.URL+"/things/"+id, wot.MediaTypeThingDescription, conformanceTD(id)), http.StatusCreated)
+	}
+	remove := func(id string) {
+		t.Helper()
+		expectStatus(t, request(t, http.MethodDelete, siteServer.URL+"/things/"+id, "", nil), http.StatusNoContent)
+	}
+	put("urn:example:before")
+
+	federation, err := catalog.NewFederation(catalog.NewMemoryStorage(0),
+		[]catalog.FederationPeer{{Name: "site", URL: siteServer.URL}}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("error starting federation: %s", err)
+	}
+	t.Cleanup(federation.Stop)
+	centralConfig := &Config{ServiceID: "central", Description: "central directory"}
+	central := httptest.NewServer(newTestDirectory(t, centralConfig, 100, federation))
+	t.Cleanup(central.Close)
+
+	mirrored := func(id string) map[string]interface{} {
+		res := request(t, http.MethodGet, central.URL+"/federation/things/site/"+id, "", nil)
+		if res.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		expectStatus(t, res, http.StatusOK)
+		var td map[string]interface{}
+		decode(t, res, &td)
+		return td
+	}
+	peerStatus := func() catalog.PeerStatus {
+		res := request(t, http.MethodGet, central.URL+"/federation/peers", "", nil)
+		expectStatus(t, res, http.StatusOK)
+		var statuses []catalog.PeerStatus
+		decode(t, res, &statuses)
+		if len(statuses) != 1 {
+			t.Fatalf("%d peers instead of 1", len(statuses))
+		}
+		return statuses[0]
+	}
+	// disconnect keeps the federation from following the events until the returned function is called
+	disconnect := func() func() {
+		atomic.StoreInt32(&site.closed, 1)
+		siteServer.CloseClientConnections()
+		eventually(t, "disconnection", func() bool { return !peerStatus().Connected })
+		return func() { atomic.StoreInt32(&site.closed, 0) }
+	}
+	// stored waits for the event of a TD to be stored in the history of the site
+	stored := func(id string) {
+		eventually(t, "event of "+id, func() bool {
+			res := request(t, http.MethodGet, siteServer.URL+"/events/history?per_page=100", "", nil)
+			var page struct {
+				Items []struct {
+					Data map[string]interface{} `json:"data"`
+				} `json:"items"`
+			}
+			decode(t, res, &page)
+			for _, event := range page.Items {
+				if event.Data[wot.KeyThingID] == id {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	t.Run("synchronize on start", func(t *testing.T) {
+		eventually(t, "mirrored TD", func() bool { return mirrored("urn:example:before") != nil })
+		td := mirrored("urn:example:before")
+		if origin := td[wot.KeyThingRegistration].(map[string]interface{})[wot.KeyThingRegistrationOrigin]; origin != "site" {
+			t.Fatalf("origin %v instead of site", origin)
+		}
+		// the mirrored TDs are not part of the local catalog
+		expectStatus(t, request(t, http.MethodGet, central.URL+"/things/urn:example:before", "", nil), http.StatusNotFound)
+	})
+
+	t.Run("create, update, delete", func(t *testing.T) {
+		put("urn:example:created")
+		eventually(t, "created TD", func() bool { return mirrored("urn:example:created") != nil })
+
+		patch := map[string]interface{}{"title": "updated thing"}
+		expectStatus(t, request(t, http.MethodPatch, siteServer.URL+"/things/urn:example:created", wot.MediaTypeMergePatch, patch), http.StatusNoContent)
+		eventually(t, "updated TD", func() bool { return mirrored("urn:example:created")["title"] == "updated thing" })
+		td := mirrored("urn:example:created")
+		if catalog.ThingRevision(catalog.ThingRegistration(td)) != 2 {
+			t.Fatalf("unexpected registration of the updated TD: %v", td[wot.KeyThingRegistration])
+		}
+
+		remove("urn:example:before")
+		eventually(t, "deleted TD", func() bool { return mirrored("urn:example:before") == nil })
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		reconnect := disconnect()
+		put("urn:example:resumed")
+		stored("urn:example:resumed")
+		reconnect()
+
+		eventually(t, "resumed TD", func() bool { return mirrored("urn:example:resumed") != nil })
+		if status := peerStatus(); status.Syncs != 1 {
+			t.Fatalf("%d synchronizations after resuming instead of 1", status.Syncs)
+		}
+	})
+
+	t.Run("resynchronize after gap", func(t *testing.T) {
+		reconnect := disconnect()
+		// more events than kept by the site
+		remove("urn:example:created")
+		for _, id := range []string{"urn:example:gap-1", "urn:example:gap-2", "urn:example:gap-3"} {
+			put(id)
+		}
+		stored("urn:example:gap-3")
+		reconnect()
+
+		eventually(t, "resynchronization", func() bool { return peerStatus().Syncs == 2 })
+		if mirrored("urn:example:created") != nil {
+			t.Fatalf("TD deleted during the gap is still mirrored")
+		}
+		status := peerStatus()
+		if !status.Connected || status.Things != 4 || status.LastEventID == "" {
+			t.Fatalf("unexpected status: %+v", status)
+		}
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/context"
@@ -35,6 +36,8 @@ const (
 	SwaggerUISchemeLess = "linksmart.github.io/swagger-ui/dist"
 	Spec                = "https://raw.githubusercontent.com/linksmart/thing-directory/{version}/apidoc/openapi-spec.yml"
 	SourceCodeRepo      = "https://github.com/linksmart/thing-directory"
+
+	defaultFederationRetryInterval = 5 * time.Second
 )
 
 var (
@@ -85,8 +88,11 @@ func main() {
 	// Setup API storage
 	var storage catalog.Storage
 	switch config.Storage.Type {
+	case catalog.BackendMemory:
+		storage = catalog.NewMemoryStorage(config.Storage.HistorySize)
+		defer storage.Close()
 	case catalog.BackendLevelDB:
-		storage, err = catalog.NewLevelDBStorage(config.Storage.DSN, nil)
+		storage, err = catalog.NewLevelDBStorage(config.Storage.DSN, nil, config.Storage.Indexes, config.Storage.HistorySize)
 		if err != nil {
 			panic("Failed to start LevelDB storage:" + err.Error())
 		}
@@ -99,30 +105,105 @@ func main() {
 	if err != nil {
 		panic("Failed to start the controller:" + err.Error())
 	}
-	defer controller.Stop()
 
 	// Create catalog API object
 	api := catalog.NewHTTPAPI(controller, Version)
 
 	// Start notification
 	var eventQueue notification.EventQueue
-	switch config.Storage.Type {
+	historySize := uint64(notification.DefaultEventQueueCapacity)
+	if config.Notification.HistorySize > 0 {
+		historySize = uint64(config.Notification.HistorySize)
+	}
+	eventQueueType := config.Notification.StorageType
+	if eventQueueType == "" {
+		eventQueueType = config.Storage.Type
+	}
+	switch eventQueueType {
+	case catalog.BackendMemory:
+		eventQueue = notification.NewMemoryEventQueue(historySize)
 	case catalog.BackendLevelDB:
-		eventQueue, err = notification.NewLevelDBEventQueue(config.Storage.DSN+"/sse", nil, 1000)
+		eventQueue, err = notification.NewLevelDBEventQueue(config.Storage.DSN+"/sse", nil, historySize)
 		if err != nil {
 			panic("Failed to start LevelDB storage for SSE events:" + err.Error())
 		}
 		defer eventQueue.Close()
 	default:
-		panic("Could not create SSE storage. Unsupported type:" + config.Storage.Type)
+		panic("Could not create SSE storage. Unsupported type:" + eventQueueType)
 	}
-	notificationController := notification.NewController(eventQueue)
-	notifAPI := notification.NewSSEAPI(notificationController, Version)
+	notificationController := notification.NewController(eventQueue, config.Notification.BufferSize, config.Notification.OverflowPolicy)
+	notifAPI := notification.NewSSEAPI(notificationController, Version, config.HTTP.PublicEndpoint)
+	wsAPI := notification.NewWebSocketAPI(notificationController, config.HTTP.PublicEndpoint)
 	defer notificationController.Stop()
 
+	// Webhook subscriptions, stopped before the notification controller
+	var webhookAPI *notification.WebhookAPI
+	if config.Notification.Webhooks.Enabled {
+		webhookManager, err := notification.NewWebhookManager(notificationController, config.HTTP.PublicEndpoint, config.Storage.DSN+"/webhooks", nil)
+		if err != nil {
+			panic("Failed to start LevelDB storage for webhooks:" + err.Error())
+		}
+		defer webhookManager.Close()
+		webhookAPI = notification.NewWebhookAPI(webhookManager)
+	}
+
 	controller.AddSubscriber(notificationController)
 
-	nRouter, err := setupHTTPRouter(&config.HTTP, api, notifAPI)
+	// Publish events over MQTT
+	if config.MQTT.Publish.Enabled {
+		mqttPublisher, err := notification.NewMQTTPublisher(config.MQTT.Publish, config.HTTP.PublicEndpoint)
+		if err != nil {
+			panic("Failed to start MQTT publisher:" + err.Error())
+		}
+		defer mqttPublisher.Close()
+		controller.AddSubscriber(mqttPublisher)
+	}
+	// stop dispatching events before stopping the listeners
+	defer controller.Stop()
+
+	// Mirror the TDs of peer directories
+	var federation *catalog.Federation
+	if config.Federation.Enabled {
+		var mirrorStorage catalog.Storage
+		switch config.Storage.Type {
+		case catalog.BackendMemory:
+			mirrorStorage = catalog.NewMemoryStorage(0)
+		case catalog.BackendLevelDB:
+			mirrorStorage, err = catalog.NewLevelDBStorage(config.Storage.DSN+"/federation", nil, nil, 0)
+			if err != nil {
+				panic("Failed to start LevelDB storage for federation:" + err.Error())
+			}
+		}
+		defer mirrorStorage.Close()
+		retryInterval := defaultFederationRetryInterval
+		if config.Federation.RetryInterval > 0 {
+			retryInterval = time.Duration(config.Federation.RetryInterval) * time.Second
+		}
+		federation, err = catalog.NewFederation(mirrorStorage, config.Federation.Peers, retryInterval)
+		if err != nil {
+			panic("Failed to start federation:" + err.Error())
+		}
+		defer federation.Stop()
+	}
+
+	// Forward the queries of the federated search scope
+	if config.Federation.Search.Enabled {
+		var directories *catalog.DNSSDDirectories
+		if config.Federation.Search.DNSSD {
+			directories, err = browseDNSSDDirectories(config)
+			if err != nil {
+				panic("Failed to start DNS-SD browsing for directories:" + err.Error())
+			}
+			defer directories.Stop()
+		}
+		timeout := defaultSearchTimeout
+		if config.Federation.Search.Timeout > 0 {
+			timeout = time.Duration(config.Federation.Search.Timeout) * time.Second
+		}
+		api.SetFederatedSearch(catalog.NewFederatedSearch(config.Federation.Search.Peers, directories, timeout))
+	}
+
+	nRouter, err := setupHTTPRouter(&config.HTTP, directoryTD(config), api, notifAPI, wsAPI, webhookAPI, federation)
 	if err != nil {
 		panic(err)
 	}
@@ -153,6 +234,15 @@ func main() {
 		defer shutdown()
 	}
 
+	// Register the Things found using DNS-SD
+	if config.DNSSD.Browse.Enabled {
+		browser, err := browseDNSSDThings(config, controller)
+		if err != nil {
+			panic("Failed to start DNS-SD browsing:" + err.Error())
+		}
+		defer browser.Stop()
+	}
+
 	// Register in the LinkSmart Service Catalog
 	if config.ServiceCatalog.Enabled {
 		unregisterService, err := registerInServiceCatalog(config)
@@ -177,7 +267,7 @@ func main() {
 	log.Println("Shutting down...")
 }
 
-func setupHTTPRouter(config *HTTPConfig, api *catalog.HTTPAPI, notifAPI *notification.SSEAPI) (*negroni.Negroni, error) {
+func setupHTTPRouter(config *HTTPConfig, directory catalog.ThingDescription, api *catalog.HTTPAPI, notifAPI *notification.SSEAPI, wsAPI *notification.WebSocketAPI, webhookAPI *notification.WebhookAPI, federation *catalog.Federation) (*negroni.Negroni, error) {
 
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
@@ -222,34 +312,78 @@ func setupHTTPRouter(config *HTTPConfig, api *catalog.HTTPAPI, notifAPI *notific
 	r.get("/openapi-spec-proxy", commonHandlers.ThenFunc(apiSpecProxy))
 	r.get("/openapi-spec-proxy/{basepath:.+}", commonHandlers.ThenFunc(apiSpecProxy))
 
+	r.get(wot.WellKnownPath, commonHandlers.ThenFunc(wellKnownHandler(directory)))
+
 	// Deprecated: use /things and /search instead
 	// TD CRUD, listing, filtering
-	r.get("/td", commonHandlers.ThenFunc(api.GetMany))
-	r.get("/td-chunked", commonHandlers.ThenFunc(api.GetAll))
-	r.post("/td", commonHandlers.ThenFunc(api.Post))
-	r.get("/td/{id:.+}", commonHandlers.ThenFunc(api.Get))
-	r.put("/td/{id:.+}", commonHandlers.ThenFunc(api.Put))
-	r.patch("/td/{id:.+}", commonHandlers.ThenFunc(api.Patch))
-	r.delete("/td/{id:.+}", commonHandlers.ThenFunc(api.Delete))
+	if config.Conformance != ConformanceWoTDiscovery {
+		r.get("/td", commonHandlers.ThenFunc(api.GetMany))
+		r.get("/td-chunked", commonHandlers.ThenFunc(api.GetAll))
+		r.post("/td", commonHandlers.ThenFunc(api.Post))
+		r.get("/td/{id:.+}", commonHandlers.ThenFunc(api.Get))
+		r.put("/td/{id:.+}", commonHandlers.ThenFunc(api.Put))
+		r.patch("/td/{id:.+}", commonHandlers.ThenFunc(api.Patch))
+		r.delete("/td/{id:.+}", commonHandlers.ThenFunc(api.Delete))
+	}
 
 	// CRUDL
-	r.post("/things", commonHandlers.ThenFunc(api.Post))             // create anonymous
-	r.put("/things/{id:.+}", commonHandlers.ThenFunc(api.Put))       // create or update
-	r.get("/things/{id:.+}", commonHandlers.ThenFunc(api.Get))       // retrieve
-	r.patch("/things/{id:.+}", commonHandlers.ThenFunc(api.Patch))   // partially update
-	r.delete("/things/{id:.+}", commonHandlers.ThenFunc(api.Delete)) // delete
-	r.get("/things", commonHandlers.ThenFunc(api.GetAll))            // listing
+	r.post("/things", commonHandlers.ThenFunc(api.Post))                   // create anonymous
+	r.post("/things/batch", commonHandlers.ThenFunc(api.Batch))            // create, update, delete in batch
+	r.put("/things/{id:.+}", commonHandlers.ThenFunc(api.Put))             // create or update
+	r.get("/things/{id:.+}/history", commonHandlers.ThenFunc(api.History)) // previous revisions
+	r.get("/things/{id:.+}", commonHandlers.ThenFunc(api.Get))             // retrieve
+	r.patch("/things/{id:.+}", commonHandlers.ThenFunc(api.Patch))         // partially update
+	r.delete("/things/{id:.+}", commonHandlers.ThenFunc(api.Delete))       // delete
+	if config.Conformance == ConformanceWoTDiscovery {
+		r.get("/things", commonHandlers.ThenFunc(api.ListThings)) // listing as array or collection
+	} else {
+		r.get("/things", commonHandlers.ThenFunc(api.GetAll)) // listing
+	}
+
+	r.post("/things/{id:.+}/heartbeat", commonHandlers.ThenFunc(api.Heartbeat)) // renew registration
+	r.post("/things/{id:.+}/restore", commonHandlers.ThenFunc(api.Restore))     // restore a previous revision
 
 	// search
 	r.get("/search/jsonpath", commonHandlers.ThenFunc(api.SearchJSONPath))
 	r.get("/search/xpath", commonHandlers.ThenFunc(api.SearchXPath))
+	if config.Conformance == ConformanceWoTDiscovery {
+		r.get("/search/sparql", commonHandlers.ThenFunc(api.SearchSPARQL))
+		r.post("/search/sparql", commonHandlers.ThenFunc(api.SearchSPARQL))
+	}
 
 	// TD validation
 	r.get("/validation", commonHandlers.ThenFunc(api.GetValidation))
 
 	//TD notification
-	r.get("/events", commonHandlers.ThenFunc(notifAPI.SubscribeEvent))
-	r.get("/events/{type}", commonHandlers.ThenFunc(notifAPI.SubscribeEvent))
+	subscribeEvent := notifAPI.SubscribeEvent
+	if config.Conformance == ConformanceWoTDiscovery {
+		subscribeEvent = notifAPI.SubscribeDiscoveryEvent
+	}
+	r.get("/events", commonHandlers.ThenFunc(subscribeEvent))
+	r.get("/events/ws", commonHandlers.ThenFunc(wsAPI.SubscribeEvent))
+	r.get("/events/subscribers", commonHandlers.ThenFunc(notifAPI.GetSubscribers))
+	r.get("/events/history", commonHandlers.ThenFunc(notifAPI.GetHistory))
+	r.get("/events/{type}", commonHandlers.ThenFunc(subscribeEvent))
+
+	// webhook subscriptions
+	if webhookAPI != nil {
+		r.post("/subscriptions", commonHandlers.ThenFunc(webhookAPI.Post))
+		r.get("/subscriptions", commonHandlers.ThenFunc(webhookAPI.GetAll))
+		r.get("/subscriptions/{id}/deadletters", commonHandlers.ThenFunc(webhookAPI.GetDeadLetters))
+		r.get("/subscriptions/{id}", commonHandlers.ThenFunc(webhookAPI.Get))
+		r.delete("/subscriptions/{id}", commonHandlers.ThenFunc(webhookAPI.Delete))
+	}
+
+	// read-only view of the TDs mirrored from the peers
+	if federation != nil {
+		mirrorAPI := catalog.NewHTTPAPI(federation.Controller(), Version)
+		r.get("/federation/peers", commonHandlers.ThenFunc(federation.GetPeers))
+		r.get("/federation/things", commonHandlers.ThenFunc(mirrorAPI.GetAll))
+		// the mirrored TDs are stored by origin and id, i.e. at /federation/things/{origin}/{id}
+		r.get("/federation/things/{id:.+}", commonHandlers.ThenFunc(mirrorAPI.Get))
+		r.get("/federation/search/jsonpath", commonHandlers.ThenFunc(mirrorAPI.SearchJSONPath))
+		r.get("/federation/search/xpath", commonHandlers.ThenFunc(mirrorAPI.SearchXPath))
+	}
 
 	logger := negroni.NewLogger()
 	logFlags := log.LstdFlags
@@ -0,0 +1,77 @@
+package notification
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const (
+	// FormatCloudEvents renders the events as CloudEvents 1.0 in structured JSON mode
+	FormatCloudEvents = "cloudevents"
+
+	MediaTypeCloudEvents = "application/cloudevents+json"
+
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsTypePrefix  = "org.w3.wot.td."
+)
+
+// CloudEvent is the CloudEvents 1.0 representation of an Event
+type CloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            string      `json:"time,omitempty"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// validateFormat accepts the empty (default) format and the CloudEvents format
+func validateFormat(format string) error {
+	if format != "" && format != FormatCloudEvents {
+		return fmt.Errorf("unsupported format: %s", format)
+	}
+	return nil
+}
+
+// acceptsCloudEvents checks whether the CloudEvents media type is in the Accept header
+func acceptsCloudEvents(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.Split(mediaRange, ";")[0])
+		if strings.EqualFold(mediaType, MediaTypeCloudEvents) {
+			return true
+		}
+	}
+	return false
+}
+
+// CloudEvent renders the event with the given source, i.e. the public endpoint of the directory
+func (e Event) CloudEvent(source string) CloudEvent {
+	subject, _ := e.Data[wot.KeyThingID].(string)
+	var t string
+	if !e.Time.IsZero() {
+		t = e.Time.Format(time.RFC3339Nano)
+	}
+	return CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              e.ID,
+		Source:          source,
+		Type:            cloudEventsTypePrefix + string(e.Type),
+		Subject:         subject,
+		Time:            t,
+		DataContentType: wot.MediaTypeJSON,
+		Data:            e.payload(),
+	}
+}
+
+// render returns the event in the given format, for the transports that send whole events
+func (e Event) render(format, source string) interface{} {
+	if format == FormatCloudEvents {
+		return e.CloudEvent(source)
+	}
+	return e
+}
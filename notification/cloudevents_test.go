@@ -0,0 +1,85 @@
+package notification
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+func TestCloudEvent(t *testing.T) {
+	event := Event{ID: "1f", Type: wot.EventTypeCreate, Data: catalog.ThingDescription{wot.KeyThingID: "urn:example:1"}}
+
+	ce := event.CloudEvent("http://localhost:8081")
+	expected := CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              "1f",
+		Source:          "http://localhost:8081",
+		Type:            "org.w3.wot.td.create",
+		Subject:         "urn:example:1",
+		DataContentType: "application/json",
+		Data:            event.Data,
+	}
+	b1, _ := json.Marshal(ce)
+	b2, _ := json.Marshal(expected)
+	if string(b1) != string(b2) {
+		t.Fatalf("got %s, expected %s", b1, b2)
+	}
+
+	tests := map[string]bool{
+		"application/cloudevents+json":                          true,
+		"text/event-stream, application/cloudevents+json;q=0.9": true,
+		"text/event-stream":                                     false,
+		"":                                                      false,
+	}
+	for accept, expected := range tests {
+		if acceptsCloudEvents(accept) != expected {
+			t.Errorf("%s: expected %t", accept, expected)
+		}
+	}
+}
+
+func TestSSECloudEvents(t *testing.T) {
+	controller := setupController(t)
+	server := httptest.NewServer(http.HandlerFunc(NewSSEAPI(controller, "", "http://localhost:8081").SubscribeEvent))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?format=cloudevents", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error subscribing: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+
+	// the subscription is registered once the response headers are sent
+	go controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:1"})
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ce CloudEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ce); err != nil {
+			t.Fatalf("error decoding data: %s", err)
+		}
+		if ce.SpecVersion != "1.0" || ce.Type != "org.w3.wot.td.create" || ce.Subject != "urn:example:1" || ce.ID == "" {
+			t.Fatalf("unexpected CloudEvent: %+v", ce)
+		}
+		return
+	}
+	t.Fatalf("no event received: %v", scanner.Err())
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/linksmart/thing-directory/catalog"
@@ -16,42 +18,55 @@ type Controller struct {
 	Notifier chan Event
 
 	// New client connections
-	subscribingClients chan subscriber
+	subscribingClients chan *subscriber
 
 	// Closed client connections
 	unsubscribingClients chan chan Event
 
 	// Client connections registry
-	activeClients map[chan Event]subscriber
+	activeClients map[chan Event]*subscriber
+
+	// Requests for the metrics of the subscribers
+	metricsRequests chan chan []SubscriberMetrics
+
+	// buffer size and overflow policy of each subscriber
+	bufferSize     int
+	overflowPolicy OverflowPolicy
+	lastID         uint64
 
 	// shutdown
 	shutdown chan bool
 }
 
-type subscriber struct {
-	client      chan Event
-	eventTypes  []wot.EventType
-	diff        bool
-	lastEventID string
-}
-
-func NewController(s EventQueue) *Controller {
+// NewController creates the notification controller
+// Zero values of bufferSize and overflowPolicy are replaced by the defaults.
+func NewController(s EventQueue, bufferSize int, overflowPolicy OverflowPolicy) *Controller {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	if overflowPolicy == "" {
+		overflowPolicy = DefaultOverflowPolicy
+	}
 	c := &Controller{
 		s:                    s,
 		Notifier:             make(chan Event, 1),
-		subscribingClients:   make(chan subscriber),
+		subscribingClients:   make(chan *subscriber),
 		unsubscribingClients: make(chan chan Event),
-		activeClients:        make(map[chan Event]subscriber),
+		activeClients:        make(map[chan Event]*subscriber),
+		metricsRequests:      make(chan chan []SubscriberMetrics),
+		bufferSize:           bufferSize,
+		overflowPolicy:       overflowPolicy,
 		shutdown:             make(chan bool),
 	}
 	go c.handler()
 	return c
 }
 
-func (c *Controller) subscribe(client chan Event, eventTypes []wot.EventType, diff bool, lastEventID string) error {
-	s := subscriber{client: client,
+func (c *Controller) subscribe(client chan Event, eventTypes []wot.EventType, diff DiffMode, filter *eventFilter, lastEventID string) error {
+	s := &subscriber{client: client,
 		eventTypes:  eventTypes,
 		diff:        diff,
+		filter:      filter,
 		lastEventID: lastEventID,
 	}
 	c.subscribingClients <- s
@@ -63,22 +78,33 @@ func (c *Controller) unsubscribe(client chan Event) error {
 	return nil
 }
 
+func (c *Controller) metrics() []SubscriberMetrics {
+	res := make(chan []SubscriberMetrics)
+	c.metricsRequests <- res
+	return <-res
+}
+
+func (c *Controller) latestEventID() (string, error) {
+	return c.s.getLatestID()
+}
+
 func (c *Controller) storeAndNotify(event Event) error {
 	var err error
 	event.ID, err = c.s.getNewID()
 	if err != nil {
 		return fmt.Errorf("error generating ID : %v", err)
 	}
+	event.Time = time.Now().UTC()
 
-	// Notify
-	c.Notifier <- event
-
-	// Store
+	// Store before notifying, so that the notified events can be replayed
+	// Events failing to be stored are not notified, as they are passed again by the catalog controller.
 	err = c.s.addRotate(event)
 	if err != nil {
 		return fmt.Errorf("error storing the notification : %v", err)
 	}
 
+	// Notify
+	c.Notifier <- event
 	return nil
 }
 
@@ -114,9 +140,24 @@ func (c *Controller) UpdateHandler(old catalog.ThingDescription, new catalog.Thi
 		return fmt.Errorf("error unmarshalling the patch TD")
 	}
 	td[wot.KeyThingID] = old[wot.KeyThingID]
+
+	operations, err := createJSONPatch(oldJson, newJson)
+	if err != nil {
+		return fmt.Errorf("error creating the JSON patch: %s", err)
+	}
+	previousRevision := catalog.ThingRevision(catalog.ThingRegistration(old))
+	if previousRevision != 0 {
+		// the patch fails on a different revision of the TD
+		test := PatchOperation{Op: "test", Path: "/" + wot.KeyThingRegistration + "/" + wot.KeyThingRegistrationRevision, Value: previousRevision}
+		operations = append([]PatchOperation{test}, operations...)
+	}
+
 	event := Event{
-		Type: wot.EventTypeUpdate,
-		Data: td,
+		Type:             wot.EventTypeUpdate,
+		Data:             td,
+		TD:               new,
+		Patch:            operations,
+		PreviousRevision: previousRevision,
 	}
 	err = c.storeAndNotify(event)
 	return err
@@ -129,16 +170,38 @@ func (c *Controller) DeleteHandler(old catalog.ThingDescription) error {
 	event := Event{
 		Type: wot.EventTypeDelete,
 		Data: deleted,
+		TD:   old,
+	}
+	err := c.storeAndNotify(event)
+	return err
+}
+
+func (c *Controller) ExpireHandler(old catalog.ThingDescription) error {
+	expired := catalog.ThingDescription{
+		wot.KeyThingID: old[wot.KeyThingID],
+	}
+	event := Event{
+		Type: wot.EventTypeExpire,
+		Data: expired,
+		TD:   old,
 	}
 	err := c.storeAndNotify(event)
 	return err
 }
 
 func (c *Controller) handler() {
+	ticker := time.NewTicker(controllerReplayInterval)
+	defer ticker.Stop()
 loop:
 	for {
 		select {
 		case s := <-c.subscribingClients:
+			c.lastID++
+			s.id = c.lastID
+			s.since = time.Now().UTC()
+			s.queue = make(chan Event, c.bufferSize)
+			s.lastQueuedID = s.lastEventID
+			go s.forward()
 			c.activeClients[s.client] = s
 			log.Printf("New subscription. %d active clients", len(c.activeClients))
 
@@ -149,18 +212,55 @@ loop:
 					log.Printf("error getting the events after ID %s: %s", s.lastEventID, err)
 					continue loop
 				}
+				s.replayed = make(map[string]bool, len(missedEvents))
 				for _, event := range missedEvents {
-					sendToSubscriber(s, event)
+					c.enqueue(s, event)
+					if s.lagging || c.activeClients[s.client] != s {
+						break
+					}
+					s.replayed[event.ID] = true
 				}
 			}
 		case clientChan := <-c.unsubscribingClients:
-			delete(c.activeClients, clientChan)
-			close(clientChan)
+			// the subscriber may already be disconnected
+			if s, found := c.activeClients[clientChan]; found {
+				c.remove(s)
+			}
 			log.Printf("Unsubscribed. %d active clients", len(c.activeClients))
 		case event := <-c.Notifier:
 			for _, s := range c.activeClients {
-				sendToSubscriber(s, event)
+				if s.lagging {
+					// replay once the buffer is drained, the event is included if already stored
+					if len(s.queue) > 0 {
+						continue
+					}
+					c.replay(s)
+					if s.lagging {
+						continue
+					}
+				}
+				if s.replayed != nil {
+					// stored events may also be pending in the Notifier while replaying
+					if s.replayed[event.ID] {
+						continue
+					}
+					s.replayed = nil
+				}
+				c.enqueue(s, event)
+			}
+		case <-ticker.C:
+			for _, s := range c.activeClients {
+				if s.lagging && len(s.queue) == 0 {
+					c.replay(s)
+				}
+			}
+		case res := <-c.metricsRequests:
+			metrics := make([]SubscriberMetrics, 0, len(c.activeClients))
+			for _, s := range c.activeClients {
+				metrics = append(metrics, s.metrics())
 			}
+			sort.Slice(metrics, func(i, j int) bool { return metrics[i].ID < metrics[j].ID })
+			res <- metrics
 		case <-c.shutdown:
 			log.Println("Shutting down notification controller")
 			break loop
@@ -168,17 +268,3 @@ loop:
 	}
 
 }
-
-func sendToSubscriber(s subscriber, event Event) {
-	for _, eventType := range s.eventTypes {
-		// Send the notification if the type matches
-		if eventType == event.Type {
-			toSend := event
-			if !s.diff {
-				toSend.Data = catalog.ThingDescription{wot.KeyThingID: toSend.Data[wot.KeyThingID]}
-			}
-			s.client <- toSend
-			break
-		}
-	}
-}
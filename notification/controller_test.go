@@ -0,0 +1,149 @@
+package notification
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+func setupController(t *testing.T) *Controller {
+	return setupControllerWithPolicy(t, 0, "")
+}
+
+func setupControllerWithPolicy(t *testing.T, bufferSize int, policy OverflowPolicy) *Controller {
+	queue, err := NewLevelDBEventQueue(t.TempDir(), nil, 100)
+	if err != nil {
+		t.Fatalf("error creating event queue: %s", err)
+	}
+	controller := NewController(queue, bufferSize, policy)
+	t.Cleanup(func() {
+		controller.Stop()
+		queue.Close()
+	})
+	return controller
+}
+
+func TestEventFilter(t *testing.T) {
+	td := catalog.ThingDescription{wot.KeyThingID: "urn:example:1", "@type": "saref:TemperatureSensor", "title": "example"}
+
+	tests := []struct {
+		jsonPath, xPath string
+		match           bool
+	}{
+		{`$[?(@['@type']=='saref:TemperatureSensor')]`, "", true},
+		{`$[?(@.title=='other')]`, "", false},
+		{"", `*[title='example']`, true},
+		{"", `*[title='other']`, false},
+	}
+	for _, test := range tests {
+		f, err := newEventFilter(test.jsonPath, test.xPath)
+		if err != nil {
+			t.Fatalf("%s%s: %s", test.jsonPath, test.xPath, err)
+		}
+		match, err := f.matches(td)
+		if err != nil {
+			t.Fatalf("%s%s: %s", test.jsonPath, test.xPath, err)
+		}
+		if match != test.match {
+			t.Errorf("%s%s: got %t, expected %t", test.jsonPath, test.xPath, match, test.match)
+		}
+	}
+
+	for _, queries := range [][2]string{{"$[?(", ""}, {"", "*["}, {"$", "*"}} {
+		if _, err := newEventFilter(queries[0], queries[1]); err == nil {
+			t.Errorf("expected error for %v", queries)
+		}
+	}
+	if f, err := newEventFilter("", ""); f != nil || err != nil {
+		t.Errorf("expected no filter without queries")
+	}
+}
+
+func TestControllerFilter(t *testing.T) {
+	controller := setupController(t)
+
+	sensor := catalog.ThingDescription{wot.KeyThingID: "urn:example:sensor", "@type": "saref:TemperatureSensor"}
+	other := catalog.ThingDescription{wot.KeyThingID: "urn:example:other", "@type": "saref:Light"}
+
+	filter, err := newEventFilter(`$[?(@['@type']=='saref:TemperatureSensor')]`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allTypes := []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete}
+
+	receive := func(t *testing.T, client chan Event, n int) []Event {
+		var events []Event
+		for len(events) < n {
+			select {
+			case event := <-client:
+				if event.TD != nil {
+					t.Fatalf("TD for filtering was sent: %v", event)
+				}
+				events = append(events, event)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout after receiving %d events", len(events))
+			}
+		}
+		return events
+	}
+	expect := func(t *testing.T, events []Event) {
+		expected := []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete}
+		for i, event := range events {
+			if event.Type != expected[i] || event.Data[wot.KeyThingID] != sensor[wot.KeyThingID] {
+				t.Fatalf("unexpected event %d: %v", i, event)
+			}
+		}
+	}
+
+	t.Run("live", func(t *testing.T) {
+		client := make(chan Event)
+		controller.subscribe(client, allTypes, DiffNone, filter, "")
+		defer controller.unsubscribe(client)
+
+		go func() {
+			controller.CreateHandler(other)
+			controller.CreateHandler(sensor)
+			controller.UpdateHandler(sensor, catalog.ThingDescription{wot.KeyThingID: "urn:example:sensor", "@type": "saref:TemperatureSensor", "title": "new"})
+			controller.DeleteHandler(other)
+			// matched with the deleted TD
+			controller.DeleteHandler(sensor)
+		}()
+		expect(t, receive(t, client, 3))
+	})
+
+	t.Run("replayed", func(t *testing.T) {
+		client := make(chan Event)
+		go controller.subscribe(client, allTypes, DiffNone, filter, "0")
+		defer controller.unsubscribe(client)
+
+		expect(t, receive(t, client, 3))
+	})
+}
+
+func TestControllerStoreError(t *testing.T) {
+	queue := &failingEventQueue{EventQueue: NewMemoryEventQueue(10), failing: true}
+	controller := NewController(queue, 0, "")
+	defer controller.Stop()
+
+	client := make(chan Event)
+	controller.subscribe(client, []wot.EventType{wot.EventTypeCreate}, DiffNone, nil, "")
+	defer controller.unsubscribe(client)
+
+	// the event is not notified, as it is passed again once the storage recovers
+	if err := controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:1"}); err == nil {
+		t.Fatalf("no error storing the event")
+	}
+	queue.failing = false
+	go controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:2"})
+
+	select {
+	case event := <-client:
+		if event.Data[wot.KeyThingID] != "urn:example:2" {
+			t.Fatalf("notified the event that failed to be stored: %v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for the event")
+	}
+}
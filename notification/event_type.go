@@ -1 +1,34 @@
 package notification
+
+import (
+	"fmt"
+
+	"github.com/linksmart/thing-directory/wot"
+)
+
+// discoveryEventName returns the name of the event type in the W3C WoT Discovery
+// Expiry is a kind of deletion and has no name of its own.
+func discoveryEventName(eventType wot.EventType) string {
+	switch eventType {
+	case wot.EventTypeCreate:
+		return wot.DiscoveryEventCreated
+	case wot.EventTypeUpdate:
+		return wot.DiscoveryEventUpdated
+	case wot.EventTypeDelete, wot.EventTypeExpire:
+		return wot.DiscoveryEventDeleted
+	}
+	return string(eventType)
+}
+
+// parseDiscoveryEventName returns the event type with the given name in the W3C WoT Discovery
+func parseDiscoveryEventName(name string) (wot.EventType, error) {
+	switch name {
+	case wot.DiscoveryEventCreated:
+		return wot.EventTypeCreate, nil
+	case wot.DiscoveryEventUpdated:
+		return wot.EventTypeUpdate, nil
+	case wot.DiscoveryEventDeleted:
+		return wot.EventTypeDelete, nil
+	}
+	return "", fmt.Errorf("invalid event type: %s", name)
+}
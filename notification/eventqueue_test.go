@@ -0,0 +1,149 @@
+package notification
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+func TestEventQueue(t *testing.T) {
+	const capacity = 5
+
+	queues := map[string]func(t *testing.T) EventQueue{
+		catalog.BackendMemory: func(t *testing.T) EventQueue {
+			return NewMemoryEventQueue(capacity)
+		},
+		catalog.BackendLevelDB: func(t *testing.T) EventQueue {
+			queue, err := NewLevelDBEventQueue(t.TempDir(), nil, capacity)
+			if err != nil {
+				t.Fatalf("error creating event queue: %s", err)
+			}
+			return queue
+		},
+	}
+
+	// add stores n events with new IDs
+	add := func(t *testing.T, queue EventQueue, n int) {
+		for i := 0; i < n; i++ {
+			id, err := queue.getNewID()
+			if err != nil {
+				t.Fatalf("error creating ID: %s", err)
+			}
+			if err := queue.addRotate(Event{ID: id, Type: wot.EventTypeCreate}); err != nil {
+				t.Fatalf("error adding event: %s", err)
+			}
+		}
+	}
+	ids := func(events []Event) (ids string) {
+		for _, e := range events {
+			ids += e.ID + ","
+		}
+		return ids
+	}
+
+	for name, newQueue := range queues {
+		t.Run(name, func(t *testing.T) {
+			t.Run("replay", func(t *testing.T) {
+				queue := newQueue(t)
+				defer queue.Close()
+				add(t, queue, 3)
+
+				events, err := queue.getAllAfter("1")
+				if err != nil {
+					t.Fatalf("error getting events: %s", err)
+				}
+				if ids(events) != "2,3," {
+					t.Fatalf("unexpected events: %s", ids(events))
+				}
+				if latest, _ := queue.getLatestID(); latest != "3" {
+					t.Fatalf("latest ID %s instead of 3", latest)
+				}
+			})
+
+			t.Run("rotation", func(t *testing.T) {
+				queue := newQueue(t)
+				defer queue.Close()
+				add(t, queue, capacity+11)
+
+				// the oldest available events are replayed if the requested one is gone
+				events, err := queue.getAllAfter("0")
+				if err != nil {
+					t.Fatalf("error getting events: %s", err)
+				}
+				if ids(events) != "c,d,e,f,10," {
+					t.Fatalf("unexpected events: %s", ids(events))
+				}
+			})
+
+			t.Run("concurrent IDs", func(t *testing.T) {
+				queue := newQueue(t)
+				defer queue.Close()
+
+				const goroutines, n = 10, 100
+				var wg sync.WaitGroup
+				created := make(chan string, goroutines*n)
+				for g := 0; g < goroutines; g++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; i < n; i++ {
+							id, _ := queue.getNewID()
+							created <- id
+						}
+					}()
+				}
+				wg.Wait()
+				close(created)
+				unique := make(map[string]bool)
+				for id := range created {
+					unique[id] = true
+				}
+				if len(unique) != goroutines*n {
+					t.Fatalf("%d unique IDs instead of %d", len(unique), goroutines*n)
+				}
+			})
+
+			t.Run("out of order", func(t *testing.T) {
+				queue := newQueue(t)
+				defer queue.Close()
+				for _, id := range []string{"1", "3", "2"} {
+					if err := queue.addRotate(Event{ID: id}); err != nil {
+						t.Fatalf("error adding event: %s", err)
+					}
+				}
+				events, _ := queue.getAllAfter("0")
+				if ids(events) != "1,2,3," {
+					t.Fatalf("unexpected events: %s", ids(events))
+				}
+			})
+		})
+	}
+}
+
+func TestControllerMemoryEventQueue(t *testing.T) {
+	controller := NewController(NewMemoryEventQueue(100), 0, "")
+	defer controller.Stop()
+
+	for i := 0; i < 3; i++ {
+		controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:" + strconv.Itoa(i)})
+	}
+
+	// missed events are replayed from memory
+	client := make(chan Event)
+	go controller.subscribe(client, []wot.EventType{wot.EventTypeCreate}, DiffNone, nil, "1")
+	defer controller.unsubscribe(client)
+	for _, id := range []string{"2", "3"} {
+		select {
+		case event := <-client:
+			if event.ID != id {
+				t.Fatalf("event %s instead of %s", event.ID, id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for event %s", id)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package notification
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	xpath "github.com/antchfx/jsonquery"
+	jsonpath "github.com/bhmj/jsonslice"
+	"github.com/linksmart/thing-directory/catalog"
+)
+
+// eventFilter selects events by their TD
+// As in the search API, the query is evaluated on an array, which here holds only the TD of the event.
+type eventFilter struct {
+	jsonPath string
+	xPath    string
+}
+
+// newEventFilter returns nil if no query is given
+func newEventFilter(jsonPath, xPath string) (*eventFilter, error) {
+	if jsonPath == "" && xPath == "" {
+		return nil, nil
+	}
+	if jsonPath != "" && xPath != "" {
+		return nil, fmt.Errorf("only one of jsonpath or xpath filters is allowed")
+	}
+	f := &eventFilter{jsonPath: jsonPath, xPath: xPath}
+	// check the syntax
+	if _, err := f.matches(catalog.ThingDescription{}); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *eventFilter) matches(td catalog.ThingDescription) (bool, error) {
+	b, err := json.Marshal([]catalog.ThingDescription{td})
+	if err != nil {
+		return false, fmt.Errorf("error serializing TD for filtering: %s", err)
+	}
+
+	if f.jsonPath != "" {
+		res, err := jsonpath.Get(b, f.jsonPath)
+		if err != nil {
+			return false, fmt.Errorf("error evaluating jsonpath: %s", err)
+		}
+		res = bytes.TrimSpace(res)
+		return len(res) > 0 && string(res) != "[]" && string(res) != "null", nil
+	}
+
+	doc, err := xpath.Parse(bytes.NewReader(b))
+	if err != nil {
+		return false, fmt.Errorf("error parsing serialized TD for xpath filtering: %s", err)
+	}
+	nodes, err := xpath.QueryAll(doc, f.xPath)
+	if err != nil {
+		return false, fmt.Errorf("error evaluating xpath: %s", err)
+	}
+	return len(nodes) > 0, nil
+}
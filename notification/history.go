@@ -0,0 +1,180 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/linksmart/service-catalog/v3/utils"
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+const (
+	QueryParamSince = "since"
+	QueryParamUntil = "until"
+	QueryParamThing = "thing"
+
+	// DefaultEventQueueCapacity is the number of events kept in history by default
+	DefaultEventQueueCapacity = 1000
+)
+
+// EventHistoryPage is a page of stored events, oldest first
+type EventHistoryPage struct {
+	Items   []Event `json:"items"`
+	Page    int     `json:"page"`
+	PerPage int     `json:"perPage"`
+	Total   int     `json:"total"`
+	Next    string  `json:"next,omitempty"`
+}
+
+// historyQuery selects stored events. Since and until are either event IDs or timestamps.
+type historyQuery struct {
+	sinceID    string
+	sinceTime  time.Time
+	untilID    string
+	untilTime  time.Time
+	eventTypes []wot.EventType
+	thing      string
+}
+
+// parseHistoryQuery parses the since, until, type, and thing query parameters
+// Since is exclusive for IDs, as Last-Event-ID. Since and until are inclusive for timestamps, and until is inclusive for IDs.
+func parseHistoryQuery(form url.Values) (historyQuery, error) {
+	var q historyQuery
+	if since := form.Get(QueryParamSince); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			q.sinceTime = t
+		} else {
+			q.sinceID = since
+		}
+	}
+	if until := form.Get(QueryParamUntil); until != "" {
+		if t, err := time.Parse(time.RFC3339, until); err == nil {
+			q.untilTime = t
+		} else {
+			q.untilID = until
+		}
+	}
+	if eventType := form.Get(QueryParamType); eventType != "" {
+		t := wot.EventType(eventType)
+		if !t.IsValid() {
+			return q, fmt.Errorf("invalid event type: %s", eventType)
+		}
+		q.eventTypes = []wot.EventType{t}
+		// as with subscriptions
+		if t == wot.EventTypeDelete {
+			q.eventTypes = append(q.eventTypes, wot.EventTypeExpire)
+		}
+	}
+	q.thing = form.Get(QueryParamThing)
+	return q, nil
+}
+
+func (q historyQuery) matches(event Event) bool {
+	if !q.sinceTime.IsZero() && event.Time.Before(q.sinceTime) {
+		return false
+	}
+	if !q.untilTime.IsZero() && event.Time.After(q.untilTime) {
+		return false
+	}
+	if q.eventTypes != nil {
+		found := false
+		for _, t := range q.eventTypes {
+			found = found || t == event.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.thing != "" && event.Data[wot.KeyThingID] != q.thing {
+		return false
+	}
+	return true
+}
+
+// history returns the stored events matching the query, oldest first
+func (c *Controller) history(q historyQuery) ([]Event, error) {
+	after := q.sinceID
+	if after == "" {
+		after = "0"
+	}
+	if _, err := strconv.ParseUint(after, 16, 64); err != nil {
+		return nil, &catalog.BadRequestError{S: fmt.Sprintf("invalid event ID %s: %s", after, err)}
+	}
+	events, err := c.s.getAllAfter(after)
+	if err != nil {
+		return nil, fmt.Errorf("error getting the events after %s: %s", after, err)
+	}
+
+	results := []Event{}
+	for _, event := range events {
+		if q.matches(event) {
+			event.TD = nil
+			results = append(results, event)
+		}
+		if q.untilID != "" && event.ID == q.untilID {
+			break
+		}
+	}
+	return results, nil
+}
+
+// GetHistory returns the stored events as pages
+func (a *SSEAPI) GetHistory(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	q, err := parseHistoryQuery(req.Form)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, perPage, err := utils.ParsePagingParams(req.Form.Get(catalog.QueryParamPage), req.Form.Get(catalog.QueryParamPerPage), catalog.MaxPerPage)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
+
+	events, err := a.controller.history(q)
+	if err != nil {
+		switch err.(type) {
+		case *catalog.BadRequestError:
+			catalog.ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		default:
+			catalog.ErrorResponse(w, http.StatusInternalServerError, "Error retrieving the events:", err.Error())
+			return
+		}
+	}
+
+	offset, limit, err := utils.GetPagingAttr(len(events), page, perPage, catalog.MaxPerPage)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, "Unable to paginate:", err.Error())
+		return
+	}
+	coll := EventHistoryPage{
+		Items:   events[offset : offset+limit],
+		Page:    page,
+		PerPage: perPage,
+		Total:   len(events),
+	}
+	if offset+limit < len(events) {
+		query := req.URL.Query()
+		query.Set(catalog.QueryParamPage, strconv.Itoa(page+1))
+		coll.Next = req.URL.Path + "?" + query.Encode()
+	}
+
+	b, err := json.Marshal(coll)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
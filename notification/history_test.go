@@ -0,0 +1,137 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+func TestHistory(t *testing.T) {
+	controller := setupController(t)
+
+	td1 := catalog.ThingDescription{wot.KeyThingID: "urn:example:1", "title": "one"}
+	td2 := catalog.ThingDescription{wot.KeyThingID: "urn:example:2", "title": "two"}
+	controller.CreateHandler(td1)
+	controller.CreateHandler(td2)
+	controller.UpdateHandler(td1, catalog.ThingDescription{wot.KeyThingID: "urn:example:1", "title": "uno"})
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	controller.ExpireHandler(td2)
+	controller.DeleteHandler(td1)
+
+	api := NewSSEAPI(controller, "", "")
+	get := func(t *testing.T, query url.Values) (int, EventHistoryPage) {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/events/history?"+query.Encode(), nil)
+		api.GetHistory(res, req)
+		var page EventHistoryPage
+		if res.Code == http.StatusOK {
+			if err := json.Unmarshal(res.Body.Bytes(), &page); err != nil {
+				t.Fatalf("error decoding page: %s", err)
+			}
+		}
+		return res.Code, page
+	}
+	ids := func(page EventHistoryPage) (ids string) {
+		for _, event := range page.Items {
+			ids += event.ID
+			if event.TD != nil {
+				t.Errorf("event %s includes the TD", event.ID)
+			}
+			if event.Time.IsZero() {
+				t.Errorf("event %s has no time", event.ID)
+			}
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		expected string
+	}{
+		{"all", url.Values{}, "12345"},
+		{"since id", url.Values{"since": {"2"}}, "345"},
+		{"until id", url.Values{"until": {"3"}}, "123"},
+		{"since time", url.Values{"since": {middle.Format(time.RFC3339Nano)}}, "45"},
+		{"until time", url.Values{"until": {middle.Format(time.RFC3339Nano)}}, "123"},
+		{"type", url.Values{"type": {"create"}}, "12"},
+		{"delete type includes expire", url.Values{"type": {"delete"}}, "45"},
+		{"thing", url.Values{"thing": {"urn:example:1"}}, "135"},
+		{"thing and type", url.Values{"thing": {"urn:example:1"}, "type": {"update"}}, "3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, page := get(t, test.query)
+			if code != http.StatusOK {
+				t.Fatalf("status %d", code)
+			}
+			if ids(page) != test.expected || page.Total != len(test.expected) {
+				t.Fatalf("got %s (total %d), expected %s", ids(page), page.Total, test.expected)
+			}
+		})
+	}
+
+	t.Run("paging", func(t *testing.T) {
+		_, page := get(t, url.Values{"per_page": {"2"}, "page": {"2"}})
+		if ids(page) != "34" || page.Total != 5 || page.Next == "" {
+			t.Fatalf("unexpected page: %+v", page)
+		}
+		_, page = get(t, url.Values{"per_page": {"2"}, "page": {"3"}})
+		if ids(page) != "5" || page.Next != "" {
+			t.Fatalf("unexpected page: %+v", page)
+		}
+	})
+
+	t.Run("bad type", func(t *testing.T) {
+		if code, _ := get(t, url.Values{"type": {"foo"}}); code != http.StatusBadRequest {
+			t.Fatalf("status %d instead of 400", code)
+		}
+	})
+
+	t.Run("bad since id", func(t *testing.T) {
+		if code, _ := get(t, url.Values{"since": {"foo"}}); code != http.StatusBadRequest {
+			t.Fatalf("status %d instead of 400", code)
+		}
+	})
+}
+
+// failingEventQueue is an event queue failing to store and read the events while failing is set
+type failingEventQueue struct {
+	EventQueue
+	failing bool
+}
+
+func (q *failingEventQueue) addRotate(event Event) error {
+	if q.failing {
+		return fmt.Errorf("storage failure")
+	}
+	return q.EventQueue.addRotate(event)
+}
+
+func (q *failingEventQueue) getAllAfter(id string) ([]Event, error) {
+	if q.failing {
+		return nil, fmt.Errorf("storage failure")
+	}
+	return q.EventQueue.getAllAfter(id)
+}
+
+func TestHistoryStorageError(t *testing.T) {
+	controller := NewController(&failingEventQueue{EventQueue: NewMemoryEventQueue(10), failing: true}, 0, "")
+	defer controller.Stop()
+	api := NewSSEAPI(controller, "", "")
+
+	res := httptest.NewRecorder()
+	api.GetHistory(res, httptest.NewRequest(http.MethodGet, "/events/history?since=1", nil))
+	if res.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d instead of 500", res.Code)
+	}
+}
@@ -0,0 +1,174 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DiffMode selects the payload of the update events
+type DiffMode string
+
+const (
+	// DiffNone sends only the ID of the TDs
+	DiffNone DiffMode = ""
+	// DiffMergePatch sends the created TDs and the JSON Merge Patch (RFC7396) of the updates
+	DiffMergePatch DiffMode = "mergepatch"
+	// DiffJSONPatch sends the created TDs and the JSON Patch (RFC6902) of the updates
+	DiffJSONPatch DiffMode = "jsonpatch"
+)
+
+// parseDiffMode parses the diff query parameter
+// For backward compatibility, true selects the merge patch and unknown values select no diff.
+func parseDiffMode(value string) DiffMode {
+	switch {
+	case strings.EqualFold(value, "true"), strings.EqualFold(value, string(DiffMergePatch)):
+		return DiffMergePatch
+	case strings.EqualFold(value, string(DiffJSONPatch)):
+		return DiffJSONPatch
+	default:
+		return DiffNone
+	}
+}
+
+func (m DiffMode) IsValid() bool {
+	switch m {
+	case DiffNone, DiffMergePatch, DiffJSONPatch:
+		return true
+	}
+	return false
+}
+
+// MarshalJSON encodes the merge patch mode as true, as before diff modes were introduced
+func (m DiffMode) MarshalJSON() ([]byte, error) {
+	switch m {
+	case DiffNone:
+		return []byte("false"), nil
+	case DiffMergePatch:
+		return []byte("true"), nil
+	}
+	return json.Marshal(string(m))
+}
+
+// UnmarshalJSON decodes a boolean or the name of a mode
+func (m *DiffMode) UnmarshalJSON(b []byte) error {
+	var diff bool
+	if err := json.Unmarshal(b, &diff); err == nil {
+		*m = DiffNone
+		if diff {
+			*m = DiffMergePatch
+		}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("diff must be a boolean or a string")
+	}
+	*m = DiffMode(s)
+	if !m.IsValid() {
+		return fmt.Errorf("unsupported diff mode: %s", s)
+	}
+	return nil
+}
+
+// PatchOperation is a JSON Patch (RFC6902) operation
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON omits the value of remove operations, but not the null values of the others
+func (op PatchOperation) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type operation PatchOperation
+	return json.Marshal(operation(op))
+}
+
+// JSONPatchData is the data of update events in the JSON Patch diff mode
+type JSONPatchData struct {
+	ID               interface{}      `json:"id"`
+	PreviousRevision uint64           `json:"previousRevision,omitempty"`
+	Patch            []PatchOperation `json:"patch"`
+}
+
+// createJSONPatch returns the operations that transform the old into the new JSON document
+// Arrays are compared by index, which is correct but not always minimal.
+func createJSONPatch(oldJSON, newJSON []byte) ([]PatchOperation, error) {
+	var oldDoc, newDoc interface{}
+	if err := json.Unmarshal(oldJSON, &oldDoc); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(newJSON, &newDoc); err != nil {
+		return nil, err
+	}
+	return diffJSON(nil, "", oldDoc, newDoc), nil
+}
+
+func diffJSON(patch []PatchOperation, path string, oldValue, newValue interface{}) []PatchOperation {
+	switch o := oldValue.(type) {
+	case map[string]interface{}:
+		n, ok := newValue.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(o)+len(n))
+		for k := range o {
+			keys = append(keys, k)
+		}
+		for k := range n {
+			if _, found := o[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			oldChild, inOld := o[k]
+			newChild, inNew := n[k]
+			childPath := path + "/" + escapePointer(k)
+			switch {
+			case !inNew:
+				patch = append(patch, PatchOperation{Op: "remove", Path: childPath})
+			case !inOld:
+				patch = append(patch, PatchOperation{Op: "add", Path: childPath, Value: newChild})
+			default:
+				patch = diffJSON(patch, childPath, oldChild, newChild)
+			}
+		}
+		return patch
+	case []interface{}:
+		n, ok := newValue.([]interface{})
+		if !ok {
+			break
+		}
+		i := 0
+		for ; i < len(o) && i < len(n); i++ {
+			patch = diffJSON(patch, path+"/"+strconv.Itoa(i), o[i], n[i])
+		}
+		for j := i; j < len(n); j++ {
+			patch = append(patch, PatchOperation{Op: "add", Path: path + "/-", Value: n[j]})
+		}
+		// remove from the end, to not shift the indices
+		for j := len(o) - 1; j >= i; j-- {
+			patch = append(patch, PatchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(j)})
+		}
+		return patch
+	}
+	if !reflect.DeepEqual(oldValue, newValue) {
+		patch = append(patch, PatchOperation{Op: "replace", Path: path, Value: newValue})
+	}
+	return patch
+}
+
+// escapePointer escapes a key as a JSON Pointer (RFC6901) reference token
+func escapePointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
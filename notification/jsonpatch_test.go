@@ -0,0 +1,129 @@
+package notification
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+func TestCreateJSONPatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{"replace", `{"a":1,"b":"x"}`, `{"a":2,"b":"x"}`},
+		{"add and remove", `{"a":1}`, `{"b":{"c":true}}`},
+		{"set to null", `{"a":1,"b":[1,2]}`, `{"a":null,"b":[1,null]}`},
+		{"array elements", `{"a":[{"x":1},{"x":2},3]}`, `{"a":[{"x":1},{"x":3}]}`},
+		{"array append", `{"a":[1]}`, `{"a":[1,2,3]}`},
+		{"type change", `{"a":[1]}`, `{"a":{"b":1}}`},
+		{"escaped keys", `{"a/b":1,"c~d":2}`, `{"a/b":3}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			operations, err := createJSONPatch([]byte(test.old), []byte(test.new))
+			if err != nil {
+				t.Fatalf("error creating patch: %s", err)
+			}
+			b, _ := json.Marshal(operations)
+			patch, err := jsonpatch.DecodePatch(b)
+			if err != nil {
+				t.Fatalf("invalid patch %s: %s", b, err)
+			}
+			patched, err := patch.Apply([]byte(test.old))
+			if err != nil {
+				t.Fatalf("error applying patch %s: %s", b, err)
+			}
+			var got, expected interface{}
+			json.Unmarshal(patched, &got)
+			json.Unmarshal([]byte(test.new), &expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("patch %s gave %s instead of %s", b, patched, test.new)
+			}
+		})
+	}
+}
+
+func TestDiffModeJSON(t *testing.T) {
+	tests := map[string]DiffMode{
+		`false`:       DiffNone,
+		`true`:        DiffMergePatch,
+		`"jsonpatch"`: DiffJSONPatch,
+	}
+	for value, expected := range tests {
+		var m DiffMode
+		if err := json.Unmarshal([]byte(value), &m); err != nil || m != expected {
+			t.Fatalf("%s: got %q (%v), expected %q", value, m, err, expected)
+		}
+		if b, _ := json.Marshal(m); string(b) != value {
+			t.Fatalf("%q encoded as %s instead of %s", m, b, value)
+		}
+	}
+	var m DiffMode
+	if err := json.Unmarshal([]byte(`"other"`), &m); err == nil {
+		t.Fatalf("expected an error for an unsupported mode")
+	}
+}
+
+func TestControllerJSONPatch(t *testing.T) {
+	controller := setupController(t)
+
+	revision := func(r float64) map[string]interface{} {
+		return map[string]interface{}{wot.KeyThingRegistrationRevision: r}
+	}
+	old := catalog.ThingDescription{wot.KeyThingID: "urn:example:1", "title": "old", "tags": []interface{}{"a", "b"}, wot.KeyThingRegistration: revision(1)}
+	new := catalog.ThingDescription{wot.KeyThingID: "urn:example:1", "title": "new", "tags": []interface{}{"a"}, wot.KeyThingRegistration: revision(2)}
+
+	jsonPatchClient := make(chan Event)
+	controller.subscribe(jsonPatchClient, []wot.EventType{wot.EventTypeUpdate}, DiffJSONPatch, nil, "")
+	defer controller.unsubscribe(jsonPatchClient)
+	mergePatchClient := make(chan Event)
+	controller.subscribe(mergePatchClient, []wot.EventType{wot.EventTypeUpdate}, DiffMergePatch, nil, "")
+	defer controller.unsubscribe(mergePatchClient)
+
+	go controller.UpdateHandler(old, new)
+
+	receive := func(client chan Event) Event {
+		select {
+		case event := <-client:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for the event")
+		}
+		return Event{}
+	}
+
+	event := receive(jsonPatchClient)
+	if len(event.Data) != 1 || event.PreviousRevision != 1 || event.Patch[0].Op != "test" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	// the patch applies to the cached copy of the previous revision only
+	b, _ := json.Marshal(event.payload().(JSONPatchData).Patch)
+	patch, err := jsonpatch.DecodePatch(b)
+	if err != nil {
+		t.Fatalf("invalid patch %s: %s", b, err)
+	}
+	oldJSON, _ := json.Marshal(old)
+	patched, err := patch.Apply(oldJSON)
+	if err != nil {
+		t.Fatalf("error applying patch %s: %s", b, err)
+	}
+	var got catalog.ThingDescription
+	json.Unmarshal(patched, &got)
+	if got["title"] != "new" || len(got["tags"].([]interface{})) != 1 {
+		t.Fatalf("patched TD: %s", patched)
+	}
+	if _, err := patch.Apply(patched); err == nil {
+		t.Fatalf("patch applied to another revision")
+	}
+
+	event = receive(mergePatchClient)
+	if event.Patch != nil || event.PreviousRevision != 0 || event.Data["title"] != "new" {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+}
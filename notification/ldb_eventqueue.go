@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
@@ -61,8 +62,8 @@ func (s *LevelDBEventQueue) addRotate(event Event) error {
 	batch.Put(uint64ToByte(uintID), bytes)
 
 	// cleanup the older data
-	if s.latestID > s.capacity {
-		cleanBefore := s.latestID - s.capacity + 1 // adding 1 as Range is  is not inclusive the limit.
+	if latestID := atomic.LoadUint64(&s.latestID); latestID > s.capacity {
+		cleanBefore := latestID - s.capacity + 1 // adding 1 as Range is  is not inclusive the limit.
 		iter := s.db.NewIterator(&util.Range{Limit: uint64ToByte(cleanBefore)}, nil)
 		for iter.Next() {
 			// log.Println("deleting older entry: ", byteToUint64(iter.Key()))
@@ -110,8 +111,11 @@ func (s *LevelDBEventQueue) getAllAfter(id string) ([]Event, error) {
 }
 
 func (s *LevelDBEventQueue) getNewID() (string, error) {
-	s.latestID += 1
-	return strconv.FormatUint(s.latestID, 16), nil
+	return strconv.FormatUint(atomic.AddUint64(&s.latestID, 1), 16), nil
+}
+
+func (s *LevelDBEventQueue) getLatestID() (string, error) {
+	return strconv.FormatUint(atomic.LoadUint64(&s.latestID), 16), nil
 }
 
 func (s *LevelDBEventQueue) Close() {
@@ -0,0 +1,99 @@
+package notification
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// In-memory event queue
+// The latest events are kept in a ring buffer, ordered by their IDs. The events are lost on restart.
+type MemoryEventQueue struct {
+	sync.RWMutex
+	// ring buffer of the events, starting at head
+	events []memoryQueueEntry
+	head   int
+	size   int
+	// the last ID created by getNewID
+	latestID uint64
+}
+
+type memoryQueueEntry struct {
+	id    uint64
+	event Event
+}
+
+// NewMemoryEventQueue creates an event queue that keeps up to capacity events
+func NewMemoryEventQueue(capacity uint64) EventQueue {
+	if capacity == 0 {
+		capacity = 1
+	}
+	return &MemoryEventQueue{
+		events: make([]memoryQueueEntry, capacity),
+	}
+}
+
+// index returns the position of the i-th oldest event in the ring
+func (s *MemoryEventQueue) index(i int) int {
+	return (s.head + i) % len(s.events)
+}
+
+func (s *MemoryEventQueue) addRotate(event Event) error {
+	id, err := strconv.ParseUint(event.ID, 16, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing event ID: %w", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.size == len(s.events) {
+		// overwrite the oldest event
+		s.head = s.index(1)
+		s.size--
+	}
+	// events with concurrently created IDs may be added out of order
+	i := s.size
+	for ; i > 0 && s.events[s.index(i-1)].id > id; i-- {
+		s.events[s.index(i)] = s.events[s.index(i-1)]
+	}
+	s.events[s.index(i)] = memoryQueueEntry{id, event}
+	s.size++
+	return nil
+}
+
+func (s *MemoryEventQueue) getAllAfter(id string) ([]Event, error) {
+	intID, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing latest ID: %w", err)
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	// as LevelDBEventQueue, start with the oldest available event if the requested one is gone
+	var events []Event
+	for i := 0; i < s.size; i++ {
+		if entry := s.events[s.index(i)]; entry.id > intID {
+			events = append(events, entry.event)
+		}
+	}
+	return events, nil
+}
+
+func (s *MemoryEventQueue) getNewID() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.latestID++
+	return strconv.FormatUint(s.latestID, 16), nil
+}
+
+func (s *MemoryEventQueue) getLatestID() (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return strconv.FormatUint(s.latestID, 16), nil
+}
+
+func (s *MemoryEventQueue) Close() {}
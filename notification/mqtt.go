@@ -0,0 +1,227 @@
+package notification
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	mqttClientIDPrefix     = "TD-"
+	mqttDefaultTopicPrefix = "td/"
+	mqttWaitTimeout        = 5 * time.Second
+	mqttMaxRetryInterval   = 10 * time.Minute
+)
+
+// MQTTConf configures the publishing of events to an MQTT broker
+// The events are published to <topicPrefix><event>/<id>, e.g. td/create/urn:example:1234
+type MQTTConf struct {
+	Enabled     bool   `json:"enabled"`
+	BrokerURI   string `json:"brokerURI"`
+	TopicPrefix string `json:"topicPrefix"`
+	QoS         byte   `json:"qos"`
+	// retain the create and update events, cleared on deletion. The create event is cleared on update.
+	Retained bool   `json:"retained"`
+	Format   string `json:"format"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	CaFile   string `json:"caFile,omitempty"`   // trusted CA certificates file path
+	CertFile string `json:"certFile,omitempty"` // client certificate file path
+	KeyFile  string `json:"keyFile,omitempty"`  // client private key file path
+}
+
+func (c MQTTConf) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.BrokerURI == "" {
+		return fmt.Errorf("brokerURI not defined")
+	}
+	_, err := url.Parse(c.BrokerURI)
+	if err != nil {
+		return err
+	}
+	if c.QoS > 2 {
+		return fmt.Errorf("QoS must be 0, 1, or 2")
+	}
+	if strings.ContainsAny(c.TopicPrefix, "+#") {
+		return fmt.Errorf("topicPrefix must not contain wildcards")
+	}
+	if err := validateFormat(c.Format); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c MQTTConf) pahoOptions() (*paho.ClientOptions, error) {
+	opts := paho.NewClientOptions()
+	opts.AddBroker(c.BrokerURI)
+	opts.SetClientID(mqttClientIDPrefix + uuid.NewV4().String())
+
+	if c.Username != "" {
+		opts.SetUsername(c.Username)
+	}
+	if c.Password != "" {
+		opts.SetPassword(c.Password)
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.CaFile != "" {
+		pemCerts, err := ioutil.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf("no certificates found in CA file")
+		}
+	}
+	if c.CertFile != "" && c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client keypair: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	opts.SetTLSConfig(tlsConfig)
+
+	return opts, nil
+}
+
+// MQTTPublisher publishes the events of the catalog controller to an MQTT broker
+// The events have no IDs, as they are not taken from the event queue. CloudEvents get random IDs.
+type MQTTPublisher struct {
+	conf   MQTTConf
+	client paho.Client
+	// source of the CloudEvents, i.e. the public endpoint
+	source string
+}
+
+// NewMQTTPublisher connects to the broker in the background, retrying until connected
+func NewMQTTPublisher(conf MQTTConf, source string) (*MQTTPublisher, error) {
+	if conf.TopicPrefix == "" {
+		conf.TopicPrefix = mqttDefaultTopicPrefix
+	}
+	opts, err := conf.pahoOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts.SetOnConnectHandler(func(paho.Client) {
+		log.Printf("MQTT: %s: Connected.", conf.BrokerURI)
+	})
+	opts.SetConnectionLostHandler(func(_ paho.Client, err error) {
+		log.Printf("MQTT: %s: Disconnected: %s", conf.BrokerURI, err)
+	})
+
+	p := &MQTTPublisher{
+		conf:   conf,
+		client: paho.NewClient(opts),
+		source: source,
+	}
+	go p.connect()
+	return p, nil
+}
+
+func (p *MQTTPublisher) connect() {
+	for interval := 5 * time.Second; ; {
+		token := p.client.Connect()
+		if token.WaitTimeout(mqttWaitTimeout) && token.Error() == nil {
+			return
+		}
+		log.Printf("MQTT: %s: Error connecting: %v. Retry in %v", p.conf.BrokerURI, token.Error(), interval)
+		time.Sleep(interval)
+		if interval *= 2; interval > mqttMaxRetryInterval {
+			interval = mqttMaxRetryInterval
+		}
+	}
+}
+
+// Close disconnects from the broker
+func (p *MQTTPublisher) Close() {
+	p.client.Disconnect(uint(mqttWaitTimeout / time.Millisecond))
+}
+
+func (p *MQTTPublisher) CreateHandler(new catalog.ThingDescription) error {
+	return p.publish(Event{Type: wot.EventTypeCreate, Data: new}, p.conf.Retained)
+}
+
+// UpdateHandler publishes the whole new TD, so that retained messages reflect the current catalog
+// The retained create message is cleared, to not deliver the original TD to new subscribers.
+func (p *MQTTPublisher) UpdateHandler(old catalog.ThingDescription, new catalog.ThingDescription) error {
+	err := p.publish(Event{Type: wot.EventTypeUpdate, Data: new}, p.conf.Retained)
+	if err != nil || !p.conf.Retained {
+		return err
+	}
+	id, _ := new[wot.KeyThingID].(string)
+	return p.send(p.topic(wot.EventTypeCreate, id), true, []byte{})
+}
+
+func (p *MQTTPublisher) DeleteHandler(old catalog.ThingDescription) error {
+	return p.removed(wot.EventTypeDelete, old)
+}
+
+func (p *MQTTPublisher) ExpireHandler(old catalog.ThingDescription) error {
+	return p.removed(wot.EventTypeExpire, old)
+}
+
+func (p *MQTTPublisher) removed(eventType wot.EventType, old catalog.ThingDescription) error {
+	err := p.publish(Event{Type: eventType, Data: catalog.ThingDescription{wot.KeyThingID: old[wot.KeyThingID]}}, false)
+	if err != nil || !p.conf.Retained {
+		return err
+	}
+	// an empty retained message clears the retained message of the topic
+	id, _ := old[wot.KeyThingID].(string)
+	for _, t := range []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate} {
+		err = p.send(p.topic(t, id), true, []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *MQTTPublisher) publish(event Event, retained bool) error {
+	event.Time = time.Now().UTC()
+	if p.conf.Format == FormatCloudEvents {
+		event.ID = uuid.NewV4().String()
+	}
+	payload, err := json.Marshal(event.render(p.conf.Format, p.source))
+	if err != nil {
+		return fmt.Errorf("error serializing event: %s", err)
+	}
+	id, _ := event.Data[wot.KeyThingID].(string)
+	return p.send(p.topic(event.Type, id), retained, payload)
+}
+
+// send returns the errors, so that the event is retried by the outbox of the catalog controller
+// The publisher has its own dispatcher in the outbox, waiting for the broker does not delay the other listeners.
+func (p *MQTTPublisher) send(topic string, retained bool, payload []byte) error {
+	if !p.client.IsConnectionOpen() {
+		return fmt.Errorf("not connected to %s", p.conf.BrokerURI)
+	}
+	token := p.client.Publish(topic, p.conf.QoS, retained, payload)
+	if !token.WaitTimeout(mqttWaitTimeout) {
+		return fmt.Errorf("timeout publishing to %s", topic)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("error publishing to %s: %s", topic, token.Error())
+	}
+	return nil
+}
+
+// topic escapes the topic level separator and wildcards in the id
+func (p *MQTTPublisher) topic(eventType wot.EventType, id string) string {
+	id = strings.NewReplacer("%", "%25", "/", "%2F", "+", "%2B", "#", "%23").Replace(id)
+	return p.conf.TopicPrefix + string(eventType) + "/" + id
+}
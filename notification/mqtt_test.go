@@ -0,0 +1,152 @@
+package notification
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+// set to a broker URI, e.g. tcp://localhost:1883, to test against a broker
+const envMQTTTestBroker = "TD_MQTT_TEST_BROKER"
+
+type message struct {
+	topic    string
+	retained bool
+	payload  []byte
+}
+
+// fakeMQTTClient records the published messages
+type fakeMQTTClient struct {
+	paho.Client
+	disconnected bool
+	messages     []message
+}
+
+func (c *fakeMQTTClient) IsConnectionOpen() bool { return !c.disconnected }
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (doneToken) Error() error                   { return nil }
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	c.messages = append(c.messages, message{topic, retained, payload.([]byte)})
+	return doneToken{}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	client := &fakeMQTTClient{}
+	p := &MQTTPublisher{
+		conf:   MQTTConf{TopicPrefix: "td/", Retained: true},
+		client: client,
+	}
+	td := catalog.ThingDescription{wot.KeyThingID: "urn:example/a+b", "title": "example"}
+
+	p.CreateHandler(td)
+	p.UpdateHandler(td, catalog.ThingDescription{wot.KeyThingID: "urn:example/a+b", "title": "updated"})
+	p.ExpireHandler(td)
+
+	expected := []struct {
+		topic    string
+		retained bool
+		event    wot.EventType
+		title    interface{}
+	}{
+		{"td/create/urn:example%2Fa%2Bb", true, wot.EventTypeCreate, "example"},
+		{"td/update/urn:example%2Fa%2Bb", true, wot.EventTypeUpdate, "updated"},
+		{"td/create/urn:example%2Fa%2Bb", true, "", nil},
+		{"td/expire/urn:example%2Fa%2Bb", false, wot.EventTypeExpire, nil},
+		{"td/create/urn:example%2Fa%2Bb", true, "", nil},
+		{"td/update/urn:example%2Fa%2Bb", true, "", nil},
+	}
+	if len(client.messages) != len(expected) {
+		t.Fatalf("published %d messages instead of %d", len(client.messages), len(expected))
+	}
+	for i, e := range expected {
+		m := client.messages[i]
+		if m.topic != e.topic || m.retained != e.retained {
+			t.Errorf("message %d: got %s (retained: %t), expected %s (retained: %t)", i, m.topic, m.retained, e.topic, e.retained)
+		}
+		if e.event == "" {
+			if len(m.payload) != 0 {
+				t.Errorf("message %d: expected empty payload, got %s", i, m.payload)
+			}
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(m.payload, &event); err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		if event.Type != e.event || event.Data["title"] != e.title || event.Data[wot.KeyThingID] != td[wot.KeyThingID] {
+			t.Errorf("message %d: unexpected event: %v", i, event)
+		}
+	}
+}
+
+func TestMQTTPublisherDisconnected(t *testing.T) {
+	client := &fakeMQTTClient{disconnected: true}
+	p := &MQTTPublisher{
+		conf:   MQTTConf{TopicPrefix: "td/"},
+		client: client,
+	}
+
+	// the error is returned to be retried by the outbox, without waiting for the broker
+	if err := p.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:1"}); err == nil {
+		t.Fatalf("no error publishing while disconnected")
+	}
+	if len(client.messages) != 0 {
+		t.Fatalf("published %d messages while disconnected", len(client.messages))
+	}
+}
+
+func TestMQTTPublisherWithBroker(t *testing.T) {
+	broker := os.Getenv(envMQTTTestBroker)
+	if broker == "" {
+		t.Skipf("%s is not set", envMQTTTestBroker)
+	}
+
+	conf := MQTTConf{Enabled: true, BrokerURI: broker, TopicPrefix: "td-test/", QoS: 1}
+	p, err := NewMQTTPublisher(conf, "http://localhost")
+	if err != nil {
+		t.Fatalf("error creating publisher: %s", err)
+	}
+	defer p.Close()
+
+	opts, _ := conf.pahoOptions()
+	subscriber := paho.NewClient(opts)
+	if token := subscriber.Connect(); token.WaitTimeout(mqttWaitTimeout) && token.Error() != nil {
+		t.Fatalf("error connecting: %s", token.Error())
+	}
+	defer subscriber.Disconnect(0)
+
+	received := make(chan string, 10)
+	token := subscriber.Subscribe("td-test/#", 1, func(_ paho.Client, m paho.Message) {
+		received <- m.Topic()
+	})
+	if token.WaitTimeout(mqttWaitTimeout) && token.Error() != nil {
+		t.Fatalf("error subscribing: %s", token.Error())
+	}
+
+	// wait for the publisher to connect
+	for start := time.Now(); !p.client.IsConnected(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > mqttWaitTimeout {
+			t.Fatalf("publisher not connected")
+		}
+	}
+
+	p.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:1"})
+	select {
+	case topic := <-received:
+		if topic != "td-test/create/urn:example:1" {
+			t.Fatalf("received on unexpected topic: %s", topic)
+		}
+	case <-time.After(mqttWaitTimeout):
+		t.Fatalf("timeout waiting for message")
+	}
+}
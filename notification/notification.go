@@ -1,6 +1,8 @@
 package notification
 
 import (
+	"time"
+
 	"github.com/linksmart/thing-directory/catalog"
 	"github.com/linksmart/thing-directory/wot"
 )
@@ -9,16 +11,56 @@ type Event struct {
 	ID   string                   `json:"id"`
 	Type wot.EventType            `json:"event"`
 	Data catalog.ThingDescription `json:"data"`
+	// Time is when the event occurred
+	Time time.Time `json:"time"`
+	// Patch is the JSON Patch of updates, sent in the JSON Patch diff mode
+	Patch []PatchOperation `json:"patch,omitempty"`
+	// PreviousRevision is the revision of the TD the patch applies to
+	PreviousRevision uint64 `json:"previousRevision,omitempty"`
+	// TD is the whole TD for filtering, i.e. the new TD of updates and the old TD of deletes and expiries
+	// It is stored along with the event, but not sent to the subscribers.
+	TD catalog.ThingDescription `json:"td,omitempty"`
+}
+
+// filterTD returns the TD to evaluate the subscriber filters with
+func (e Event) filterTD() catalog.ThingDescription {
+	if e.TD != nil {
+		return e.TD
+	}
+	// the data of creations is the whole TD
+	return e.Data
+}
+
+// payload returns the data of the event as sent over SSE and in CloudEvents
+func (e Event) payload() interface{} {
+	if e.Patch != nil {
+		return JSONPatchData{
+			ID:               e.Data[wot.KeyThingID],
+			PreviousRevision: e.PreviousRevision,
+			Patch:            e.Patch,
+		}
+	}
+	return e.Data
 }
 
 // NotificationController interface
 type NotificationController interface {
 	// subscribe to the events. the caller will get events through the channel 'client' starting from 'lastEventID'
-	subscribe(client chan Event, eventTypes []wot.EventType, diff bool, lastEventID string) error
+	// the events are filtered by their TD if a filter is given
+	subscribe(client chan Event, eventTypes []wot.EventType, diff DiffMode, filter *eventFilter, lastEventID string) error
 
 	// unsubscribe and close the channel 'client'
 	unsubscribe(client chan Event) error
 
+	// metrics returns the state of the subscribers
+	metrics() []SubscriberMetrics
+
+	// latestEventID returns the ID of the latest event, for subscribing from the current point later on
+	latestEventID() (string, error)
+
+	// history returns the stored events matching the query
+	history(q historyQuery) ([]Event, error)
+
 	// Stop the controller
 	Stop()
 
@@ -36,6 +78,9 @@ type EventQueue interface {
 	// getNewID creates a new ID for the event
 	getNewID() (string, error)
 
+	// getLatestID returns the last ID created by getNewID
+	getLatestID() (string, error)
+
 	// Close all the resources acquired by the queue implementation
 	Close()
 }
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/linksmart/thing-directory/catalog"
@@ -13,17 +12,22 @@ import (
 )
 
 const (
-	QueryParamType    = "type"
-	QueryParamFull    = "diff"
-	HeaderLastEventID = "Last-Event-ID"
+	QueryParamType     = "type"
+	QueryParamFull     = "diff"
+	QueryParamJSONPath = "jsonpath"
+	QueryParamXPath    = "xpath"
+	QueryParamFormat   = "format"
+	HeaderLastEventID  = "Last-Event-ID"
 )
 
 type SSEAPI struct {
 	controller  NotificationController
 	contentType string
+	// source of the CloudEvents, i.e. the public endpoint
+	source string
 }
 
-func NewSSEAPI(controller NotificationController, version string) *SSEAPI {
+func NewSSEAPI(controller NotificationController, version, source string) *SSEAPI {
 	contentType := "text/event-stream"
 	if version != "" {
 		contentType += ";version=" + version
@@ -31,17 +35,35 @@ func NewSSEAPI(controller NotificationController, version string) *SSEAPI {
 	return &SSEAPI{
 		controller:  controller,
 		contentType: contentType,
+		source:      source,
 	}
 
 }
 
 func (a *SSEAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
-	diff, err := parseQueryParameters(req)
+	eventTypes, err := parsePath(req)
 	if err != nil {
 		catalog.ErrorResponse(w, http.StatusBadRequest, err)
 		return
 	}
-	eventTypes, err := parsePath(req)
+	a.stream(w, req, eventTypes, func(eventType wot.EventType) string {
+		return string(eventType)
+	})
+}
+
+// SubscribeDiscoveryEvent streams the events with the types and names of the W3C WoT Discovery, e.g. thing_created
+func (a *SSEAPI) SubscribeDiscoveryEvent(w http.ResponseWriter, req *http.Request) {
+	eventTypes, err := parseDiscoveryPath(req)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	a.stream(w, req, eventTypes, discoveryEventName)
+}
+
+// stream sends the events of the given types, naming them with the given function
+func (a *SSEAPI) stream(w http.ResponseWriter, req *http.Request, eventTypes []wot.EventType, eventName func(wot.EventType) string) {
+	diff, filter, format, err := parseQueryParameters(req)
 	if err != nil {
 		catalog.ErrorResponse(w, http.StatusBadRequest, err)
 		return
@@ -56,7 +78,7 @@ func (a *SSEAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
 	messageChan := make(chan Event)
 
 	lastEventID := req.Header.Get(HeaderLastEventID)
-	a.controller.subscribe(messageChan, eventTypes, diff, lastEventID)
+	a.controller.subscribe(messageChan, eventTypes, diff, filter, lastEventID)
 
 	go func() {
 		<-req.Context().Done()
@@ -64,13 +86,20 @@ func (a *SSEAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
 		a.controller.unsubscribe(messageChan)
 	}()
 
+	// send the headers right away, to confirm the subscription
+	flusher.Flush()
+
 	for event := range messageChan {
-		//data, err := json.MarshalIndent(event.Data, "data: ", "")
-		data, err := json.Marshal(event.Data)
+		var data []byte
+		if format == FormatCloudEvents {
+			data, err = json.Marshal(event.CloudEvent(a.source))
+		} else {
+			data, err = json.Marshal(event.payload())
+		}
 		if err != nil {
 			log.Printf("error marshaling event %v: %s", event, err)
 		}
-		fmt.Fprintf(w, "event: %s\n", event.Type)
+		fmt.Fprintf(w, "event: %s\n", eventName(event.Type))
 		fmt.Fprintf(w, "id: %s\n", event.ID)
 		fmt.Fprintf(w, "data: %s\n\n", data)
 
@@ -78,14 +107,38 @@ func (a *SSEAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func parseQueryParameters(req *http.Request) (bool, error) {
-	diff := false
+// GetSubscribers returns the metrics of the active subscribers
+func (a *SSEAPI) GetSubscribers(w http.ResponseWriter, req *http.Request) {
+	b, err := json.Marshal(a.controller.metrics())
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
+
+func parseQueryParameters(req *http.Request) (DiffMode, *eventFilter, string, error) {
 	req.ParseForm()
 	// Parse diff or just ID
-	if strings.EqualFold(req.Form.Get(QueryParamFull), "true") {
-		diff = true
+	diff := parseDiffMode(req.Form.Get(QueryParamFull))
+	// Parse the content-based filter
+	filter, err := newEventFilter(req.Form.Get(QueryParamJSONPath), req.Form.Get(QueryParamXPath))
+	if err != nil {
+		return diff, nil, "", err
+	}
+	// Parse the format of the data, also selectable by the Accept header
+	format := req.Form.Get(QueryParamFormat)
+	if err := validateFormat(format); err != nil {
+		return diff, nil, "", err
 	}
-	return diff, nil
+	if format == "" && acceptsCloudEvents(req.Header.Get("Accept")) {
+		format = FormatCloudEvents
+	}
+	return diff, filter, format, nil
 }
 
 func parsePath(req *http.Request) ([]wot.EventType, error) {
@@ -93,7 +146,7 @@ func parsePath(req *http.Request) ([]wot.EventType, error) {
 	params := mux.Vars(req)
 	event := params[QueryParamType]
 	if event == "" {
-		return []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete}, nil
+		return []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete, wot.EventTypeExpire}, nil
 	}
 
 	eventType := wot.EventType(event)
@@ -104,3 +157,16 @@ func parsePath(req *http.Request) ([]wot.EventType, error) {
 	return []wot.EventType{eventType}, nil
 
 }
+
+func parseDiscoveryPath(req *http.Request) ([]wot.EventType, error) {
+	event := mux.Vars(req)[QueryParamType]
+	if event == "" {
+		return []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete, wot.EventTypeExpire}, nil
+	}
+
+	eventType, err := parseDiscoveryEventName(event)
+	if err != nil {
+		return nil, err
+	}
+	return []wot.EventType{eventType}, nil
+}
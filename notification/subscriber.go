@@ -0,0 +1,195 @@
+package notification
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+// OverflowPolicy decides what happens to the events of a subscriber whose buffer is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest drops the oldest buffered event in favour of the new one
+	OverflowDropOldest OverflowPolicy = "dropOldest"
+	// OverflowDisconnect ends the subscription, after the buffered events are sent
+	OverflowDisconnect OverflowPolicy = "disconnect"
+	// OverflowReplay skips the new events and replays them from the event queue once the buffer is drained
+	OverflowReplay OverflowPolicy = "replay"
+
+	DefaultBufferSize     = 100
+	DefaultOverflowPolicy = OverflowReplay
+)
+
+func (p OverflowPolicy) IsValid() bool {
+	switch p {
+	case OverflowDropOldest, OverflowDisconnect, OverflowReplay:
+		return true
+	}
+	return false
+}
+
+// interval for replaying to the lagging subscribers when there are no new events
+var controllerReplayInterval = time.Second
+
+// SubscriberMetrics describes the state of a subscriber
+type SubscriberMetrics struct {
+	ID            uint64          `json:"id"`
+	Since         time.Time       `json:"since"`
+	EventTypes    []wot.EventType `json:"eventTypes"`
+	QueueLength   int             `json:"queueLength"`
+	QueueCapacity int             `json:"queueCapacity"`
+	Sent          uint64          `json:"sent"`
+	Dropped       uint64          `json:"dropped"`
+	Overflows     uint64          `json:"overflows"`
+	Replays       uint64          `json:"replays"`
+	Lagging       bool            `json:"lagging"`
+}
+
+type subscriber struct {
+	client      chan Event
+	eventTypes  []wot.EventType
+	diff        DiffMode
+	filter      *eventFilter
+	lastEventID string
+
+	// the fields below are owned by the handler of the controller, except sent
+
+	id    uint64
+	since time.Time
+	// buffered events, sent to client by forward
+	queue chan Event
+	// IDs of the replayed events, skipped when notified until the first new event
+	replayed map[string]bool
+	// the last event that was queued or filtered out, to replay from when lagging
+	lastQueuedID string
+	// events are skipped until replayed
+	lagging bool
+
+	sent      uint64 // atomic
+	dropped   uint64
+	overflows uint64
+	replays   uint64
+}
+
+// forward sends the buffered events to the client, and closes the client once the queue is closed
+func (s *subscriber) forward() {
+	for event := range s.queue {
+		s.client <- event
+		atomic.AddUint64(&s.sent, 1)
+	}
+	close(s.client)
+}
+
+// prepare returns the event as sent to the subscriber, or false if the subscriber does not want it
+func (s *subscriber) prepare(event Event) (Event, bool) {
+	for _, eventType := range s.eventTypes {
+		// Send the notification if the type matches
+		// Expiry is a kind of deletion and is also sent to subscribers of delete events
+		if eventType == event.Type || (eventType == wot.EventTypeDelete && event.Type == wot.EventTypeExpire) {
+			if s.filter != nil {
+				ok, err := s.filter.matches(event.filterTD())
+				if err != nil {
+					log.Printf("error filtering event %s: %s", event.ID, err)
+				}
+				if !ok {
+					return event, false
+				}
+			}
+			toSend := event
+			toSend.TD = nil
+			// the patch of updates replaces the merge patch in the JSON Patch mode
+			jsonPatch := s.diff == DiffJSONPatch && toSend.Patch != nil
+			if s.diff == DiffNone || jsonPatch {
+				toSend.Data = catalog.ThingDescription{wot.KeyThingID: toSend.Data[wot.KeyThingID]}
+			}
+			if !jsonPatch {
+				toSend.Patch = nil
+				toSend.PreviousRevision = 0
+			}
+			return toSend, true
+		}
+	}
+	return event, false
+}
+
+func (s *subscriber) metrics() SubscriberMetrics {
+	return SubscriberMetrics{
+		ID:            s.id,
+		Since:         s.since,
+		EventTypes:    s.eventTypes,
+		QueueLength:   len(s.queue),
+		QueueCapacity: cap(s.queue),
+		Sent:          atomic.LoadUint64(&s.sent),
+		Dropped:       s.dropped,
+		Overflows:     s.overflows,
+		Replays:       s.replays,
+		Lagging:       s.lagging,
+	}
+}
+
+// enqueue buffers the event if the subscriber wants it, and applies the overflow policy if the buffer is full
+// It never blocks. Must only be called by the handler.
+func (c *Controller) enqueue(s *subscriber, event Event) {
+	toSend, ok := s.prepare(event)
+	if ok {
+		select {
+		case s.queue <- toSend:
+		default:
+			s.overflows++
+			switch c.overflowPolicy {
+			case OverflowDropOldest:
+				select {
+				case <-s.queue:
+				default:
+				}
+				s.dropped++
+				select {
+				case s.queue <- toSend:
+				default:
+					s.dropped++
+				}
+			case OverflowDisconnect:
+				log.Printf("Subscriber %d is too slow. Disconnecting.", s.id)
+				c.remove(s)
+				return
+			case OverflowReplay:
+				if !s.lagging {
+					log.Printf("Subscriber %d is too slow. Events will be replayed.", s.id)
+				}
+				s.lagging = true
+				return
+			}
+		}
+	}
+	s.lastQueuedID = event.ID
+}
+
+// replay queues the events that were skipped while lagging. Must only be called by the handler.
+func (c *Controller) replay(s *subscriber) {
+	events, err := c.s.getAllAfter(s.lastQueuedID)
+	if err != nil {
+		log.Printf("error getting the events after ID %s: %s", s.lastQueuedID, err)
+		return
+	}
+	s.replays++
+	s.lagging = false
+	s.replayed = make(map[string]bool, len(events))
+	for _, event := range events {
+		c.enqueue(s, event)
+		if s.lagging {
+			// the rest is replayed later
+			return
+		}
+		s.replayed[event.ID] = true
+	}
+}
+
+// remove ends the subscription. Must only be called by the handler.
+func (c *Controller) remove(s *subscriber) {
+	delete(c.activeClients, s.client)
+	close(s.queue)
+}
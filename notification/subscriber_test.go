@@ -0,0 +1,121 @@
+package notification
+
+import (
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+func TestSlowSubscriber(t *testing.T) {
+	defer func(interval time.Duration) {
+		controllerReplayInterval = interval
+	}(controllerReplayInterval)
+	controllerReplayInterval = 10 * time.Millisecond
+
+	const total = 10
+	allTypes := []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete}
+
+	// receive returns the events until the channel is closed, or none arrives for a while
+	receive := func(client chan Event) (events []Event, closed bool) {
+		for {
+			select {
+			case event, ok := <-client:
+				if !ok {
+					return events, true
+				}
+				events = append(events, event)
+			case <-time.After(200 * time.Millisecond):
+				return events, false
+			}
+		}
+	}
+
+	// setup creates a stuck and a fast subscriber and notifies the events
+	setup := func(t *testing.T, policy OverflowPolicy) (*Controller, chan Event) {
+		controller := setupControllerWithPolicy(t, 2, policy)
+
+		stuck := make(chan Event)
+		controller.subscribe(stuck, allTypes, DiffNone, nil, "")
+		fast := make(chan Event)
+		controller.subscribe(fast, allTypes, DiffNone, nil, "")
+		received := make(chan []Event)
+		go func() {
+			events, _ := receive(fast)
+			received <- events
+		}()
+
+		notified := make(chan struct{})
+		go func() {
+			for i := 0; i < total; i++ {
+				controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:1"})
+				// slow enough for the fast subscriber
+				time.Sleep(5 * time.Millisecond)
+			}
+			close(notified)
+		}()
+		select {
+		case <-notified:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("notifying is blocked by the stuck subscriber")
+		}
+		if events := <-received; len(events) != total {
+			t.Fatalf("fast subscriber received %d events instead of %d", len(events), total)
+		}
+		t.Cleanup(func() {
+			controller.unsubscribe(fast)
+			controller.unsubscribe(stuck)
+			receive(fast)
+			receive(stuck)
+		})
+		return controller, stuck
+	}
+
+	t.Run("drop oldest", func(t *testing.T) {
+		controller, stuck := setup(t, OverflowDropOldest)
+
+		metrics := controller.metrics()
+		events, _ := receive(stuck)
+		if len(events) == 0 || len(events) > 3 || events[len(events)-1].ID != "a" {
+			t.Fatalf("unexpected events: %v", events)
+		}
+		if metrics[0].Dropped != uint64(total-len(events)) || metrics[0].Overflows == 0 {
+			t.Fatalf("unexpected metrics: %+v", metrics[0])
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		controller, stuck := setup(t, OverflowDisconnect)
+
+		metrics := controller.metrics()
+		if len(metrics) != 1 || metrics[0].ID != 2 {
+			t.Fatalf("stuck subscriber is not disconnected: %+v", metrics)
+		}
+		events, closed := receive(stuck)
+		if !closed || len(events) == 0 || len(events) > 3 {
+			t.Fatalf("unexpected events: %v (closed: %t)", events, closed)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		controller, stuck := setup(t, OverflowReplay)
+
+		if metrics := controller.metrics(); !metrics[0].Lagging || metrics[0].Overflows == 0 {
+			t.Fatalf("unexpected metrics: %+v", metrics[0])
+		}
+		events, _ := receive(stuck)
+		if len(events) != total {
+			t.Fatalf("received %d events instead of %d", len(events), total)
+		}
+		for i, event := range events {
+			if event.ID != string("123456789a"[i]) {
+				t.Fatalf("unexpected event %d: %v", i, event)
+			}
+		}
+		metrics := controller.metrics()
+		if metrics[0].Lagging || metrics[0].Replays == 0 || metrics[0].Dropped != 0 || metrics[0].Sent != total {
+			t.Fatalf("unexpected metrics: %+v", metrics[0])
+		}
+	})
+}
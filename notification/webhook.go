@@ -0,0 +1,461 @@
+package notification
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+	uuid "github.com/satori/go.uuid"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	// HeaderSignature carries the hex encoded HMAC-SHA256 of the payload, prefixed with "sha256="
+	HeaderSignature = "X-Signature-256"
+
+	webhookSubscriptionPrefix = "s/"
+	webhookDeadLetterPrefix   = "d/"
+	// pending events per webhook, further events are dead-lettered right away
+	webhookQueueSize = 1000
+)
+
+// delivery settings, variables to allow overriding in tests
+var (
+	webhookMaxAttempts    = 8
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = 5 * time.Minute
+	webhookTimeout        = 10 * time.Second
+)
+
+// WebhookSubscription is a receiver URL for events
+// The secret is write-only and is never included in the responses.
+type WebhookSubscription struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Types    []wot.EventType `json:"types,omitempty"`
+	Diff     DiffMode        `json:"diff,omitempty"`
+	JSONPath string          `json:"jsonpath,omitempty"`
+	Secret   string          `json:"secret,omitempty"`
+	Format   string          `json:"format,omitempty"`
+	Created  time.Time       `json:"created"`
+	// the last event that was delivered or dead-lettered
+	LastEventID string `json:"lastEventID,omitempty"`
+}
+
+// DeadLetter is an event that could not be delivered to a webhook
+type DeadLetter struct {
+	Event    Event     `json:"event"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+func (s *WebhookSubscription) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return &catalog.BadRequestError{S: fmt.Sprintf("invalid webhook url: %s", s.URL)}
+	}
+	for _, t := range s.Types {
+		if !t.IsValid() {
+			return &catalog.BadRequestError{S: fmt.Sprintf("invalid event type: %s", t)}
+		}
+	}
+	if !s.Diff.IsValid() {
+		return &catalog.BadRequestError{S: fmt.Sprintf("unsupported diff mode: %s", s.Diff)}
+	}
+	if _, err := newEventFilter(s.JSONPath, ""); err != nil {
+		return &catalog.BadRequestError{S: err.Error()}
+	}
+	if err := validateFormat(s.Format); err != nil {
+		return &catalog.BadRequestError{S: err.Error()}
+	}
+	return nil
+}
+
+// WebhookManager delivers the events to the webhook subscriptions
+// The subscriptions and dead letters are persisted in LevelDB. Each subscription resumes from
+// its last event after a restart, as far as the events are still in the event queue.
+type WebhookManager struct {
+	controller NotificationController
+	db         *leveldb.DB
+	client     *http.Client
+	// source of the CloudEvents, i.e. the public endpoint
+	source string
+
+	// guards workers
+	sync.Mutex
+	workers map[string]*webhookWorker
+}
+
+func NewWebhookManager(controller NotificationController, source, dsn string, opts *opt.Options) (*WebhookManager, error) {
+	url, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := leveldb.OpenFile(url.Path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &WebhookManager{
+		controller: controller,
+		db:         db,
+		client:     &http.Client{Timeout: webhookTimeout},
+		source:     source,
+		workers:    make(map[string]*webhookWorker),
+	}
+
+	subs, err := m.list()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, sub := range subs {
+		m.start(sub)
+	}
+	return m, nil
+}
+
+func (m *WebhookManager) add(sub WebhookSubscription) (WebhookSubscription, error) {
+	if err := sub.validate(); err != nil {
+		return sub, err
+	}
+	sub.ID = uuid.NewV4().String()
+	sub.Created = time.Now().UTC()
+	// the starting point, in case of a restart before the first event
+	latestID, err := m.controller.latestEventID()
+	if err != nil {
+		return sub, err
+	}
+	sub.LastEventID = latestID
+
+	m.Lock()
+	defer m.Unlock()
+	if err := m.put(sub); err != nil {
+		return sub, err
+	}
+	m.start(sub)
+	return sub, nil
+}
+
+func (m *WebhookManager) get(id string) (WebhookSubscription, error) {
+	var sub WebhookSubscription
+	b, err := m.db.Get([]byte(webhookSubscriptionPrefix+id), nil)
+	if err == leveldb.ErrNotFound {
+		return sub, &catalog.NotFoundError{S: fmt.Sprintf("%s is not found", id)}
+	} else if err != nil {
+		return sub, err
+	}
+	err = json.Unmarshal(b, &sub)
+	return sub, err
+}
+
+func (m *WebhookManager) list() ([]WebhookSubscription, error) {
+	subs := []WebhookSubscription{}
+	iter := m.db.NewIterator(util.BytesPrefix([]byte(webhookSubscriptionPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var sub WebhookSubscription
+		if err := json.Unmarshal(iter.Value(), &sub); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, iter.Error()
+}
+
+// delete removes the subscription along with its dead letters
+func (m *WebhookManager) delete(id string) error {
+	m.Lock()
+	w, found := m.workers[id]
+	delete(m.workers, id)
+	m.Unlock()
+	if !found {
+		return &catalog.NotFoundError{S: fmt.Sprintf("%s is not found", id)}
+	}
+
+	// no more state is recorded by the worker after this
+	w.Lock()
+	w.removed = true
+	w.Unlock()
+
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(webhookSubscriptionPrefix + id))
+	iter := m.db.NewIterator(util.BytesPrefix([]byte(webhookDeadLetterPrefix+id+"/")), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	err := m.db.Write(batch, nil)
+
+	w.stop()
+	return err
+}
+
+func (m *WebhookManager) deadLetters(id string) ([]DeadLetter, error) {
+	if _, err := m.get(id); err != nil {
+		return nil, err
+	}
+	letters := []DeadLetter{}
+	iter := m.db.NewIterator(util.BytesPrefix([]byte(webhookDeadLetterPrefix+id+"/")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var letter DeadLetter
+		if err := json.Unmarshal(iter.Value(), &letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	return letters, iter.Error()
+}
+
+// Close stops the deliveries and closes the database
+// It must be called before stopping the notification controller.
+func (m *WebhookManager) Close() {
+	m.Lock()
+	workers := m.workers
+	m.workers = make(map[string]*webhookWorker)
+	m.Unlock()
+	for _, w := range workers {
+		w.stop()
+	}
+	err := m.db.Close()
+	if err != nil {
+		log.Printf("Error closing webhook storage: %s", err)
+	}
+}
+
+func (m *WebhookManager) put(sub WebhookSubscription) error {
+	b, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	return m.db.Put([]byte(webhookSubscriptionPrefix+sub.ID), b, nil)
+}
+
+// processed records the last event of the worker and the dead letter, if any
+func (w *webhookWorker) processed(event Event, letter *DeadLetter) {
+	w.Lock()
+	defer w.Unlock()
+	if w.removed {
+		return
+	}
+	batch := new(leveldb.Batch)
+	if letter != nil {
+		b, err := json.Marshal(letter)
+		if err != nil {
+			log.Printf("Webhook %s: error serializing dead letter: %s", w.sub.ID, err)
+			return
+		}
+		key := fmt.Sprintf("%s%s/%020d/%s", webhookDeadLetterPrefix, w.sub.ID, letter.Time.UnixNano(), event.ID)
+		batch.Put([]byte(key), b)
+	}
+	w.sub.LastEventID = event.ID
+	b, err := json.Marshal(w.sub)
+	if err != nil {
+		log.Printf("Webhook %s: error serializing subscription: %s", w.sub.ID, err)
+		return
+	}
+	batch.Put([]byte(webhookSubscriptionPrefix+w.sub.ID), b)
+	if err := w.m.db.Write(batch, nil); err != nil {
+		log.Printf("Webhook %s: error storing delivery state: %s", w.sub.ID, err)
+	}
+}
+
+// start runs a worker for the subscription. The caller must hold the lock.
+func (m *WebhookManager) start(sub WebhookSubscription) {
+	w := &webhookWorker{
+		m:         m,
+		sub:       sub,
+		client:    make(chan Event),
+		signal:    make(chan struct{}, 1),
+		forwarded: make(chan struct{}),
+		stopped:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	m.workers[sub.ID] = w
+
+	eventTypes := sub.Types
+	if len(eventTypes) == 0 {
+		eventTypes = []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete, wot.EventTypeExpire}
+	}
+	// validated on creation
+	filter, err := newEventFilter(sub.JSONPath, "")
+	if err != nil {
+		log.Printf("Webhook %s: ignoring invalid jsonpath: %s", sub.ID, err)
+	}
+	// the events must be received while subscribing, as missed events are sent right away
+	go w.receive()
+	go w.run()
+	m.controller.subscribe(w.client, eventTypes, sub.Diff, filter, sub.LastEventID)
+}
+
+// webhookWorker delivers the events of a subscription one at a time
+type webhookWorker struct {
+	m   *WebhookManager
+	sub WebhookSubscription
+
+	client chan Event
+
+	// guards pending, removed and the delivery state in the database
+	sync.Mutex
+	// filled by receive without blocking the notification controller
+	pending []Event
+	signal  chan struct{}
+	removed bool
+
+	// closed once the client channel is drained
+	forwarded chan struct{}
+	stopped   chan struct{}
+	done      chan struct{}
+}
+
+// receive queues the events until the client channel is closed
+func (w *webhookWorker) receive() {
+	defer close(w.forwarded)
+	for event := range w.client {
+		w.Lock()
+		overflow := len(w.pending) >= webhookQueueSize
+		if !overflow {
+			w.pending = append(w.pending, event)
+		}
+		w.Unlock()
+		if overflow {
+			w.processed(event, &DeadLetter{Event: event, Error: "delivery queue is full", Time: time.Now().UTC()})
+			continue
+		}
+
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run delivers the pending events until stopped
+func (w *webhookWorker) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.signal:
+		case <-w.stopped:
+			return
+		}
+		for {
+			w.Lock()
+			if len(w.pending) == 0 {
+				w.Unlock()
+				break
+			}
+			event := w.pending[0]
+			w.pending = w.pending[1:]
+			w.Unlock()
+
+			if !w.deliver(event) {
+				return
+			}
+		}
+	}
+}
+
+// stop ends the subscription and waits for the worker to return
+func (w *webhookWorker) stop() {
+	close(w.stopped)
+	w.m.controller.unsubscribe(w.client)
+	<-w.forwarded
+	<-w.done
+}
+
+// deliver posts the event with retries, and dead-letters it once the attempts are exhausted
+// It returns false if the worker was stopped in between.
+func (w *webhookWorker) deliver(event Event) bool {
+	body, err := json.Marshal(event.render(w.sub.Format, w.m.source))
+	if err != nil {
+		w.processed(event, &DeadLetter{Event: event, Error: err.Error(), Time: time.Now().UTC()})
+		return true
+	}
+
+	backoff := webhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			w.processed(event, nil)
+			return true
+		}
+		if !retry || attempt >= webhookMaxAttempts {
+			log.Printf("Webhook %s: giving up on event %s after %d attempt(s): %s", w.sub.ID, event.ID, attempt, err)
+			w.processed(event, &DeadLetter{Event: event, Attempts: attempt, Error: err.Error(), Time: time.Now().UTC()})
+			return true
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-w.stopped:
+			// not recorded as processed, the event is sent again after a restart
+			return false
+		}
+		backoff *= 2
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// post sends the payload once. Network errors, 429 and 5xx responses are worth a retry.
+func (w *webhookWorker) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if w.sub.Format == FormatCloudEvents {
+		req.Header.Set("Content-Type", MediaTypeCloudEvents)
+	} else {
+		req.Header.Set("Content-Type", wot.MediaTypeJSON)
+	}
+	if w.sub.Secret != "" {
+		req.Header.Set(HeaderSignature, "sha256="+sign(w.sub.Secret, body))
+	}
+
+	res, err := w.m.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return false, nil
+	case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return true, fmt.Errorf("receiver responded with %s", res.Status)
+	default:
+		return false, fmt.Errorf("receiver responded with %s", res.Status)
+	}
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the body
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// withoutSecret hides the secret of subscriptions in responses
+func withoutSecret(sub WebhookSubscription) WebhookSubscription {
+	sub.Secret = ""
+	return sub
+}
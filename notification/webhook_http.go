@@ -0,0 +1,134 @@
+package notification
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+type WebhookAPI struct {
+	manager *WebhookManager
+}
+
+func NewWebhookAPI(manager *WebhookManager) *WebhookAPI {
+	return &WebhookAPI{
+		manager: manager,
+	}
+}
+
+// Post creates a webhook subscription (Response: StatusCreated)
+func (a *WebhookAPI) Post(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var sub WebhookSubscription
+	if err := json.Unmarshal(body, &sub); err != nil {
+		catalog.ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
+		return
+	}
+
+	sub, err = a.manager.add(sub)
+	if err != nil {
+		switch err.(type) {
+		case *catalog.BadRequestError:
+			catalog.ErrorResponse(w, http.StatusBadRequest, "Invalid subscription:", err.Error())
+			return
+		default:
+			catalog.ErrorResponse(w, http.StatusInternalServerError, "Error creating the subscription:", err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Location", sub.ID)
+	writeJSON(w, http.StatusCreated, withoutSecret(sub))
+}
+
+// GetAll lists the webhook subscriptions
+func (a *WebhookAPI) GetAll(w http.ResponseWriter, req *http.Request) {
+	subs, err := a.manager.list()
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusInternalServerError, "Error listing the subscriptions:", err.Error())
+		return
+	}
+	for i := range subs {
+		subs[i] = withoutSecret(subs[i])
+	}
+	writeJSON(w, http.StatusOK, subs)
+}
+
+// Get retrieves a webhook subscription
+func (a *WebhookAPI) Get(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	sub, err := a.manager.get(params["id"])
+	if err != nil {
+		switch err.(type) {
+		case *catalog.NotFoundError:
+			catalog.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			catalog.ErrorResponse(w, http.StatusInternalServerError, "Error retrieving the subscription:", err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, withoutSecret(sub))
+}
+
+// Delete removes a webhook subscription and its dead letters
+func (a *WebhookAPI) Delete(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	err := a.manager.delete(params["id"])
+	if err != nil {
+		switch err.(type) {
+		case *catalog.NotFoundError:
+			catalog.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			catalog.ErrorResponse(w, http.StatusInternalServerError, "Error deleting the subscription:", err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetDeadLetters lists the events that could not be delivered to a webhook
+func (a *WebhookAPI) GetDeadLetters(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	letters, err := a.manager.deadLetters(params["id"])
+	if err != nil {
+		switch err.(type) {
+		case *catalog.NotFoundError:
+			catalog.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			catalog.ErrorResponse(w, http.StatusInternalServerError, "Error listing the dead letters:", err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, letters)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		catalog.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", wot.MediaTypeJSON)
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("ERROR writing HTTP response: %s", err)
+	}
+}
@@ -0,0 +1,273 @@
+package notification
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+)
+
+// receiver records the deliveries and responds with the given status codes, then with 200
+type receiver struct {
+	sync.Mutex
+	codes      []int
+	requests   []*http.Request
+	deliveries chan []byte
+}
+
+func newReceiver(codes ...int) (*receiver, *httptest.Server) {
+	r := &receiver{codes: codes, deliveries: make(chan []byte, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.Lock()
+		r.requests = append(r.requests, req)
+		code := http.StatusOK
+		if len(r.codes) > 0 {
+			code, r.codes = r.codes[0], r.codes[1:]
+		}
+		r.Unlock()
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			r.deliveries <- body
+		}
+	}))
+	return r, server
+}
+
+func (r *receiver) next(t *testing.T) Event {
+	select {
+	case b := <-r.deliveries:
+		var event Event
+		if err := json.Unmarshal(b, &event); err != nil {
+			t.Fatalf("error decoding delivery: %s", err)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for delivery")
+	}
+	return Event{}
+}
+
+func TestWebhookManager(t *testing.T) {
+	defer func(backoff time.Duration, attempts int) {
+		webhookInitialBackoff, webhookMaxAttempts = backoff, attempts
+	}(webhookInitialBackoff, webhookMaxAttempts)
+	webhookInitialBackoff = 10 * time.Millisecond
+	webhookMaxAttempts = 3
+	controller := setupController(t)
+	dir := t.TempDir()
+	manager, err := NewWebhookManager(controller, "http://localhost", dir, nil)
+	if err != nil {
+		t.Fatalf("error creating webhook manager: %s", err)
+	}
+	defer func() {
+		manager.Close()
+	}()
+
+	t.Run("filter and sign", func(t *testing.T) {
+		r, server := newReceiver()
+		defer server.Close()
+		sub, err := manager.add(WebhookSubscription{
+			URL:      server.URL,
+			Types:    []wot.EventType{wot.EventTypeCreate},
+			Diff:     DiffMergePatch,
+			JSONPath: "$[?(@.title=='match')]",
+			Secret:   "secret",
+		})
+		if err != nil {
+			t.Fatalf("error adding subscription: %s", err)
+		}
+		defer manager.delete(sub.ID)
+
+		controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:1", "title": "other"})
+		controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:2", "title": "match"})
+
+		event := r.next(t)
+		if event.Data[wot.KeyThingID] != "urn:example:2" {
+			t.Fatalf("unexpected event: %v", event)
+		}
+		r.Lock()
+		req := r.requests[0]
+		r.Unlock()
+		b, _ := json.Marshal(event)
+		if req.Header.Get(HeaderSignature) != "sha256="+sign("secret", b) {
+			t.Fatalf("invalid signature: %s", req.Header.Get(HeaderSignature))
+		}
+	})
+
+	t.Run("cloudevents", func(t *testing.T) {
+		r, server := newReceiver()
+		defer server.Close()
+		sub, err := manager.add(WebhookSubscription{URL: server.URL, Format: FormatCloudEvents})
+		if err != nil {
+			t.Fatalf("error adding subscription: %s", err)
+		}
+		defer manager.delete(sub.ID)
+
+		controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:5"})
+		var ce CloudEvent
+		select {
+		case b := <-r.deliveries:
+			json.Unmarshal(b, &ce)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for delivery")
+		}
+		r.Lock()
+		contentType := r.requests[0].Header.Get("Content-Type")
+		r.Unlock()
+		if contentType != MediaTypeCloudEvents || ce.Type != "org.w3.wot.td.create" || ce.Subject != "urn:example:5" || ce.Source != "http://localhost" {
+			t.Fatalf("unexpected CloudEvent (%s): %+v", contentType, ce)
+		}
+	})
+
+	t.Run("retry", func(t *testing.T) {
+		r, server := newReceiver(http.StatusServiceUnavailable, http.StatusInternalServerError)
+		defer server.Close()
+		sub, err := manager.add(WebhookSubscription{URL: server.URL})
+		if err != nil {
+			t.Fatalf("error adding subscription: %s", err)
+		}
+		defer manager.delete(sub.ID)
+
+		controller.DeleteHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:1", "title": "other"})
+		event := r.next(t)
+		if event.Type != wot.EventTypeDelete || len(event.Data) != 1 {
+			t.Fatalf("unexpected event: %v", event)
+		}
+		r.Lock()
+		attempts := len(r.requests)
+		r.Unlock()
+		if attempts != 3 {
+			t.Fatalf("delivered after %d attempts instead of 3", attempts)
+		}
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		_, server := newReceiver(http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusBadRequest)
+		defer server.Close()
+		sub, err := manager.add(WebhookSubscription{URL: server.URL})
+		if err != nil {
+			t.Fatalf("error adding subscription: %s", err)
+		}
+		defer manager.delete(sub.ID)
+
+		// exhausts the attempts
+		controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:3"})
+		// not retried
+		controller.CreateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:4"})
+
+		var letters []DeadLetter
+		for start := time.Now(); len(letters) < 2 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			letters, err = manager.deadLetters(sub.ID)
+			if err != nil {
+				t.Fatalf("error listing dead letters: %s", err)
+			}
+		}
+		if len(letters) != 2 {
+			t.Fatalf("got %d dead letters instead of 2", len(letters))
+		}
+		if letters[0].Attempts != 3 || letters[1].Attempts != 1 || letters[1].Event.Data[wot.KeyThingID] != "urn:example:4" {
+			t.Fatalf("unexpected dead letters: %v", letters)
+		}
+
+		stored, err := manager.get(sub.ID)
+		if err != nil {
+			t.Fatalf("error getting subscription: %s", err)
+		}
+		if stored.LastEventID != letters[1].Event.ID {
+			t.Fatalf("last event ID is %s instead of %s", stored.LastEventID, letters[1].Event.ID)
+		}
+	})
+
+	t.Run("persistence", func(t *testing.T) {
+		r, server := newReceiver()
+		defer server.Close()
+		sub, err := manager.add(WebhookSubscription{URL: server.URL, Types: []wot.EventType{wot.EventTypeUpdate}})
+		if err != nil {
+			t.Fatalf("error adding subscription: %s", err)
+		}
+
+		manager.Close()
+		// missed while closed
+		controller.UpdateHandler(catalog.ThingDescription{wot.KeyThingID: "urn:example:1"}, catalog.ThingDescription{wot.KeyThingID: "urn:example:1", "title": "new"})
+
+		manager, err = NewWebhookManager(controller, "http://localhost", dir, nil)
+		if err != nil {
+			t.Fatalf("error reopening webhook manager: %s", err)
+		}
+		event := r.next(t)
+		if event.Type != wot.EventTypeUpdate {
+			t.Fatalf("unexpected event: %v", event)
+		}
+		// recorded right after the delivery
+		var stored WebhookSubscription
+		for start := time.Now(); stored.LastEventID != event.ID && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			stored, err = manager.get(sub.ID)
+			if err != nil {
+				t.Fatalf("error getting subscription: %s", err)
+			}
+		}
+		if stored.LastEventID != event.ID {
+			t.Fatalf("last event ID is %s instead of %s", stored.LastEventID, event.ID)
+		}
+	})
+}
+
+func TestWebhookAPI(t *testing.T) {
+	controller := setupController(t)
+	manager, err := NewWebhookManager(controller, "http://localhost", t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("error creating webhook manager: %s", err)
+	}
+	defer manager.Close()
+	api := NewWebhookAPI(manager)
+
+	t.Run("create", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(`{"url":"http://localhost:1/hook","secret":"s"}`))
+		res := httptest.NewRecorder()
+		api.Post(res, req)
+		if res.Code != http.StatusCreated {
+			t.Fatalf("status %d: %s", res.Code, res.Body)
+		}
+		var sub WebhookSubscription
+		json.Unmarshal(res.Body.Bytes(), &sub)
+		if sub.ID == "" || sub.Secret != "" || res.Header().Get("Location") != sub.ID {
+			t.Fatalf("unexpected response: %s", res.Body)
+		}
+
+		req = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/subscriptions/"+sub.ID, nil), map[string]string{"id": sub.ID})
+		res = httptest.NewRecorder()
+		api.Get(res, req)
+		if res.Code != http.StatusOK || strings.Contains(res.Body.String(), `"secret"`) {
+			t.Fatalf("status %d: %s", res.Code, res.Body)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, body := range []string{`{"url":"/relative"}`, `{"url":"http://localhost:1","types":["x"]}`, `{"url":"http://localhost:1","jsonpath":"$[?("}`, `{"url":"http://localhost:1","format":"xml"}`} {
+			req := httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body))
+			res := httptest.NewRecorder()
+			api.Post(res, req)
+			if res.Code != http.StatusBadRequest {
+				t.Fatalf("%s: status %d instead of 400", body, res.Code)
+			}
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/subscriptions/x", nil), map[string]string{"id": "x"})
+		res := httptest.NewRecorder()
+		api.Delete(res, req)
+		if res.Code != http.StatusNotFound {
+			t.Fatalf("status %d instead of 404", res.Code)
+		}
+	})
+}
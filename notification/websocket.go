@@ -0,0 +1,180 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/linksmart/thing-directory/wot"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// WebSocket control actions
+	WSActionSubscribe   = "subscribe"
+	WSActionUnsubscribe = "unsubscribe"
+)
+
+// WSControlMessage is sent by WebSocket clients to change their subscription
+// Subscribing again replaces the current subscription. Without lastEventID, a new subscription
+// continues after the last event sent over the connection.
+type WSControlMessage struct {
+	Action      string          `json:"action"`
+	Types       []wot.EventType `json:"types,omitempty"`
+	Diff        DiffMode        `json:"diff,omitempty"`
+	LastEventID string          `json:"lastEventID,omitempty"`
+	Format      string          `json:"format,omitempty"`
+}
+
+// WSControlResponse acknowledges or rejects a control message
+type WSControlResponse struct {
+	Action string `json:"action"`
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+}
+
+type WebSocketAPI struct {
+	controller NotificationController
+	// source of the CloudEvents, i.e. the public endpoint
+	source string
+}
+
+func NewWebSocketAPI(controller NotificationController, source string) *WebSocketAPI {
+	return &WebSocketAPI{
+		controller: controller,
+		source:     source,
+	}
+}
+
+// SubscribeEvent upgrades the request to a WebSocket connection for receiving events
+func (a *WebSocketAPI) SubscribeEvent(w http.ResponseWriter, req *http.Request) {
+	// no origin check, access is controlled by the auth middleware
+	s := websocket.Server{Handler: a.serve}
+	s.ServeHTTP(w, req)
+}
+
+// wsConn is a WebSocket connection with at most one active subscription
+type wsConn struct {
+	ws         *websocket.Conn
+	controller NotificationController
+	source     string
+
+	// guards writes to ws and lastEventID
+	sync.Mutex
+	lastEventID string
+
+	client chan Event
+	// closed once all events of client are forwarded
+	forwarded chan struct{}
+}
+
+func (a *WebSocketAPI) serve(ws *websocket.Conn) {
+	defer ws.Close()
+	c := &wsConn{ws: ws, controller: a.controller, source: a.source}
+	defer c.unsubscribe()
+
+	for {
+		var b []byte
+		err := websocket.Message.Receive(ws, &b)
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			log.Printf("WebSocket: error receiving control message: %s", err)
+			return
+		}
+		var msg WSControlMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			c.send(WSControlResponse{Error: fmt.Sprintf("invalid control message: %s", err)})
+			continue
+		}
+
+		switch msg.Action {
+		case WSActionSubscribe:
+			err = c.subscribe(msg)
+		case WSActionUnsubscribe:
+			c.unsubscribe()
+		default:
+			err = fmt.Errorf("unknown action: %s", msg.Action)
+		}
+
+		resp := WSControlResponse{Action: msg.Action, OK: err == nil}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		if err := c.send(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (c *wsConn) send(v interface{}) error {
+	c.Lock()
+	defer c.Unlock()
+	err := websocket.JSON.Send(c.ws, v)
+	if err != nil {
+		log.Printf("WebSocket: error sending message: %s", err)
+	}
+	return err
+}
+
+// subscribe replaces the current subscription
+func (c *wsConn) subscribe(msg WSControlMessage) error {
+	eventTypes := msg.Types
+	if len(eventTypes) == 0 {
+		eventTypes = []wot.EventType{wot.EventTypeCreate, wot.EventTypeUpdate, wot.EventTypeDelete, wot.EventTypeExpire}
+	}
+	for _, t := range eventTypes {
+		if !t.IsValid() {
+			return fmt.Errorf("invalid event type: %s", t)
+		}
+	}
+	if err := validateFormat(msg.Format); err != nil {
+		return err
+	}
+
+	c.unsubscribe()
+
+	lastEventID := msg.LastEventID
+	if lastEventID == "" {
+		c.Lock()
+		lastEventID = c.lastEventID
+		c.Unlock()
+	}
+
+	// the events must be forwarded while subscribing, as missed events are sent right away
+	c.client = make(chan Event)
+	c.forwarded = make(chan struct{})
+	go c.forward(c.client, msg.Format, c.forwarded)
+
+	return c.controller.subscribe(c.client, eventTypes, msg.Diff, nil, lastEventID)
+}
+
+// unsubscribe ends the current subscription, after all of its events are forwarded
+func (c *wsConn) unsubscribe() {
+	if c.client == nil {
+		return
+	}
+	c.controller.unsubscribe(c.client)
+	<-c.forwarded
+	c.client = nil
+}
+
+// forward sends the events to the WebSocket until the client channel is closed
+func (c *wsConn) forward(client chan Event, format string, done chan struct{}) {
+	defer close(done)
+	for event := range client {
+		c.Lock()
+		err := websocket.JSON.Send(c.ws, event.render(format, c.source))
+		if err == nil {
+			c.lastEventID = event.ID
+		}
+		c.Unlock()
+		if err != nil {
+			log.Printf("WebSocket: error sending event: %s", err)
+			// keep draining until unsubscribed
+		}
+	}
+}
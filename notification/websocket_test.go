@@ -0,0 +1,117 @@
+package notification
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linksmart/thing-directory/catalog"
+	"github.com/linksmart/thing-directory/wot"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketAPI(t *testing.T) {
+	controller := setupController(t)
+	server := httptest.NewServer(http.HandlerFunc(NewWebSocketAPI(controller, "http://localhost").SubscribeEvent))
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", server.URL)
+	if err != nil {
+		t.Fatalf("error connecting: %s", err)
+	}
+	defer ws.Close()
+
+	receive := func(v interface{}) {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err := websocket.JSON.Receive(ws, v)
+		if err != nil {
+			t.Fatalf("error receiving: %s", err)
+		}
+	}
+	control := func(msg WSControlMessage) WSControlResponse {
+		err := websocket.JSON.Send(ws, msg)
+		if err != nil {
+			t.Fatalf("error sending control message: %s", err)
+		}
+		var resp WSControlResponse
+		receive(&resp)
+		return resp
+	}
+
+	td := catalog.ThingDescription{wot.KeyThingID: "urn:example:test/thing1", "title": "example thing"}
+
+	t.Run("subscribe", func(t *testing.T) {
+		resp := control(WSControlMessage{Action: WSActionSubscribe, Types: []wot.EventType{wot.EventTypeCreate}, Diff: DiffMergePatch})
+		if !resp.OK {
+			t.Fatalf("subscription failed: %s", resp.Error)
+		}
+
+		go controller.CreateHandler(td)
+		var event Event
+		receive(&event)
+		if event.Type != wot.EventTypeCreate || event.Data["title"] != "example thing" {
+			t.Fatalf("unexpected event: %v", event)
+		}
+	})
+
+	t.Run("change subscription", func(t *testing.T) {
+		resp := control(WSControlMessage{Action: WSActionSubscribe, Types: []wot.EventType{wot.EventTypeDelete}})
+		if !resp.OK {
+			t.Fatalf("subscription failed: %s", resp.Error)
+		}
+
+		// only the deletion should be received
+		go func() {
+			controller.CreateHandler(td)
+			controller.DeleteHandler(td)
+		}()
+		var event Event
+		receive(&event)
+		if event.Type != wot.EventTypeDelete || event.Data[wot.KeyThingID] != td[wot.KeyThingID] {
+			t.Fatalf("unexpected event: %v", event)
+		}
+	})
+
+	t.Run("resume from event ID", func(t *testing.T) {
+		resp := control(WSControlMessage{Action: WSActionUnsubscribe})
+		if !resp.OK {
+			t.Fatalf("unsubscribing failed: %s", resp.Error)
+		}
+
+		// the missed events and the acknowledgement arrive in any order
+		err := websocket.JSON.Send(ws, WSControlMessage{Action: WSActionSubscribe, LastEventID: "0"})
+		if err != nil {
+			t.Fatalf("error sending control message: %s", err)
+		}
+		var types []wot.EventType
+		acknowledged := false
+		for !acknowledged || len(types) < 3 {
+			var raw json.RawMessage
+			receive(&raw)
+			var resp WSControlResponse
+			json.Unmarshal(raw, &resp)
+			if resp.Action == WSActionSubscribe {
+				acknowledged = true
+				continue
+			}
+			var event Event
+			json.Unmarshal(raw, &event)
+			types = append(types, event.Type)
+		}
+		expected := []wot.EventType{wot.EventTypeCreate, wot.EventTypeCreate, wot.EventTypeDelete}
+		if !reflect.DeepEqual(types, expected) {
+			t.Fatalf("received events %v instead of %v", types, expected)
+		}
+	})
+
+	t.Run("invalid type", func(t *testing.T) {
+		resp := control(WSControlMessage{Action: WSActionSubscribe, Types: []wot.EventType{"unknown"}})
+		if resp.OK || resp.Error == "" {
+			t.Fatalf("expected an error for invalid event type, got: %v", resp)
+		}
+	})
+}
@@ -9,9 +9,21 @@ const (
 	DNSSDServiceType             = "_wot._tcp"
 	DNSSDServiceSubtypeThing     = "_thing"     // _thing._sub._wot._tcp
 	DNSSDServiceSubtypeDirectory = "_directory" // _directory._sub._wot._tcp
+	// W3C WoT Discovery
+	WellKnownPath         = "/.well-known/wot"
+	ContextURLTD          = "https://www.w3.org/2019/wot/td/v1" // TD 1.0, as validated by the directory
+	ContextURLDiscovery   = "https://www.w3.org/2022/wot/discovery"
+	TypeThingDirectory    = "ThingDirectory"
+	TypeThingCollection   = "ThingCollection"
+	DiscoveryEventCreated = "thing_created"
+	DiscoveryEventUpdated = "thing_updated"
+	DiscoveryEventDeleted = "thing_deleted"
 	// Media Types
 	MediaTypeJSONLD = "application/ld+json"
 	MediaTypeJSON   = "application/json"
+	// Patch Media Types
+	MediaTypeMergePatch = "application/merge-patch+json"
+	MediaTypeJSONPatch  = "application/json-patch+json"
 	// TD keys used by directory
 	KeyThingID                   = "id"
 	KeyThingRegistration         = "registration"
@@ -19,10 +31,14 @@ const (
 	KeyThingRegistrationModified = "modified"
 	KeyThingRegistrationExpires  = "expires"
 	KeyThingRegistrationTTL      = "ttl"
+	KeyThingRegistrationRevision = "revision"
+	KeyThingRegistrationLastSeen = "lastSeen"
+	KeyThingRegistrationOrigin   = "origin" // source of the TDs registered by the directory itself, e.g. the peer of mirrored TDs
 	// TD event types
 	EventTypeCreate = "create"
 	EventTypeUpdate = "update"
 	EventTypeDelete = "delete"
+	EventTypeExpire = "expire" // deletion due to expiry of the registration
 )
 
 type EnrichedTD struct {
@@ -35,8 +51,11 @@ type EnrichedTD struct {
 type ThingRegistration struct {
 	Created   *time.Time `json:"created,omitempty"`
 	Expires   *time.Time `json:"expires,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
 	Modified  *time.Time `json:"modified,omitempty"`
+	Origin    string     `json:"origin,omitempty"`
 	Retrieved *time.Time `json:"retrieved,omitempty"`
+	Revision  *uint64    `json:"revision,omitempty"`
 	TTL       *float64   `json:"ttl,omitempty"`
 }
 
@@ -44,7 +63,7 @@ type EventType string
 
 func (e EventType) IsValid() bool {
 	switch e {
-	case EventTypeCreate, EventTypeUpdate, EventTypeDelete:
+	case EventTypeCreate, EventTypeUpdate, EventTypeDelete, EventTypeExpire:
 		return true
 	default:
 		return false